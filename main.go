@@ -1,40 +1,35 @@
 package main
 
 import (
-	// _ "net/http/pprof"
-	"net/http"
 	"proxy"
 	"runtime"
 	"sync"
-	"time"
 
 	log "github.com/cihub/seelog"
-	"github.com/samuel/go-zookeeper/zk"
 )
 
 func main() {
-	//initMonitor(config)
 	config := proxy.NewProxyConfig()
 	initLog()
 	initCpu(config)
+	proxy.SetMonitorMaxCommands(config.Monitor_max_commands)
+	proxy.InitSlowlogLogger(config.Slowlog_logger)
+	proxy.InitHealth(config)
+	proxy.InitTracing(config)
+	proxy.StartMetricsServer(config.Metrics_listen)
+	proxy.StartAdminServer(config)
 
-	zkConn := connectZookeeper(config.Zookeeper_servers)
+	zkConn, zkEvents := proxy.ConnectZookeeper(config.Zookeeper_servers)
+	registry := proxy.NewRegistry(config, zkConn, zkEvents)
 
-	log.Info("connect Zookeeper end!")
 	for i := 0; i < len(config.Proxy_clusters); i++ {
-		go proxy.StartRedisClusterProxy(&config.Proxy_clusters[i], zkConn)
+		go proxy.StartRedisClusterProxy(&config.Proxy_clusters[i], registry, zkConn)
 	}
 	var wg sync.WaitGroup
 	wg.Add(1)
 	wg.Wait()
 }
 
-func connectZookeeper(zks []string) *zk.Conn {
-	log.Info("connect Zookeeper started!")
-	conn, _, err := zk.Connect(zks, 60*time.Second)
-	proxy.Must(err)
-	return conn
-}
 func initCpu(config *proxy.ProxyConfig) {
 	log.Info("initCpu started!")
 	if config.Cpu_num > 0 {
@@ -44,13 +39,6 @@ func initCpu(config *proxy.ProxyConfig) {
 	}
 }
 
-func initMonitor(config *proxy.ProxyConfig) {
-	log.Info("monitor started!")
-	go func() {
-		log.Info(http.ListenAndServe("localhost:6060", nil))
-	}()
-}
-
 func initLog() {
 	logger, err := log.LoggerFromConfigAsFile("./seelog.xml")
 	if err != nil {
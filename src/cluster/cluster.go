@@ -0,0 +1,319 @@
+package cluster
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxRedirects bounds the MOVED and ASK redirections followed for one command.
+const maxRedirects = 5
+
+var (
+	ErrClosed           = errors.New("cluster: closed")
+	ErrNoNode           = errors.New("cluster: no node available")
+	ErrTooManyRedirects = errors.New("cluster: too many redirections")
+	// every connection of the pool stayed in use for the connect timeout
+	ErrPoolExhausted = errors.New("cluster: connection pool exhausted")
+)
+
+// Breaker is asked before a command is sent to a node and told how it went.
+type Breaker interface {
+	Allow(addr string) error
+	Record(addr string, err error)
+}
+
+// Options configures a Cluster.
+type Options struct {
+	StartNodes   []string
+	ConnTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// connections per node at most, a command waits up to ConnTimeout for
+	// one once they are all in use
+	PoolSize int
+	// idle connections older than this are closed, 0 keeps them
+	AliveTime time.Duration
+	// replies over them fail with ReplyTooLargeError, 0 is unlimited
+	ReplyMaxBytes    int
+	ReplyMaxElements int
+	// optional, guards every node a command is sent to
+	Breaker Breaker
+	// optional, called with the node answering MOVED or ASK
+	OnRedirect func(addr string, redirect string)
+}
+
+// Cluster sends every command to the master owning the slot of its first
+// argument, commands without one go to any node. The slot cache is loaded
+// from CLUSTER SLOTS, a MOVED updates it at once and reloads it in the
+// background, an ASK is followed once with ASKING. The commands of
+// multiKeyCommands are split by slot when their keys live in several slots.
+type Cluster struct {
+	options Options
+
+	mu     sync.RWMutex
+	slots  [SlotCount]string
+	pools  map[string]*Pool
+	closed bool
+	// as of the last CLUSTER SLOTS, MOVED only updates slots
+	ranges      []SlotRange
+	refreshedAt time.Time
+
+	refreshing int32
+}
+
+// NewCluster loads the slot cache from the first start node answering.
+func NewCluster(options *Options) (*Cluster, error) {
+	c := &Cluster{options: *options, pools: make(map[string]*Pool)}
+	if err := c.Refresh(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Do sends cmd to the node serving args and decodes the reply, see ReadReply.
+func (c *Cluster) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, _, err := c.do(0, replyDecoded, cmd, args)
+	return reply, err
+}
+
+// DoRaw is Do returning the reply as a Raw frame, a 0 readTimeout waits
+// Options.ReadTimeout.
+func (c *Cluster) DoRaw(readTimeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	reply, _, err := c.do(readTimeout, replyRaw, cmd, args)
+	return reply, err
+}
+
+// DoRawNode is DoRaw also returning the node that answered, empty when the
+// command was split over several nodes.
+func (c *Cluster) DoRawNode(readTimeout time.Duration, cmd string, args ...interface{}) (interface{}, string, error) {
+	return c.do(readTimeout, replyRaw, cmd, args)
+}
+
+// DoStreamNode is DoRawNode returning a reply that outgrows the largest
+// pooled buffer as a Stream, see Pool.DoStream. The replies of a split
+// command are merged, they are never streamed.
+func (c *Cluster) DoStreamNode(readTimeout time.Duration, cmd string, args ...interface{}) (interface{}, string, error) {
+	return c.do(readTimeout, replyStream, cmd, args)
+}
+
+func (c *Cluster) do(readTimeout time.Duration, mode replyMode, cmd string, args []interface{}) (interface{}, string, error) {
+	if split, ok := multiKeyCommands[cmd]; ok {
+		if groups := slotGroups(args, split.step); len(groups) > 1 {
+			if mode == replyStream {
+				mode = replyRaw
+			}
+			reply, err := c.doSplit(readTimeout, mode, cmd, args, split, groups)
+			return reply, "", err
+		}
+	}
+	return c.doSlot(readTimeout, mode, cmd, args)
+}
+
+// doSlot sends cmd to the master of the slot of args and follows MOVED and ASK.
+func (c *Cluster) doSlot(readTimeout time.Duration, mode replyMode, cmd string, args []interface{}) (interface{}, string, error) {
+	addr, err := c.nodeOf(args)
+	if err != nil {
+		return nil, "", err
+	}
+	asking := false
+	for i := 0; i <= maxRedirects; i++ {
+		pool, err := c.Pool(addr)
+		if err != nil {
+			return nil, addr, err
+		}
+		breaker := c.options.Breaker
+		if breaker != nil {
+			if err := breaker.Allow(addr); err != nil {
+				return nil, addr, err
+			}
+		}
+		reply, err := pool.do(readTimeout, asking, mode, cmd, args)
+		if breaker != nil {
+			breaker.Record(addr, err)
+		}
+		if err != nil {
+			return nil, addr, err
+		}
+		redisErr, ok := ReplyError(reply)
+		if !ok {
+			return reply, addr, nil
+		}
+		redirect, slot, to := parseRedirect(redisErr)
+		if redirect == "" {
+			return reply, addr, nil
+		}
+		Release(reply)
+		if c.options.OnRedirect != nil {
+			c.options.OnRedirect(addr, redirect)
+		}
+		if redirect == "MOVED" {
+			c.setSlot(slot, to)
+			c.triggerRefresh()
+		}
+		addr, asking = to, redirect == "ASK"
+	}
+	return nil, addr, ErrTooManyRedirects
+}
+
+// parseRedirect splits "MOVED <slot> <addr>" and "ASK <slot> <addr>", the
+// redirect is empty for other errors.
+func parseRedirect(redisErr Error) (string, int, string) {
+	fields := strings.Fields(string(redisErr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", 0, ""
+	}
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil || slot < 0 || slot >= SlotCount {
+		return "", 0, ""
+	}
+	return fields[0], slot, fields[2]
+}
+
+// nodeOf returns the master of the slot of args[0] as cached, any node if
+// the slot is unknown or there is no argument.
+func (c *Cluster) nodeOf(args []interface{}) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return "", ErrClosed
+	}
+	if len(args) > 0 {
+		var slot int
+		switch key := args[0].(type) {
+		case []byte:
+			slot = Slot(key)
+		case string:
+			slot = Slot([]byte(key))
+		default:
+			slot = -1
+		}
+		if slot >= 0 && c.slots[slot] != "" {
+			return c.slots[slot], nil
+		}
+	}
+	// map iteration picks a node at random
+	for addr := range c.pools {
+		return addr, nil
+	}
+	if len(c.options.StartNodes) > 0 {
+		return c.options.StartNodes[0], nil
+	}
+	return "", ErrNoNode
+}
+
+// Master returns the master of slot as cached, empty if unknown.
+func (c *Cluster) Master(slot int) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.slots[slot]
+}
+
+// SlotRanges returns the slot ranges of the last CLUSTER SLOTS.
+func (c *Cluster) SlotRanges() []SlotRange {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ranges
+}
+
+// RefreshedAt returns when CLUSTER SLOTS was last loaded.
+func (c *Cluster) RefreshedAt() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.refreshedAt
+}
+
+// Pool returns the connections to the node addr, the pool is created on the
+// first use.
+func (c *Cluster) Pool(addr string) (*Pool, error) {
+	c.mu.RLock()
+	pool, closed := c.pools[addr], c.closed
+	c.mu.RUnlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if pool != nil {
+		return pool, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pool = c.pools[addr]; pool == nil {
+		pool = NewPool(addr, c.options.PoolSize, c.options.ConnTimeout, c.options.ReadTimeout, c.options.WriteTimeout, "")
+		pool.aliveTime = c.options.AliveTime
+		pool.LimitReplies(c.options.ReplyMaxBytes, c.options.ReplyMaxElements)
+		c.pools[addr] = pool
+	}
+	return pool, nil
+}
+
+func (c *Cluster) setSlot(slot int, addr string) {
+	c.mu.Lock()
+	c.slots[slot] = addr
+	c.mu.Unlock()
+}
+
+func (c *Cluster) triggerRefresh() {
+	if !atomic.CompareAndSwapInt32(&c.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&c.refreshing, 0)
+		c.Refresh()
+	}()
+}
+
+// Refresh reloads the slot cache from the first start node or known node
+// answering CLUSTER SLOTS.
+func (c *Cluster) Refresh() error {
+	c.mu.RLock()
+	seeds := append([]string{}, c.options.StartNodes...)
+	for addr := range c.pools {
+		seeds = append(seeds, addr)
+	}
+	c.mu.RUnlock()
+
+	var lastErr error = ErrNoNode
+	for _, addr := range seeds {
+		pool, err := c.Pool(addr)
+		if err != nil {
+			return err
+		}
+		reply, err := pool.Do("CLUSTER", "SLOTS")
+		var slotRanges []SlotRange
+		if err == nil {
+			slotRanges, err = ParseSlots(reply)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var slots [SlotCount]string
+		for _, slotRange := range slotRanges {
+			for slot := slotRange.Start; slot <= slotRange.End && slot < SlotCount; slot++ {
+				slots[slot] = slotRange.Master
+			}
+		}
+		c.mu.Lock()
+		c.slots = slots
+		c.ranges = slotRanges
+		c.refreshedAt = time.Now()
+		c.mu.Unlock()
+		return nil
+	}
+	return lastErr
+}
+
+// Close closes the connections to every node, commands still running finish
+// on their connection.
+func (c *Cluster) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, pool := range c.pools {
+		pool.Close()
+	}
+}
@@ -0,0 +1,240 @@
+package cluster
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestCluster(t *testing.T, fc *fakeCluster) *Cluster {
+	c, err := NewCluster(&Options{
+		StartNodes:   []string{fc.nodes[0].addr},
+		ConnTimeout:  time.Second,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+		PoolSize:     4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func Test_ClusterRouting(t *testing.T) {
+	fc := startFakeCluster(t, 3)
+	c := newTestCluster(t, fc)
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		if reply, err := c.DoRaw(0, "SET", key, "v"+strconv.Itoa(i)); err != nil || string(reply.(Raw)) != "+OK\r\n" {
+			t.Fatalf("SET %s returned %q,%v", key, reply, err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		value := "v" + strconv.Itoa(i)
+		reply, err := c.DoRaw(0, "GET", []byte(key))
+		if err != nil || string(reply.(Raw)) != "$"+strconv.Itoa(len(value))+"\r\n"+value+"\r\n" {
+			t.Fatalf("GET %s returned %q,%v", key, reply, err)
+		}
+	}
+	if reply, err := c.Do("GET", "missing"); err != nil || reply != nil {
+		t.Errorf("GET of a missing key returned %v,%v", reply, err)
+	}
+	for i, node := range fc.nodes {
+		// 200 commands over 3 nodes, only node 0 answered CLUSTER SLOTS
+		if commands := atomic.LoadInt64(&node.commands); commands < 40 {
+			t.Errorf("node %d served %d commands", i, commands)
+		}
+	}
+	if reply, err := c.Do("PING"); err != nil || reply != "PONG" {
+		t.Errorf("keyless command returned %v,%v", reply, err)
+	}
+}
+
+func Test_ClusterMoved(t *testing.T) {
+	fc := startFakeCluster(t, 2)
+	c := newTestCluster(t, fc)
+	key := "moving"
+	slot := Slot([]byte(key))
+	c.Do("SET", key, "v")
+	from := fc.owner[slot]
+	to := 1 - from
+
+	var redirects []string
+	c.options.OnRedirect = func(addr string, redirect string) {
+		redirects = append(redirects, redirect+" from "+addr)
+	}
+	fc.move(slot, to)
+	before := atomic.LoadInt64(&fc.nodes[to].commands)
+	reply, node, err := c.DoRawNode(0, "GET", key)
+	if err != nil || string(reply.(Raw)) != "$1\r\nv\r\n" || node != fc.nodes[to].addr {
+		t.Fatalf("GET after MOVED returned %q,%v from %s", reply, err, node)
+	}
+	if len(redirects) != 1 || redirects[0] != "MOVED from "+fc.nodes[from].addr {
+		t.Errorf("redirects=%v", redirects)
+	}
+	c.mu.RLock()
+	cached := c.slots[slot]
+	c.mu.RUnlock()
+	if cached != fc.nodes[to].addr {
+		t.Errorf("slot %d still cached on %s", slot, cached)
+	}
+	// the background refresh agrees with the MOVED
+	time.Sleep(50 * time.Millisecond)
+	c.Do("GET", key)
+	if served := atomic.LoadInt64(&fc.nodes[to].commands) - before; served < 2 {
+		t.Errorf("new owner served %d commands", served)
+	}
+}
+
+func Test_ClusterAsk(t *testing.T) {
+	fc := startFakeCluster(t, 2)
+	c := newTestCluster(t, fc)
+	c.Do("SET", "a{tag}", "1")
+	c.Do("SET", "b{tag}", "2")
+	slot := Slot([]byte("{tag}"))
+	from := fc.owner[slot]
+
+	fc.migrate(slot, 1-from, "a{tag}")
+	if reply, err := c.DoRaw(0, "GET", "a{tag}"); err != nil || string(reply.(Raw)) != "$1\r\n1\r\n" {
+		t.Fatalf("GET of a migrated key returned %q,%v", reply, err)
+	}
+	if reply, err := c.DoRaw(0, "GET", "b{tag}"); err != nil || string(reply.(Raw)) != "$1\r\n2\r\n" {
+		t.Fatalf("GET of a key not migrated yet returned %q,%v", reply, err)
+	}
+	c.mu.RLock()
+	cached := c.slots[slot]
+	c.mu.RUnlock()
+	if cached != fc.nodes[from].addr {
+		t.Errorf("ASK changed the slot cache to %s", cached)
+	}
+}
+
+func Test_ClusterDown(t *testing.T) {
+	if _, err := NewCluster(&Options{StartNodes: []string{"127.0.0.1:1"}, ConnTimeout: 100 * time.Millisecond}); err == nil {
+		t.Error("cluster created without a reachable node")
+	}
+	fc := startFakeCluster(t, 1)
+	c := newTestCluster(t, fc)
+	c.Close()
+	if _, err := c.Do("GET", "k"); err != ErrClosed {
+		t.Errorf("closed cluster returned %v", err)
+	}
+}
+
+func Test_ClusterMultiKey(t *testing.T) {
+	fc := startFakeCluster(t, 3)
+	c := newTestCluster(t, fc)
+	var mset []interface{}
+	for i := 0; i < 10; i++ {
+		mset = append(mset, "key"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+	}
+	if groups := slotGroups(mset, 2); len(groups) < 2 {
+		t.Fatalf("keys in %d slots only", len(groups))
+	}
+	if reply, err := c.DoRaw(0, "MSET", mset...); err != nil || string(reply.(Raw)) != "+OK\r\n" {
+		t.Fatalf("cross slot MSET returned %q,%v", reply, err)
+	}
+
+	reply, err := c.DoRaw(0, "MGET", "key3", "missing", "key0", "key7")
+	if err != nil || string(reply.(Raw)) != "*4\r\n$2\r\nv3\r\n$-1\r\n$2\r\nv0\r\n$2\r\nv7\r\n" {
+		t.Fatalf("cross slot MGET returned %q,%v", reply, err)
+	}
+	decoded, err := c.Do("MGET", "key9", "key1")
+	if items, ok := decoded.([]interface{}); err != nil || !ok || len(items) != 2 ||
+		string(items[0].([]byte)) != "v9" || string(items[1].([]byte)) != "v1" {
+		t.Fatalf("decoded cross slot MGET returned %v,%v", decoded, err)
+	}
+
+	if reply, err := c.DoRaw(0, "EXISTS", "key1", "key2", "missing", "key1"); err != nil || string(reply.(Raw)) != ":3\r\n" {
+		t.Errorf("cross slot EXISTS returned %q,%v", reply, err)
+	}
+	if reply, err := c.Do("DEL", "key1", "key2", "key5"); err != nil || reply != int64(3) {
+		t.Errorf("cross slot DEL returned %v,%v", reply, err)
+	}
+
+	reply, err = c.DoRaw(0, "MSETNX", "key1", "a", "key2", "b")
+	if redisErr, ok := ReplyError(reply); err != nil || !ok || !strings.HasPrefix(string(redisErr), "CROSSSLOT") {
+		t.Errorf("cross slot MSETNX returned %q,%v", reply, err)
+	}
+	if reply, err := c.DoRaw(0, "MSETNX", "a{t}", "a", "b{t}", "b"); err != nil || string(reply.(Raw)) != ":1\r\n" {
+		t.Errorf("single slot MSETNX returned %q,%v", reply, err)
+	}
+}
+
+func Test_PoolSize(t *testing.T) {
+	fc := startFakeCluster(t, 1)
+	pool := NewPool(fc.nodes[0].addr, 2, 50*time.Millisecond, time.Second, time.Second, "")
+	defer pool.Close()
+	c1, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an idle connection is reused rather than another one dialed
+	pool.put(c1, nil)
+	if c, err := pool.get(); err != nil || c != c1 {
+		t.Fatalf("get with an idle connection returned %v,%v", c, err)
+	}
+	c2, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := pool.get(); err != ErrPoolExhausted {
+		t.Fatalf("third connection returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("gave up after %v, want the connect timeout", elapsed)
+	}
+
+	// a waiting command gets the connection given back
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pool.put(c1, nil)
+	}()
+	if c, err := pool.get(); err != nil || c != c1 {
+		t.Fatalf("waiting get returned %v,%v", c, err)
+	}
+	// a broken connection makes room for a new one
+	pool.put(c2, io.EOF)
+	c3, err := pool.get()
+	if err != nil || c3 == c2 {
+		t.Fatalf("get after a broken connection returned %v,%v", c3, err)
+	}
+	if n := len(pool.open); n != 2 {
+		t.Errorf("%d connections open, want 2", n)
+	}
+	// a connection idle for too long is replaced
+	pool.aliveTime = time.Millisecond
+	pool.put(c1, nil)
+	time.Sleep(5 * time.Millisecond)
+	if c, err := pool.get(); err != nil || c == c1 {
+		t.Fatalf("get after aliveTime returned %v,%v", c, err)
+	}
+	if n := len(pool.open); n != 2 {
+		t.Errorf("%d connections open, want 2", n)
+	}
+}
+
+func Test_PoolReplyLimits(t *testing.T) {
+	fc := startFakeCluster(t, 1)
+	pool := NewPool(fc.nodes[0].addr, 1, time.Second, time.Second, time.Second, "")
+	pool.LimitReplies(4, 0)
+	defer pool.Close()
+	if reply, err := pool.Do("SET", "k", "0123456789"); err != nil || reply != "OK" {
+		t.Fatalf("SET returned %v,%v", reply, err)
+	}
+	if _, err := pool.DoRaw(0, "GET", "k"); err != (ReplyTooLargeError{Bytes: 10}) {
+		t.Fatalf("GET over the limit returned %v", err)
+	}
+	if n := len(pool.open); n != 0 {
+		t.Errorf("connection with an unread reply kept, %d open", n)
+	}
+	if reply, err := pool.DoRaw(0, "GET", "missing"); err != nil || string(reply.(Raw)) != "$-1\r\n" {
+		t.Errorf("GET after the rejected reply returned %q,%v", reply, err)
+	}
+}
@@ -0,0 +1,309 @@
+package cluster
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Conn is a plain connection to one redis node.
+type Conn struct {
+	conn         net.Conn
+	br           *bufio.Reader
+	bw           *bufio.Writer
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// when the connection went back to its pool
+	idleSince time.Time
+	// of the raw replies, see ReplyTooLargeError
+	limits replyLimits
+}
+
+func Dial(addr string, connTimeout, readTimeout, writeTimeout time.Duration) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, connTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{
+		conn:         conn,
+		br:           bufio.NewReader(conn),
+		bw:           bufio.NewWriter(conn),
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+	}, nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// replyMode is how a reply is read.
+type replyMode int
+
+const (
+	// decoded, see ReadReply
+	replyDecoded replyMode = iota
+	// a Raw frame
+	replyRaw
+	// a Raw frame, or a Stream once it outgrows the largest pooled buffer
+	replyStream
+)
+
+// Do sends one command and decodes the reply, see ReadReply. An error reply
+// is returned as an Error reply, a non nil error means the connection is
+// broken.
+func (c *Conn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.do(c.readTimeout, false, replyDecoded, cmd, args)
+}
+
+// DoRaw is Do returning the reply as a Raw frame, waiting readTimeout for it.
+func (c *Conn) DoRaw(readTimeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return c.do(readTimeout, false, replyRaw, cmd, args)
+}
+
+// DoAsking is DoRaw preceded by ASKING, the node serves cmd for a slot it is
+// importing only right after ASKING. A refused ASKING is returned as an Error
+// reply.
+func (c *Conn) DoAsking(readTimeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return c.do(readTimeout, true, replyRaw, cmd, args)
+}
+
+// do returns a Stream still reading from c in replyStream mode, c must not
+// be used until the stream is done with it.
+func (c *Conn) do(readTimeout time.Duration, asking bool, mode replyMode, cmd string, args []interface{}) (interface{}, error) {
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	if asking {
+		writeCommand(c.bw, "ASKING", nil)
+	}
+	writeCommand(c.bw, cmd, args)
+	if err := c.bw.Flush(); err != nil {
+		return nil, err
+	}
+	if readTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	}
+	if asking {
+		reply, err := ReadReply(c.br)
+		if err != nil {
+			return nil, err
+		}
+		if reply != "OK" {
+			// keep the connection in sync before giving up
+			frame, err := ReadRaw(c.br)
+			if err != nil {
+				return nil, err
+			}
+			frame.Release()
+			return reply, nil
+		}
+	}
+	switch mode {
+	case replyRaw:
+		frame, err := readRawLimited(c.br, c.limits)
+		if err != nil {
+			// a reply too large is left unread, the connection is out of sync
+			return nil, err
+		}
+		return frame, nil
+	case replyStream:
+		return readStream(c, readTimeout)
+	}
+	return ReadReply(c.br)
+}
+
+// Pool holds up to size connections to one node, it dials while fewer are
+// open and none is idle.
+type Pool struct {
+	addr string
+	idle chan *Conn
+	// a token per open connection, idle or in use
+	open         chan struct{}
+	connTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// idle connections older than this are closed, 0 keeps them
+	aliveTime time.Duration
+	// sent on every new connection, e.g. READONLY for replicas
+	initCmd string
+	limits  replyLimits
+	closed  int32
+}
+
+// NewPool opens up to size connections to addr, once they are all in use a
+// command waits up to connTimeout for one and fails with ErrPoolExhausted, a
+// 0 connTimeout waits as long as it takes.
+func NewPool(addr string, size int, connTimeout, readTimeout, writeTimeout time.Duration, initCmd string) *Pool {
+	if size <= 0 {
+		size = 1
+	}
+	return &Pool{
+		addr:         addr,
+		idle:         make(chan *Conn, size),
+		open:         make(chan struct{}, size),
+		connTimeout:  connTimeout,
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+		initCmd:      initCmd,
+	}
+}
+
+func (pool *Pool) Addr() string {
+	return pool.addr
+}
+
+// LimitReplies makes the raw replies over maxBytes of payload or maxElements
+// array elements fail with ReplyTooLargeError, 0 is unlimited. It must be
+// called before the pool is used.
+func (pool *Pool) LimitReplies(maxBytes, maxElements int) {
+	pool.limits = replyLimits{bytes: maxBytes, elements: maxElements}
+}
+
+func (pool *Pool) get() (*Conn, error) {
+	for {
+		c, err := pool.take()
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			return pool.dial()
+		}
+		if pool.aliveTime > 0 && time.Since(c.idleSince) > pool.aliveTime {
+			pool.closeConn(c)
+			continue
+		}
+		return c, nil
+	}
+}
+
+// take returns an idle connection, or else takes a token for a new one while
+// fewer than size are open and returns nil, or else waits up to connTimeout
+// for either, as long as it takes without a connect timeout like Dial.
+func (pool *Pool) take() (*Conn, error) {
+	select {
+	case c := <-pool.idle:
+		return c, nil
+	default:
+	}
+	select {
+	case c := <-pool.idle:
+		return c, nil
+	case pool.open <- struct{}{}:
+		return nil, nil
+	default:
+	}
+	var timeout <-chan time.Time
+	if pool.connTimeout > 0 {
+		timer := time.NewTimer(pool.connTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case c := <-pool.idle:
+		return c, nil
+	case pool.open <- struct{}{}:
+		return nil, nil
+	case <-timeout:
+		return nil, ErrPoolExhausted
+	}
+}
+
+// dial opens the connection get took a token for, the token is given back
+// if it fails.
+func (pool *Pool) dial() (*Conn, error) {
+	c, err := Dial(pool.addr, pool.connTimeout, pool.readTimeout, pool.writeTimeout)
+	if err != nil {
+		<-pool.open
+		return nil, err
+	}
+	c.limits = pool.limits
+	if pool.initCmd != "" {
+		reply, err := c.Do(pool.initCmd)
+		if err == nil {
+			if redisErr, ok := reply.(Error); ok {
+				err = redisErr
+			}
+		}
+		if err != nil {
+			pool.closeConn(c)
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// closeConn closes c and gives its token back.
+func (pool *Pool) closeConn(c *Conn) {
+	c.Close()
+	<-pool.open
+}
+
+func (pool *Pool) put(c *Conn, err error) {
+	if err != nil || atomic.LoadInt32(&pool.closed) == 1 {
+		pool.closeConn(c)
+		return
+	}
+	c.idleSince = time.Now()
+	select {
+	case pool.idle <- c:
+	default:
+		pool.closeConn(c)
+	}
+}
+
+// Do runs Conn.Do on a pooled connection.
+func (pool *Pool) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return pool.do(0, false, replyDecoded, cmd, args)
+}
+
+// DoRaw runs Conn.DoRaw on a pooled connection, a 0 readTimeout waits the
+// read timeout of the pool.
+func (pool *Pool) DoRaw(readTimeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return pool.do(readTimeout, false, replyRaw, cmd, args)
+}
+
+// DoStream is DoRaw returning a reply that outgrows the largest pooled
+// buffer as a Stream, which holds its connection until it is written or
+// released.
+func (pool *Pool) DoStream(readTimeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return pool.do(readTimeout, false, replyStream, cmd, args)
+}
+
+// DoAsking runs Conn.DoAsking on a pooled connection.
+func (pool *Pool) DoAsking(readTimeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return pool.do(readTimeout, true, replyRaw, cmd, args)
+}
+
+func (pool *Pool) do(readTimeout time.Duration, asking bool, mode replyMode, cmd string, args []interface{}) (interface{}, error) {
+	c, err := pool.get()
+	if err != nil {
+		return nil, err
+	}
+	if readTimeout == 0 {
+		readTimeout = pool.readTimeout
+	}
+	reply, err := c.do(readTimeout, asking, mode, cmd, args)
+	if stream, ok := reply.(*Stream); ok {
+		// the stream gives c back once done with it
+		stream.pool = pool
+		return stream, nil
+	}
+	pool.put(c, err)
+	return reply, err
+}
+
+// Close closes the idle connections, connections in use are closed when they
+// are given back.
+func (pool *Pool) Close() {
+	atomic.StoreInt32(&pool.closed, 1)
+	for {
+		select {
+		case c := <-pool.idle:
+			pool.closeConn(c)
+		default:
+			return
+		}
+	}
+}
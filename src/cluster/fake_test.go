@@ -0,0 +1,200 @@
+package cluster
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeCluster is an in-process redis cluster serving GET, SET, MGET, MSET,
+// MSETNX, DEL, EXISTS, PING and CLUSTER SLOTS, it answers MOVED, ASK and
+// CROSSSLOT the way redis does.
+type fakeCluster struct {
+	nodes []*fakeNode
+
+	mu    sync.Mutex
+	owner [SlotCount]int
+	// slot -> node importing it, the keys already moved live there
+	migrating map[int]int
+}
+
+type fakeNode struct {
+	addr     string
+	data     map[string][]byte
+	commands int64
+}
+
+// startFakeCluster starts n nodes sharing the slots evenly.
+func startFakeCluster(t *testing.T, n int) *fakeCluster {
+	fc := &fakeCluster{migrating: make(map[int]int)}
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		node := &fakeNode{addr: ln.Addr().String(), data: make(map[string][]byte)}
+		fc.nodes = append(fc.nodes, node)
+		go fc.serve(ln, i)
+	}
+	for slot := range fc.owner {
+		fc.owner[slot] = slot * n / SlotCount
+	}
+	return fc
+}
+
+func (fc *fakeCluster) serve(ln net.Listener, i int) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			br, bw := bufio.NewReader(conn), bufio.NewWriter(conn)
+			asking := false
+			for {
+				request, err := ReadReply(br)
+				if err != nil {
+					return
+				}
+				args := request.([]interface{})
+				cmd := string(args[0].([]byte))
+				if cmd == "ASKING" {
+					asking = true
+					bw.WriteString("+OK\r\n")
+				} else {
+					bw.WriteString(fc.handle(i, cmd, args[1:], asking))
+					asking = false
+				}
+				bw.Flush()
+			}
+		}()
+	}
+}
+
+func (fc *fakeCluster) handle(i int, cmd string, args []interface{}, asking bool) string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	node := fc.nodes[i]
+	atomic.AddInt64(&node.commands, 1)
+	switch cmd {
+	case "PING":
+		return "+PONG\r\n"
+	case "CLUSTER":
+		return fc.clusterSlots()
+	case "GET", "MGET", "DEL", "EXISTS", "SET", "MSET", "MSETNX":
+	default:
+		return "-ERR unknown command '" + cmd + "'\r\n"
+	}
+	step := 1
+	if cmd == "SET" || cmd == "MSET" || cmd == "MSETNX" {
+		step = 2
+	}
+	key := args[0].([]byte)
+	slot := Slot(key)
+	for k := step; k < len(args); k += step {
+		if Slot(args[k].([]byte)) != slot {
+			return "-CROSSSLOT Keys in request don't hash to the same slot\r\n"
+		}
+	}
+	_, stored := node.data[string(key)]
+	target, migrating := fc.migrating[slot]
+	switch {
+	case fc.owner[slot] == i && migrating && !stored:
+		return "-ASK " + strconv.Itoa(slot) + " " + fc.nodes[target].addr + "\r\n"
+	case fc.owner[slot] != i && !(asking && migrating && target == i):
+		return "-MOVED " + strconv.Itoa(slot) + " " + fc.nodes[fc.owner[slot]].addr + "\r\n"
+	}
+	switch cmd {
+	case "SET", "MSET":
+		for k := 0; k < len(args); k += 2 {
+			node.data[string(args[k].([]byte))] = args[k+1].([]byte)
+		}
+		return "+OK\r\n"
+	case "MSETNX":
+		for k := 0; k < len(args); k += 2 {
+			if _, ok := node.data[string(args[k].([]byte))]; ok {
+				return ":0\r\n"
+			}
+		}
+		for k := 0; k < len(args); k += 2 {
+			node.data[string(args[k].([]byte))] = args[k+1].([]byte)
+		}
+		return ":1\r\n"
+	case "DEL", "EXISTS":
+		n := 0
+		for _, arg := range args {
+			if _, ok := node.data[string(arg.([]byte))]; ok {
+				n++
+				if cmd == "DEL" {
+					delete(node.data, string(arg.([]byte)))
+				}
+			}
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "MGET":
+		reply := "*" + strconv.Itoa(len(args)) + "\r\n"
+		for _, arg := range args {
+			reply += bulk(node.data, arg.([]byte))
+		}
+		return reply
+	}
+	return bulk(node.data, key)
+}
+
+func bulk(data map[string][]byte, key []byte) string {
+	value, ok := data[string(key)]
+	if !ok {
+		return "$-1\r\n"
+	}
+	return "$" + strconv.Itoa(len(value)) + "\r\n" + string(value) + "\r\n"
+}
+
+func (fc *fakeCluster) clusterSlots() string {
+	var ranges []string
+	for start := 0; start < SlotCount; {
+		end := start
+		for end+1 < SlotCount && fc.owner[end+1] == fc.owner[start] {
+			end++
+		}
+		host, port, _ := net.SplitHostPort(fc.nodes[fc.owner[start]].addr)
+		ranges = append(ranges, "*3\r\n:"+strconv.Itoa(start)+"\r\n:"+strconv.Itoa(end)+"\r\n"+
+			"*3\r\n$"+strconv.Itoa(len(host))+"\r\n"+host+"\r\n:"+port+"\r\n$2\r\nid\r\n")
+		start = end + 1
+	}
+	reply := "*" + strconv.Itoa(len(ranges)) + "\r\n"
+	for _, r := range ranges {
+		reply += r
+	}
+	return reply
+}
+
+// move hands slot over to node to with its keys, the way a finished
+// migration does.
+func (fc *fakeCluster) move(slot int, to int) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	from := fc.nodes[fc.owner[slot]]
+	for key, value := range from.data {
+		if Slot([]byte(key)) == slot {
+			fc.nodes[to].data[key] = value
+			delete(from.data, key)
+		}
+	}
+	fc.owner[slot] = to
+	delete(fc.migrating, slot)
+}
+
+// migrate starts moving slot to node to and moves key only.
+func (fc *fakeCluster) migrate(slot int, to int, key string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	from := fc.nodes[fc.owner[slot]]
+	fc.nodes[to].data[key] = from.data[key]
+	delete(from.data, key)
+	fc.migrating[slot] = to
+}
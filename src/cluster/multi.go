@@ -0,0 +1,191 @@
+package cluster
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// multiKey describes a command taking keys, or key value pairs, only.
+type multiKey struct {
+	// arguments per key
+	step int
+	// merges the replies of the slots in the order of the keys, nil if the
+	// command can not be split
+	merge func(raw bool, keys int, groups [][]int, replies []interface{}) (interface{}, error)
+}
+
+// multiKeyCommands are split by slot when their keys live in several slots,
+// the replies are merged as if a single node had served them.
+var multiKeyCommands = map[string]multiKey{
+	"MGET":   {step: 1, merge: mergeArrays},
+	"MSET":   {step: 2, merge: mergeStatus},
+	"DEL":    {step: 1, merge: mergeSum},
+	"UNLINK": {step: 1, merge: mergeSum},
+	"EXISTS": {step: 1, merge: mergeSum},
+	"TOUCH":  {step: 1, merge: mergeSum},
+	// all or nothing can not hold over several nodes
+	"MSETNX": {step: 2},
+}
+
+// slotGroups returns the indexes of the keys of args grouped by slot, in the
+// order the slots first appear. Nil if a key is missing or not a string.
+func slotGroups(args []interface{}, step int) [][]int {
+	if len(args) == 0 || len(args)%step != 0 {
+		return nil
+	}
+	var groups [][]int
+	index := make(map[int]int)
+	for k := 0; k*step < len(args); k++ {
+		key, ok := argBytes(args[k*step])
+		if !ok {
+			return nil
+		}
+		slot := Slot(key)
+		if i, ok := index[slot]; ok {
+			groups[i] = append(groups[i], k)
+			continue
+		}
+		index[slot] = len(groups)
+		groups = append(groups, []int{k})
+	}
+	return groups
+}
+
+func argBytes(arg interface{}) ([]byte, bool) {
+	switch arg := arg.(type) {
+	case []byte:
+		return arg, true
+	case string:
+		return []byte(arg), true
+	}
+	return nil, false
+}
+
+// doSplit runs cmd once per slot group in parallel. The first error, then the
+// first error reply, is returned as is.
+func (c *Cluster) doSplit(readTimeout time.Duration, mode replyMode, cmd string, args []interface{}, split multiKey, groups [][]int) (interface{}, error) {
+	raw := mode != replyDecoded
+	if split.merge == nil {
+		return errorReply(raw, "CROSSSLOT "+cmd+" keys in different slots can not be split"), nil
+	}
+	replies := make([]interface{}, len(groups))
+	errs := make([]error, len(groups))
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		go func(i int, group []int) {
+			defer wg.Done()
+			groupArgs := make([]interface{}, 0, len(group)*split.step)
+			for _, k := range group {
+				groupArgs = append(groupArgs, args[k*split.step:(k+1)*split.step]...)
+			}
+			replies[i], _, errs[i] = c.doSlot(readTimeout, mode, cmd, groupArgs)
+		}(i, group)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, reply := range replies {
+		if _, ok := ReplyError(reply); ok {
+			return reply, nil
+		}
+	}
+	merged, err := split.merge(raw, len(args)/split.step, groups, replies)
+	// merged is a copy
+	for _, reply := range replies {
+		if r, ok := reply.(Raw); ok {
+			r.Release()
+		}
+	}
+	return merged, err
+}
+
+func errorReply(raw bool, msg string) interface{} {
+	if raw {
+		return Raw("-" + msg + "\r\n")
+	}
+	return Error(msg)
+}
+
+// mergeArrays puts the elements of the replies back in the order of the keys.
+func mergeArrays(raw bool, keys int, groups [][]int, replies []interface{}) (interface{}, error) {
+	if !raw {
+		merged := make([]interface{}, keys)
+		for i, group := range groups {
+			items, ok := replies[i].([]interface{})
+			if !ok || len(items) != len(group) {
+				return nil, ProtocolError("unexpected reply of a split command")
+			}
+			for j, k := range group {
+				merged[k] = items[j]
+			}
+		}
+		return merged, nil
+	}
+	items := make([][]byte, keys)
+	for i, group := range groups {
+		r, ok := replies[i].(Raw)
+		end := lineEnd(r)
+		if !ok || end < 0 || r[0] != '*' {
+			return nil, ProtocolError("unexpected reply of a split command")
+		}
+		if n, err := parseInt(r[1:end]); err != nil || n != int64(len(group)) {
+			return nil, ProtocolError("unexpected reply of a split command")
+		}
+		next := end + 2
+		for _, k := range group {
+			_, n := rawSize(r[next:])
+			items[k] = r[next : next+n]
+			next += n
+		}
+	}
+	merged := newRawBuffer()
+	merged = append(merged, '*')
+	merged = strconv.AppendInt(merged, int64(keys), 10)
+	merged = append(merged, '\r', '\n')
+	for _, item := range items {
+		merged = append(merged, item...)
+	}
+	return Raw(merged), nil
+}
+
+// mergeStatus replies the status of the first slot, the others are the same.
+func mergeStatus(raw bool, keys int, groups [][]int, replies []interface{}) (interface{}, error) {
+	if r, ok := replies[0].(Raw); ok {
+		return Raw(append(newRawBuffer(), r...)), nil
+	}
+	return replies[0], nil
+}
+
+// mergeSum adds up the integer replies.
+func mergeSum(raw bool, keys int, groups [][]int, replies []interface{}) (interface{}, error) {
+	var sum int64
+	for _, reply := range replies {
+		switch r := reply.(type) {
+		case int64:
+			sum += r
+		case Raw:
+			end := lineEnd(r)
+			if end < 0 || r[0] != ':' {
+				return nil, ProtocolError("unexpected reply of a split command")
+			}
+			n, err := parseInt(r[1:end])
+			if err != nil {
+				return nil, err
+			}
+			sum += n
+		default:
+			return nil, ProtocolError("unexpected reply of a split command")
+		}
+	}
+	if !raw {
+		return sum, nil
+	}
+	merged := append(newRawBuffer(), ':')
+	merged = strconv.AppendInt(merged, sum, 10)
+	return Raw(append(merged, '\r', '\n')), nil
+}
@@ -0,0 +1,394 @@
+package cluster
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"sync"
+
+	"util"
+)
+
+// Error is an error reply of a redis node.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// ProtocolError is a reply that is not valid RESP, the connection it was read
+// from is out of sync.
+type ProtocolError string
+
+func (pe ProtocolError) Error() string {
+	return "cluster: " + string(pe)
+}
+
+// ReplyTooLargeError is a reply over the reply limits of a pool, it is left
+// unread and its connection closed. Elements is the length of an array over
+// the elements limit, otherwise Bytes is the payload announced so far.
+type ReplyTooLargeError struct {
+	Bytes    int
+	Elements int
+}
+
+func (e ReplyTooLargeError) Error() string {
+	if e.Elements > 0 {
+		return "cluster: reply of " + strconv.Itoa(e.Elements) + " elements over the limit"
+	}
+	return "cluster: reply of at least " + strconv.Itoa(e.Bytes) + " bytes over the limit"
+}
+
+// replyLimits bounds the payload bytes and the array elements of the replies
+// readRaw reads, 0 is unlimited. Elements only bound the top level array,
+// the same as Raw.Size counts them.
+type replyLimits struct {
+	bytes    int
+	elements int
+}
+
+// Raw is one complete RESP reply frame as sent by the node, terminating CRLF
+// included. ReadRaw copies it out of the connection buffer into a pooled
+// buffer without decoding it, the whole frame is held until it is written to
+// the client, then Release gives the buffer back. Where a Stream is asked
+// for, a frame outgrowing rawBufferMax is not held whole, see Stream.
+type Raw []byte
+
+// rawBufferMax is the largest frame buffer kept for reuse, a big reply does
+// not stay in memory once written.
+const rawBufferMax = 64 * 1024
+
+var rawPool = sync.Pool{New: func() interface{} {
+	p := make([]byte, 0, 512)
+	return &p
+}}
+
+func newRawBuffer() []byte {
+	return (*rawPool.Get().(*[]byte))[:0]
+}
+
+// Release gives the buffer of r back to the pool, r must not be used
+// afterwards. Only the owner of a reply releases it, a reply never released
+// is simply collected.
+func (r Raw) Release() {
+	if cap(r) == 0 || cap(r) > rawBufferMax {
+		return
+	}
+	p := []byte(r[:0])
+	rawPool.Put(&p)
+}
+
+// Err returns the message of an error reply.
+func (r Raw) Err() (Error, bool) {
+	if len(r) < 3 || r[0] != '-' {
+		return "", false
+	}
+	return Error(r[1 : len(r)-2]), true
+}
+
+// Size returns the payload bytes of the reply and the number of elements of
+// an array reply, the same as counting the decoded strings.
+func (r Raw) Size() (int, int) {
+	size, _ := rawSize(r)
+	if end := lineEnd(r); end > 0 && r[0] == '*' {
+		if n, _ := parseInt(r[1:end]); n > 0 {
+			return size, int(n)
+		}
+	}
+	return size, 0
+}
+
+// rawSize returns the payload bytes of the frame starting p and where the
+// frame ends.
+func rawSize(p []byte) (int, int) {
+	end := lineEnd(p)
+	if end < 0 {
+		return 0, len(p)
+	}
+	switch p[0] {
+	case '+':
+		return end - 1, end + 2
+	case '$':
+		n, _ := parseInt(p[1:end])
+		if n < 0 {
+			return 0, end + 2
+		}
+		return int(n), end + 2 + int(n) + 2
+	case '*':
+		n, _ := parseInt(p[1:end])
+		size, next := 0, end+2
+		for i := int64(0); i < n && next < len(p); i++ {
+			itemSize, itemLen := rawSize(p[next:])
+			size += itemSize
+			next += itemLen
+		}
+		return size, next
+	}
+	return 0, end + 2
+}
+
+func lineEnd(p []byte) int {
+	for i := 0; i+1 < len(p); i++ {
+		if p[i] == '\r' && p[i+1] == '\n' {
+			return i
+		}
+	}
+	return -1
+}
+
+// ReplyError returns the error of a decoded or raw error reply.
+func ReplyError(reply interface{}) (Error, bool) {
+	switch r := reply.(type) {
+	case Error:
+		return r, true
+	case Raw:
+		return r.Err()
+	}
+	return "", false
+}
+
+// ReadReply decodes one reply: status replies are strings, error replies
+// Error, integers int64, bulk strings []byte, arrays []interface{} and null
+// replies nil.
+func ReadReply(br *bufio.Reader) (interface{}, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, ProtocolError("short response line")
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return Error(string(line[1:])), nil
+	case ':':
+		return parseInt(line[1:])
+	case '$':
+		n, err := parseInt(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		p := make([]byte, n+2)
+		if _, err := io.ReadFull(br, p); err != nil {
+			return nil, err
+		}
+		return p[:n], nil
+	case '*':
+		n, err := parseInt(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		replies := make([]interface{}, n)
+		for i := range replies {
+			if replies[i], err = ReadReply(br); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, ProtocolError("unexpected response line " + string(line))
+}
+
+// ReadRaw reads one reply frame without decoding it into a buffer of the
+// pool, bulk payloads are copied once from the connection into the frame.
+func ReadRaw(br *bufio.Reader) (Raw, error) {
+	return readRawLimited(br, replyLimits{})
+}
+
+// readRawLimited is ReadRaw failing with ReplyTooLargeError as soon as a
+// header announces more than limits allow, before the payload is read.
+func readRawLimited(br *bufio.Reader, limits replyLimits) (Raw, error) {
+	r := rawReader{br: br, limits: limits, pending: 1}
+	frame, _, err := readRaw(&r, newRawBuffer(), 0)
+	if err != nil {
+		Raw(frame).Release()
+		return nil, err
+	}
+	return Raw(frame), nil
+}
+
+// readRaw appends the lines of the frame r reads to frame. With a maxFrame
+// it stops before frame grows past it and returns the length of the bulk
+// string that would have, CRLF included, 0 if it stopped between two lines.
+// The frame is complete if r has no line pending and nothing is left.
+func readRaw(r *rawReader, frame []byte, maxFrame int) ([]byte, int, error) {
+	for r.pending > 0 {
+		if maxFrame > 0 && len(frame) >= maxFrame {
+			return frame, 0, nil
+		}
+		line, n, err := r.next()
+		if err != nil {
+			return frame, 0, err
+		}
+		frame = append(frame, line...)
+		if n < 0 {
+			continue
+		}
+		if maxFrame > 0 && len(frame)+n+2 > maxFrame {
+			return frame, n + 2, nil
+		}
+		start := len(frame)
+		if cap(frame)-start < n+2 {
+			grown := make([]byte, start, 2*start+n+2)
+			copy(grown, frame)
+			frame = grown
+		}
+		frame = frame[:start+n+2]
+		if _, err := io.ReadFull(r.br, frame[start:]); err != nil {
+			return frame, 0, err
+		}
+		if frame[len(frame)-2] != '\r' || frame[len(frame)-1] != '\n' {
+			return frame, 0, ProtocolError("bad bulk string format")
+		}
+	}
+	return frame, 0, nil
+}
+
+// rawReader walks the header lines of a reply frame without decoding it and
+// checks them against limits.
+type rawReader struct {
+	br     *bufio.Reader
+	limits replyLimits
+	// lines of the frame not read yet, bulk payloads aside
+	pending int
+	// payload bytes so far, as counted by rawSize
+	size int
+	// of the top level array, 0 for other replies
+	elements int
+	started  bool
+}
+
+// next reads the next line of the frame, CRLF included, and returns the
+// length of the bulk payload that follows it, -1 if none. The line is only
+// valid until the next read from br.
+func (r *rawReader) next() ([]byte, int, error) {
+	line, err := r.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, -1, ProtocolError("response line longer than buffer")
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, -1, ProtocolError("bad response line terminator")
+	}
+	r.pending--
+	top := !r.started
+	r.started = true
+	switch line[0] {
+	case '-', ':':
+	case '+':
+		if r.size += len(line) - 3; r.limits.bytes > 0 && r.size > r.limits.bytes {
+			return nil, -1, ReplyTooLargeError{Bytes: r.size}
+		}
+	case '$':
+		n, err := parseInt(line[1 : len(line)-2])
+		if err != nil {
+			return nil, -1, err
+		}
+		if n < 0 {
+			return line, -1, nil
+		}
+		if r.size += int(n); r.limits.bytes > 0 && r.size > r.limits.bytes {
+			return nil, -1, ReplyTooLargeError{Bytes: r.size}
+		}
+		return line, int(n), nil
+	case '*':
+		n, err := parseInt(line[1 : len(line)-2])
+		if err != nil {
+			return nil, -1, err
+		}
+		if top && r.limits.elements > 0 && n > int64(r.limits.elements) {
+			return nil, -1, ReplyTooLargeError{Elements: int(n)}
+		}
+		if n > 0 {
+			if top {
+				r.elements = int(n)
+			}
+			r.pending += int(n)
+		}
+	default:
+		return nil, -1, ProtocolError("unexpected response line " + string(line[:len(line)-2]))
+	}
+	return line, -1, nil
+}
+
+// writeCommand writes cmd and args as a RESP array of bulk strings.
+func writeCommand(bw *bufio.Writer, cmd string, args []interface{}) {
+	bw.WriteByte('*')
+	bw.WriteString(util.Itoa(len(args) + 1))
+	bw.WriteString("\r\n")
+	writeBulkString(bw, cmd)
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case []byte:
+			writeBulk(bw, arg)
+		case string:
+			writeBulkString(bw, arg)
+		case int:
+			writeBulkString(bw, strconv.Itoa(arg))
+		case int64:
+			writeBulkString(bw, strconv.FormatInt(arg, 10))
+		default:
+			panic("cluster: unsupported argument type")
+		}
+	}
+}
+
+func writeBulk(bw *bufio.Writer, arg []byte) {
+	bw.WriteByte('$')
+	bw.WriteString(util.Itoa(len(arg)))
+	bw.WriteString("\r\n")
+	bw.Write(arg)
+	bw.WriteString("\r\n")
+}
+
+func writeBulkString(bw *bufio.Writer, arg string) {
+	bw.WriteByte('$')
+	bw.WriteString(util.Itoa(len(arg)))
+	bw.WriteString("\r\n")
+	bw.WriteString(arg)
+	bw.WriteString("\r\n")
+}
+
+func readLine(br *bufio.Reader) ([]byte, error) {
+	p, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, ProtocolError("response line longer than buffer")
+	}
+	if err != nil {
+		return nil, err
+	}
+	i := len(p) - 2
+	if i < 0 || p[i] != '\r' {
+		return nil, ProtocolError("bad response line terminator")
+	}
+	return p[:i], nil
+}
+
+func parseInt(p []byte) (int64, error) {
+	if len(p) == 0 {
+		return 0, ProtocolError("malformed integer")
+	}
+	var negate bool
+	if p[0] == '-' {
+		negate = true
+		p = p[1:]
+		if len(p) == 0 {
+			return 0, ProtocolError("malformed integer")
+		}
+	}
+	var n int64
+	for _, b := range p {
+		if b < '0' || b > '9' {
+			return 0, ProtocolError("illegal bytes in integer")
+		}
+		n = n*10 + int64(b-'0')
+	}
+	if negate {
+		n = -n
+	}
+	return n, nil
+}
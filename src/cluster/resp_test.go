@@ -0,0 +1,103 @@
+package cluster
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func Test_Slot(t *testing.T) {
+	if crc16([]byte("123456789")) != 0x31C3 {
+		t.Errorf("crc16 mismatch %x", crc16([]byte("123456789")))
+	}
+	if slot := Slot([]byte("foo")); slot != 12182 {
+		t.Errorf("slot of foo is %d", slot)
+	}
+	if Slot([]byte("{user1000}.following")) != Slot([]byte("{user1000}.followers")) {
+		t.Error("hash tags are not respected")
+	}
+	if Slot([]byte("{}foo")) != int(crc16([]byte("{}foo"))%SlotCount) {
+		t.Error("empty hash tag must hash the whole key")
+	}
+}
+
+func Test_ReadRaw(t *testing.T) {
+	frames := []string{
+		"+OK\r\n",
+		"-ERR wrong type\r\n",
+		":42\r\n",
+		"$-1\r\n",
+		"$0\r\n\r\n",
+		"$12\r\nhello\r\nworld\r\n",
+		"*-1\r\n",
+		"*3\r\n$1\r\na\r\n*2\r\n:1\r\n$-1\r\n+status\r\n",
+	}
+	br := bufio.NewReader(strings.NewReader(strings.Join(frames, "")))
+	for _, frame := range frames {
+		raw, err := ReadRaw(br)
+		if err != nil || string(raw) != frame {
+			t.Errorf("read %q,%v, want %q", raw, err, frame)
+		}
+	}
+	if _, err := ReadRaw(bufio.NewReader(strings.NewReader("$3\r\nabcde\r\n"))); err == nil {
+		t.Error("bulk string longer than its length accepted")
+	}
+	if _, err := ReadRaw(bufio.NewReader(strings.NewReader("*2\r\n$1\r\na\r\n"))); err == nil {
+		t.Error("truncated array accepted")
+	}
+}
+
+func Test_ReadRawLimits(t *testing.T) {
+	limits := replyLimits{bytes: 10, elements: 2}
+	for _, c := range []struct {
+		frame string
+		err   error
+	}{
+		{"$10\r\n0123456789\r\n", nil},
+		{"$11\r\n0123456789a\r\n", ReplyTooLargeError{Bytes: 11}},
+		{"*2\r\n$6\r\n012345\r\n$6\r\n012345\r\n", ReplyTooLargeError{Bytes: 12}},
+		{"*3\r\n:1\r\n:2\r\n:3\r\n", ReplyTooLargeError{Elements: 3}},
+		// nested arrays are not counted, like Raw.Size
+		{"*1\r\n*3\r\n:1\r\n:2\r\n:3\r\n", nil},
+	} {
+		raw, err := readRawLimited(bufio.NewReader(strings.NewReader(c.frame)), limits)
+		if err != c.err || (err == nil && string(raw) != c.frame) {
+			t.Errorf("read %q,%v from %q, want %v", raw, err, c.frame, c.err)
+		}
+	}
+}
+
+func Test_RawSize(t *testing.T) {
+	resp := "*4\r\n$2\r\nf1\r\n$2\r\nv1\r\n$2\r\nf2\r\n$5\r\nvalue\r\n"
+	raw, _ := ReadRaw(bufio.NewReader(strings.NewReader(resp)))
+	if size, elements := raw.Size(); size != 11 || elements != 4 {
+		t.Errorf("size=%d,elements=%d", size, elements)
+	}
+	if size, elements := Raw("$5\r\nhello\r\n").Size(); size != 5 || elements != 0 {
+		t.Errorf("bulk size=%d,elements=%d", size, elements)
+	}
+	if redisErr, ok := ReplyError(Raw("-MOVED 1 127.0.0.1:7000\r\n")); !ok || redisErr != "MOVED 1 127.0.0.1:7000" {
+		t.Errorf("raw error reply read as %q", redisErr)
+	}
+	if _, ok := ReplyError(Raw("+OK\r\n")); ok {
+		t.Error("status reply read as an error")
+	}
+}
+
+func Test_ParseSlots(t *testing.T) {
+	resp := "*2\r\n" +
+		"*4\r\n:8192\r\n:16383\r\n*3\r\n$8\r\n10.0.0.2\r\n:7000\r\n$2\r\nid\r\n*3\r\n$8\r\n10.0.0.4\r\n:7001\r\n$2\r\nid\r\n" +
+		"*3\r\n:0\r\n:8191\r\n*3\r\n$8\r\n10.0.0.1\r\n:7000\r\n$2\r\nid\r\n"
+	reply, err := ReadReply(bufio.NewReader(strings.NewReader(resp)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots, err := ParseSlots(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slots) != 2 || slots[0].Master != "10.0.0.1:7000" || slots[1].Start != 8192 ||
+		len(slots[1].Replicas) != 1 || slots[1].Replicas[0] != "10.0.0.4:7001" {
+		t.Errorf("unexpected slots %+v", slots)
+	}
+}
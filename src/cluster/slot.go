@@ -0,0 +1,91 @@
+package cluster
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+)
+
+const SlotCount = 16384
+
+var crc16Table [256]uint16
+
+func init() {
+	for i := range crc16Table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) used by redis cluster.
+func crc16(key []byte) uint16 {
+	var crc uint16
+	for _, b := range key {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+// Slot returns the cluster slot of key, only the hash tag {...} is hashed if present.
+func Slot(key []byte) int {
+	if start := bytes.IndexByte(key, '{'); start >= 0 {
+		if end := bytes.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % SlotCount)
+}
+
+// SlotRange is one entry of CLUSTER SLOTS, nodes are host:port.
+type SlotRange struct {
+	Start    int
+	End      int
+	Master   string
+	Replicas []string
+}
+
+// ParseSlots turns a decoded CLUSTER SLOTS reply into slot ranges sorted by
+// their first slot.
+func ParseSlots(reply interface{}) ([]SlotRange, error) {
+	if redisErr, ok := reply.(Error); ok {
+		return nil, redisErr
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, ProtocolError("unexpected CLUSTER SLOTS reply")
+	}
+	slots := make([]SlotRange, 0, len(items))
+	for _, item := range items {
+		fields, ok := item.([]interface{})
+		if !ok || len(fields) < 3 {
+			return nil, ProtocolError("unexpected CLUSTER SLOTS entry")
+		}
+		start, _ := fields[0].(int64)
+		end, _ := fields[1].(int64)
+		slotRange := SlotRange{Start: int(start), End: int(end)}
+		for i, field := range fields[2:] {
+			nodeFields, ok := field.([]interface{})
+			if !ok || len(nodeFields) < 2 {
+				return nil, ProtocolError("unexpected CLUSTER SLOTS node")
+			}
+			host, _ := nodeFields[0].([]byte)
+			port, _ := nodeFields[1].(int64)
+			addr := string(host) + ":" + strconv.FormatInt(port, 10)
+			if i == 0 {
+				slotRange.Master = addr
+			} else {
+				slotRange.Replicas = append(slotRange.Replicas, addr)
+			}
+		}
+		slots = append(slots, slotRange)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Start < slots[j].Start })
+	return slots, nil
+}
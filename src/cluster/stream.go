@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// errUnread closes the connection of a stream released without being written.
+var errUnread = errors.New("cluster: reply not read to the end")
+
+// Stream is a reply frame outgrowing the largest pooled buffer: the head
+// read so far and the connection the rest of it is still to be read from.
+// WriteTo copies the rest from the connection to the client as it arrives,
+// walking the headers only to find where the frame ends, bulk payloads are
+// never held whole. A Stream holds its connection until it is written or
+// released.
+type Stream struct {
+	head Raw
+	r    rawReader
+	// of the bulk string the head stops before, CRLF included
+	left int
+
+	conn *Conn
+	pool *Pool
+	// the rest of the reply must keep coming within it
+	readTimeout time.Duration
+	refreshed   time.Time
+}
+
+// readStream reads a reply frame from c, it returns a Raw if the frame fits
+// in the largest pooled buffer and a Stream holding c otherwise.
+func readStream(c *Conn, readTimeout time.Duration) (interface{}, error) {
+	r := rawReader{br: c.br, limits: c.limits, pending: 1}
+	frame, left, err := readRaw(&r, newRawBuffer(), rawBufferMax)
+	if err != nil {
+		Raw(frame).Release()
+		return nil, err
+	}
+	if r.pending == 0 && left == 0 {
+		return Raw(frame), nil
+	}
+	return &Stream{head: Raw(frame), r: r, left: left, conn: c, readTimeout: readTimeout, refreshed: time.Now()}, nil
+}
+
+// WriteTo writes the whole reply to w and gives the connection back. On an
+// error only part of the reply was written, a reply over the reply limits
+// fails the same way once part of it is written.
+func (s *Stream) WriteTo(w io.Writer) (int64, error) {
+	if s.conn == nil {
+		return 0, errUnread
+	}
+	written, err := s.copy(w)
+	s.head.Release()
+	s.head = nil
+	// an error leaves the connection out of sync, it is closed
+	s.pool.put(s.conn, err)
+	s.conn = nil
+	return written, err
+}
+
+func (s *Stream) copy(w io.Writer) (int64, error) {
+	n, err := w.Write(s.head)
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	left := s.left
+	for {
+		if left > 0 {
+			n, err := s.copyBulk(w, left)
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+		if s.r.pending == 0 {
+			return written, nil
+		}
+		s.refresh()
+		line, bulk, err := s.r.next()
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(line)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		left = bulk + 2
+	}
+}
+
+// copyBulk copies n bytes of bulk string, CRLF included, from the connection to w.
+func (s *Stream) copyBulk(w io.Writer, n int) (int64, error) {
+	written, err := io.CopyN(w, streamBody{s}, int64(n-2))
+	if err != nil {
+		return written, err
+	}
+	crlf, err := s.r.br.Peek(2)
+	if err != nil {
+		return written, err
+	}
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return written, ProtocolError("bad bulk string format")
+	}
+	m, err := w.Write(crlf)
+	s.r.br.Discard(2)
+	return written + int64(m), err
+}
+
+// refresh moves the read deadline forward while the reply keeps coming, only
+// once an eighth of the read timeout has passed, setting it is not free.
+func (s *Stream) refresh() {
+	if s.readTimeout <= 0 {
+		return
+	}
+	if now := time.Now(); now.Sub(s.refreshed) > s.readTimeout/8 {
+		s.conn.conn.SetReadDeadline(now.Add(s.readTimeout))
+		s.refreshed = now
+	}
+}
+
+// streamBody reads bulk payloads of a stream from its connection.
+type streamBody struct {
+	s *Stream
+}
+
+func (body streamBody) Read(p []byte) (int, error) {
+	body.s.refresh()
+	return body.s.r.br.Read(p)
+}
+
+// Release closes the connection of a stream that was not written, the rest
+// of its reply is unread. It does nothing once the stream is written.
+func (s *Stream) Release() {
+	if s.conn == nil {
+		return
+	}
+	s.head.Release()
+	s.head = nil
+	s.pool.put(s.conn, errUnread)
+	s.conn = nil
+}
+
+// Size returns the payload bytes of the reply and the number of elements of
+// an array reply like Raw.Size, the bytes are complete once it is written.
+func (s *Stream) Size() (int, int) {
+	return s.r.size, s.r.elements
+}
+
+// Release gives back what reply holds, the buffer of a Raw or the connection
+// of a Stream, other replies hold nothing.
+func Release(reply interface{}) {
+	switch r := reply.(type) {
+	case Raw:
+		r.Release()
+	case *Stream:
+		r.Release()
+	}
+}
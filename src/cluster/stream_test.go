@@ -0,0 +1,81 @@
+package cluster
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_PoolStream(t *testing.T) {
+	fc := startFakeCluster(t, 1)
+	pool := NewPool(fc.nodes[0].addr, 1, time.Second, time.Second, time.Second, "")
+	defer pool.Close()
+	big := strings.Repeat("x", 3*rawBufferMax)
+	for _, key := range []string{"{b}1", "{b}2"} {
+		if _, err := pool.Do("SET", key, big); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool.Do("SET", "{b}small", "v")
+
+	if reply, err := pool.DoStream(0, "GET", "{b}small"); err != nil || string(reply.(Raw)) != "$1\r\nv\r\n" {
+		t.Fatalf("small reply returned %q,%v", reply, err)
+	}
+	bigBulk := "$" + strconv.Itoa(len(big)) + "\r\n" + big + "\r\n"
+	for _, c := range []struct {
+		args  []interface{}
+		frame string
+		size  int
+		elems int
+	}{
+		{[]interface{}{"GET", "{b}1"}, bigBulk, len(big), 0},
+		{[]interface{}{"MGET", "{b}1", "{b}small", "{b}2"}, "*3\r\n" + bigBulk + "$1\r\nv\r\n" + bigBulk, 2*len(big) + 1, 3},
+	} {
+		reply, err := pool.DoStream(0, c.args[0].(string), c.args[1:]...)
+		stream, ok := reply.(*Stream)
+		if err != nil || !ok {
+			t.Fatalf("%v returned %T,%v", c.args, reply, err)
+		}
+		if len(stream.head) > rawBufferMax {
+			t.Errorf("%v buffered %d bytes", c.args, len(stream.head))
+		}
+		var buf bytes.Buffer
+		if n, err := stream.WriteTo(&buf); err != nil || n != int64(len(c.frame)) || buf.String() != c.frame {
+			t.Fatalf("%v streamed %d bytes,%v", c.args, n, err)
+		}
+		if size, elems := stream.Size(); size != c.size || elems != c.elems {
+			t.Errorf("%v size %d,%d, want %d,%d", c.args, size, elems, c.size, c.elems)
+		}
+		if len(pool.idle) != 1 {
+			t.Fatalf("connection not given back after %v", c.args)
+		}
+	}
+
+	// the rest of a released stream is unread, its connection is closed
+	reply, err := pool.DoStream(0, "GET", "{b}1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply.(*Stream).Release()
+	if n := len(pool.open); n != 0 {
+		t.Errorf("%d connections open after the release", n)
+	}
+
+	// a limit reached while streaming fails the write
+	pool.LimitReplies(4*rawBufferMax, 0)
+	reply, err = pool.DoStream(0, "MGET", "{b}1", "{b}2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reply.(*Stream).WriteTo(&bytes.Buffer{}); err != (ReplyTooLargeError{Bytes: 2 * len(big)}) {
+		t.Errorf("stream over the limit returned %v", err)
+	}
+	if n := len(pool.open); n != 0 {
+		t.Errorf("%d connections open after the cut stream", n)
+	}
+	if reply, err := pool.DoStream(0, "GET", "{b}small"); err != nil || string(reply.(Raw)) != "$1\r\nv\r\n" {
+		t.Errorf("GET after the cut stream returned %q,%v", reply, err)
+	}
+}
@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/cihub/seelog"
+)
+
+// StartAdminServer serves the admin api on config.Admin_listen:
+//
+//	GET    /healthz                             alive, no token required
+//	GET    /readyz                              ready to serve, no token required
+//	GET    /clusters                            clusters and their config
+//	GET    /clusters/<cluster>                  config of a cluster
+//	GET    /clusters/<cluster>/topology         slot map, node health and redirections
+//	POST   /clusters/<cluster>/topology/refresh reload the slot map
+//	GET    /clusters/<cluster>/breakers         circuit breakers of the nodes
+//	GET    /clusters/<cluster>/sessions         client sessions
+//	DELETE /clusters/<cluster>/sessions/<id>    kill a client session
+//	GET    /clusters/<cluster>/slowlog?n=<n>    latest slow commands
+//	DELETE /clusters/<cluster>/slowlog          reset the slowlog
+//	GET    /clusters/<cluster>/hotkeys?n=<n>    hottest keys of the sliding window
+//	GET    /clusters/<cluster>/bigkeys?n=<n>    biggest keys by reply bytes
+//	DELETE /clusters/<cluster>/bigkeys          forget the big keys
+//	POST   /config/reload                       apply the config file
+//	GET    /commands/forbidden                  forbidden commands
+//	PUT    /commands/forbidden/<cmd>            forbid a command
+//	DELETE /commands/forbidden/<cmd>            allow a command
+//	       /debug/pprof/                        if admin_pprof is set
+//
+// Every request must carry admin_token as "Authorization: Bearer <token>" if it is set.
+func StartAdminServer(config *ProxyConfig) {
+	if config.Admin_listen == "" {
+		return
+	}
+	if config.Admin_token == "" {
+		log.Warnf("admin server without admin_token,listen=%s", config.Admin_listen)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clusters", adminClusters)
+	mux.HandleFunc("/clusters/", adminCluster)
+	mux.HandleFunc("/config/reload", adminReload)
+	mux.HandleFunc("/commands/forbidden", adminForbiddenCommands)
+	mux.HandleFunc("/commands/forbidden/", adminForbiddenCommands)
+	if config.Admin_pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	log.Infof("admin server started,listen=%s,pprof=%v", config.Admin_listen, config.Admin_pprof)
+	go func() {
+		log.Error(http.ListenAndServe(config.Admin_listen, healthMux(adminAuth(config.Admin_token, mux))))
+	}()
+}
+
+// healthMux serves the health checks without a token, the rest goes to next.
+func healthMux(next http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.Handle("/", next)
+	return mux
+}
+
+func adminAuth(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClusterInfo is the admin api view of a running cluster proxy.
+type ClusterInfo struct {
+	Config      *ProxyClusterConfig `json:"config"`
+	Servers     []string            `json:"servers"`
+	Connections int64               `json:"connections"`
+}
+
+func newClusterInfo(cp *clusterProxy) ClusterInfo {
+	return ClusterInfo{
+		Config:      cp.config,
+		Servers:     cp.backend.Servers(),
+		Connections: atomic.LoadInt64(&cp.config.connections),
+	}
+}
+
+func adminClusters(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	result := make([]ClusterInfo, 0)
+	for _, cp := range allClusterProxies() {
+		result = append(result, newClusterInfo(cp))
+	}
+	writeJson(w, result)
+}
+
+// adminCluster serves everything below /clusters/<cluster>.
+func adminCluster(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/clusters/"), "/"), "/")
+	cp := getClusterProxy(parts[0])
+	if cp == nil {
+		http.Error(w, "unknown cluster", http.StatusNotFound)
+		return
+	}
+	switch resource := strings.Join(parts[1:], "/"); {
+	case resource == "":
+		if allowMethods(w, r, http.MethodGet) {
+			writeJson(w, newClusterInfo(cp))
+		}
+	case resource == "topology":
+		if allowMethods(w, r, http.MethodGet) {
+			slots, nodes := cp.backend.replicas.Topology()
+			var refreshedAt int64
+			if at := cp.backend.replicas.RefreshedAt(); !at.IsZero() {
+				refreshedAt = at.Unix()
+			}
+			writeJson(w, map[string]interface{}{"slots": slots, "nodes": nodes, "refreshed_at": refreshedAt})
+		}
+	case resource == "topology/refresh":
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		if err := cp.backend.RefreshTopology(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		log.Infof("topology refreshed by admin,cluster=%s", cp.config.Cluster)
+		writeJson(w, map[string]interface{}{"refreshed": true})
+	case resource == "breakers":
+		if allowMethods(w, r, http.MethodGet) {
+			writeJson(w, cp.backend.breakers.States())
+		}
+	case resource == "sessions":
+		if allowMethods(w, r, http.MethodGet) {
+			writeJson(w, cp.Sessions())
+		}
+	case strings.HasPrefix(resource, "sessions/"):
+		if !allowMethods(w, r, http.MethodDelete) {
+			return
+		}
+		id, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil || !cp.KillSession(id) {
+			http.Error(w, "unknown session", http.StatusNotFound)
+			return
+		}
+		log.Infof("session killed by admin,cluster=%s,id=%d", cp.config.Cluster, id)
+		writeJson(w, map[string]interface{}{"killed": id})
+	case resource == "slowlog":
+		switch r.Method {
+		case http.MethodGet:
+			n := -1
+			if value := r.URL.Query().Get("n"); value != "" {
+				n, _ = strconv.Atoi(value)
+			}
+			writeJson(w, map[string]interface{}{"len": cp.slowlog.Len(), "entries": cp.slowlog.Get(n)})
+		case http.MethodDelete:
+			cp.slowlog.Reset()
+			writeJson(w, map[string]interface{}{"len": 0})
+		default:
+			allowMethods(w, r, http.MethodGet, http.MethodDelete)
+		}
+	case resource == "hotkeys":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		if cp.hotKeys == nil {
+			http.Error(w, "hot key detection disabled, see hotkey_top_k", http.StatusNotFound)
+			return
+		}
+		n := -1
+		if value := r.URL.Query().Get("n"); value != "" {
+			n, _ = strconv.Atoi(value)
+		}
+		writeJson(w, cp.hotKeys.Top(n))
+	case resource == "bigkeys":
+		if cp.bigKeys == nil {
+			http.Error(w, "big key detection disabled, see bigkey_bytes", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			n := -1
+			if value := r.URL.Query().Get("n"); value != "" {
+				n, _ = strconv.Atoi(value)
+			}
+			writeJson(w, cp.bigKeys.Top(n))
+		case http.MethodDelete:
+			cp.bigKeys.Reset()
+			writeJson(w, map[string]interface{}{"reset": true})
+		default:
+			allowMethods(w, r, http.MethodGet, http.MethodDelete)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func adminReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	result, err := reloadConfig(ConfigFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJson(w, result)
+}
+
+// ReloadResult tells which clusters took the reloaded config, the others
+// need a restart.
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// reloadConfig applies the servers and the slowlog threshold of the running
+// clusters, added or removed clusters and changed listen addresses need a restart.
+func reloadConfig(path string) (*ReloadResult, error) {
+	config, err := LoadProxyConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	result := &ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+	seen := make(map[string]bool)
+	for i := range config.Proxy_clusters {
+		pc := &config.Proxy_clusters[i]
+		seen[pc.Cluster] = true
+		cp := getClusterProxy(pc.Cluster)
+		if cp == nil || cp.config.Listen != pc.Listen {
+			result.RestartRequired = append(result.RestartRequired, pc.Cluster)
+			continue
+		}
+		if cp.config.Servers_path == "" {
+			if err := cp.backend.Refresh(pc.Servers); err != nil {
+				return nil, err
+			}
+		}
+		cp.slowlog.SetThreshold(pc.Slowlog_threshold_ms)
+		result.Applied = append(result.Applied, pc.Cluster)
+	}
+	for _, cp := range allClusterProxies() {
+		if !seen[cp.config.Cluster] {
+			result.RestartRequired = append(result.RestartRequired, cp.config.Cluster)
+		}
+	}
+	log.Infof("config reloaded,applied=%v,restartRequired=%v", result.Applied, result.RestartRequired)
+	return result, nil
+}
+
+func adminForbiddenCommands(w http.ResponseWriter, r *http.Request) {
+	cmd := strings.ToUpper(strings.Trim(strings.TrimPrefix(r.URL.Path, "/commands/forbidden"), "/"))
+	if cmd == "" {
+		if allowMethods(w, r, http.MethodGet) {
+			writeJson(w, ForbiddenCommands())
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		SetCmdForbidden(cmd, true)
+	case http.MethodDelete:
+		SetCmdForbidden(cmd, false)
+	default:
+		allowMethods(w, r, http.MethodPut, http.MethodDelete)
+		return
+	}
+	log.Infof("forbidden command toggled by admin,cmd=%s,forbidden=%v", cmd, IsCmdForbidden(cmd))
+	writeJson(w, map[string]interface{}{"command": cmd, "forbidden": IsCmdForbidden(cmd)})
+}
+
+// allowMethods answers 405 unless r uses one of methods.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("write json response error,%v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestAdminCluster(name string) *clusterProxy {
+	proxyCluster := newTestProxyCluster(name)
+	proxyCluster.Slowlog_max_len = 8
+	return newClusterProxy(proxyCluster, nil, &backend{proxyCluster: proxyCluster})
+}
+
+func adminRequest(t *testing.T, handler http.Handler, method, path string, v interface{}) int {
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if v != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s returned %s,%v", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+func Test_AdminAuth(t *testing.T) {
+	handler := adminAuth("secret", http.HandlerFunc(adminClusters))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/clusters", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("request without token answered %d", w.Code)
+	}
+	if code := adminRequest(t, handler, http.MethodGet, "/clusters", nil); code != http.StatusOK {
+		t.Errorf("request with token answered %d", code)
+	}
+}
+
+func Test_AdminSessions(t *testing.T) {
+	cp := newTestAdminCluster("admin_cluster")
+	handler := adminAuth("secret", http.HandlerFunc(adminCluster))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	info := cp.addSession(NewSession(server, -1, -1))
+	defer cp.removeSession(info)
+
+	var sessions []SessionInfo
+	adminRequest(t, handler, http.MethodGet, "/clusters/admin_cluster/sessions", &sessions)
+	if len(sessions) != 1 || sessions[0].Id != info.id {
+		t.Fatalf("sessions=%+v", sessions)
+	}
+	if code := adminRequest(t, handler, http.MethodDelete, "/clusters/admin_cluster/sessions/999", nil); code != http.StatusNotFound {
+		t.Errorf("killing an unknown session answered %d", code)
+	}
+	if code := adminRequest(t, handler, http.MethodDelete, "/clusters/admin_cluster/sessions/1", nil); code != http.StatusOK {
+		t.Errorf("killing a session answered %d", code)
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("killed session is still open")
+	}
+	if code := adminRequest(t, handler, http.MethodGet, "/clusters/unknown/sessions", nil); code != http.StatusNotFound {
+		t.Errorf("unknown cluster answered %d", code)
+	}
+}
+
+func Test_AdminForbiddenCommands(t *testing.T) {
+	handler := adminAuth("secret", http.HandlerFunc(adminForbiddenCommands))
+	if !IsCmdForbidden("KEYS") {
+		t.Fatal("KEYS is expected to be forbidden")
+	}
+	adminRequest(t, handler, http.MethodDelete, "/commands/forbidden/keys", nil)
+	if IsCmdForbidden("KEYS") {
+		t.Error("KEYS still forbidden")
+	}
+	adminRequest(t, handler, http.MethodPut, "/commands/forbidden/KEYS", nil)
+	if !IsCmdForbidden("KEYS") {
+		t.Error("KEYS not forbidden again")
+	}
+	var forbidden []string
+	adminRequest(t, handler, http.MethodGet, "/commands/forbidden", &forbidden)
+	if len(forbidden) == 0 {
+		t.Error("no forbidden commands listed")
+	}
+}
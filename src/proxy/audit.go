@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"cluster"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// only the keys are logged
+	AuditArgsNone = "none"
+	// every other argument is logged as <redacted N bytes>
+	AuditArgsRedacted = "redacted"
+	// arguments are logged truncated like in the slowlog
+	AuditArgsFull = "full"
+)
+
+const auditFlushInterval = time.Second
+
+// auditUnauthenticated is the user of the entries of sessions that did not
+// authenticate with AUTH.
+const auditUnauthenticated = "unauthenticated"
+
+// AuditEntry is one line of the audit log.
+type AuditEntry struct {
+	Time    string   `json:"time"`
+	Cluster string   `json:"cluster"`
+	Client  string   `json:"client"`
+	User    string   `json:"user"`
+	Command string   `json:"command"`
+	Keys    []string `json:"keys"`
+	Args    []string `json:"args,omitempty"`
+	Result  string   `json:"result"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// auditLog writes every write and admin command of a cluster as json lines.
+type auditLog struct {
+	cluster string
+	args    string
+
+	mu   sync.Mutex
+	file *rotatingFile
+	w    *bufio.Writer
+
+	done chan struct{}
+}
+
+// newAuditLog returns nil if audit_log is not set for the cluster.
+func newAuditLog(proxyCluster *ProxyClusterConfig) *auditLog {
+	if proxyCluster.Audit_log == "" {
+		return nil
+	}
+	file, err := openRotatingFile(proxyCluster.Audit_log, int64(proxyCluster.Audit_max_size_mb)<<20, proxyCluster.Audit_max_backups)
+	if err != nil {
+		log.Errorf("open audit log error,cluster=%s,path=%s,error=%v", proxyCluster.Cluster, proxyCluster.Audit_log, err)
+		return nil
+	}
+	audit := &auditLog{
+		cluster: proxyCluster.Cluster,
+		args:    proxyCluster.Audit_args,
+		file:    file,
+		w:       bufio.NewWriter(file),
+		done:    make(chan struct{}),
+	}
+	go audit.flushLoop()
+	return audit
+}
+
+func auditUser(user string) string {
+	if user == "" {
+		return auditUnauthenticated
+	}
+	return user
+}
+
+// isAudited tells whether cmd changes data or the proxy, reads are not audited.
+func isAudited(cmd string) bool {
+	return !IsCmdReadOnly(cmd) && cmd != "PING" && cmd != "QUIT"
+}
+
+// Record logs req with its result if it is a write or admin command.
+func (audit *auditLog) Record(session ClientSession, req *proxyRequest, reply interface{}, err error) {
+	if audit == nil || !isAudited(req.cmd) {
+		return
+	}
+	keys, args := auditArgs(req.cmd, req.args, audit.args)
+	entry := AuditEntry{
+		Time:    req.start.Format(time.RFC3339Nano),
+		Cluster: audit.cluster,
+		Client:  session.RemoteAddr(),
+		User:    auditUser(req.user),
+		Command: req.cmd,
+		Keys:    keys,
+		Args:    args,
+		Result:  commandOutcome(reply, err),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	} else if redisErr, ok := cluster.ReplyError(reply); ok {
+		entry.Error = redisErr.Error()
+	}
+	data, _ := json.Marshal(entry)
+
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	// rotate between lines only
+	if audit.file.full(int64(audit.w.Buffered() + len(data) + 1)) {
+		if err := audit.w.Flush(); err == nil {
+			err = audit.file.rotate()
+		}
+		if err != nil {
+			log.Errorf("rotate audit log error,cluster=%s,error=%v", audit.cluster, err)
+		}
+	}
+	audit.w.Write(data)
+	audit.w.WriteByte('\n')
+}
+
+// auditArgs splits args into keys and the other arguments redacted by policy.
+func auditArgs(cmd string, args []interface{}, policy string) ([]string, []string) {
+	isKey := commandKeyPositions(cmd)
+	keys := make([]string, 0, 1)
+	var others []interface{}
+	for i, arg := range args {
+		if isKey(i) {
+			p, _ := arg.([]byte)
+			keys = append(keys, string(p))
+		} else if policy != AuditArgsNone {
+			others = append(others, arg)
+		}
+	}
+	switch policy {
+	case AuditArgsFull:
+		return keys, slowlogArgs(others)
+	case AuditArgsNone:
+		return keys, nil
+	}
+	redacted := make([]string, 0, len(others))
+	for _, arg := range others {
+		p, _ := arg.([]byte)
+		redacted = append(redacted, "<redacted "+strconv.Itoa(len(p))+" bytes>")
+	}
+	return keys, redacted
+}
+
+// commandKeyPositions returns which arguments of cmd are keys.
+func commandKeyPositions(cmd string) func(i int) bool {
+	switch cmd {
+	case "DEL", "UNLINK", "EXISTS", "TOUCH", "MGET", "PFMERGE", "PFCOUNT",
+		"SDIFFSTORE", "SINTERSTORE", "SUNIONSTORE", "RENAME", "RENAMENX", "RPOPLPUSH", "SMOVE":
+		return func(i int) bool { return true }
+	case "MSET", "MSETNX":
+		return func(i int) bool { return i%2 == 0 }
+	case "SLOWLOG":
+		return func(i int) bool { return false }
+	}
+	return func(i int) bool { return i == 0 }
+}
+
+func (audit *auditLog) flushLoop() {
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			audit.flush()
+		case <-audit.done:
+			audit.flush()
+			return
+		}
+	}
+}
+
+func (audit *auditLog) flush() {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	if err := audit.w.Flush(); err != nil {
+		log.Errorf("write audit log error,cluster=%s,error=%v", audit.cluster, err)
+	}
+}
+
+func (audit *auditLog) Close() {
+	if audit == nil {
+		return
+	}
+	close(audit.done)
+	audit.flush()
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	audit.file.Close()
+}
+
+// rotatingFile appends to path, rotate renames it to path.1, path.2, ... and
+// starts a new one, at most backups old files are kept.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	return rf, rf.open()
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+// full tells whether writing n more bytes takes the file over maxSize.
+func (rf *rotatingFile) full(n int64) bool {
+	return rf.maxSize > 0 && rf.size > 0 && rf.size+n > rf.maxSize
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.file.Close()
+	for i := rf.backups - 1; i >= 1; i-- {
+		os.Rename(rf.path+"."+strconv.Itoa(i), rf.path+"."+strconv.Itoa(i+1))
+	}
+	if rf.backups > 0 {
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.file.Close()
+}
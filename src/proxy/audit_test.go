@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func auditRequest(cmd string, args ...string) *proxyRequest {
+	req := &proxyRequest{cmd: cmd, start: time.Now()}
+	for _, arg := range args {
+		req.args = append(req.args, []byte(arg))
+	}
+	return req
+}
+
+func readAuditLog(t *testing.T, path string) []AuditEntry {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("bad audit line %s,%v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func Test_AuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	proxyCluster := newTestProxyCluster("audit_cluster")
+	proxyCluster.Audit_log = filepath.Join(dir, "audit.log")
+	proxyCluster.Audit_args = AuditArgsRedacted
+	audit := newAuditLog(proxyCluster)
+	session := &fakeSession{addr: "127.0.0.1:50000"}
+
+	audit.Record(session, auditRequest("GET", "k"), []byte("v"), nil)
+	audit.Record(session, auditRequest("SET", "k", "secret"), "OK", nil)
+	audit.Record(session, auditRequest("MSET", "k1", "v1", "k2", "v2"), "OK", nil)
+	audit.Record(session, auditRequest("KEYS", "*"), nil, ProtocolError("unsupported cmd KEYS"))
+	audit.Close()
+
+	entries := readAuditLog(t, proxyCluster.Audit_log)
+	if len(entries) != 3 {
+		t.Fatalf("entries=%+v", entries)
+	}
+	set := entries[0]
+	if set.Command != "SET" || set.Client != session.addr || set.User != auditUnauthenticated || set.Result != OutcomeOk {
+		t.Errorf("unexpected entry %+v", set)
+	}
+	if len(set.Keys) != 1 || set.Keys[0] != "k" || len(set.Args) != 1 || set.Args[0] != "<redacted 6 bytes>" {
+		t.Errorf("SET keys=%v,args=%v", set.Keys, set.Args)
+	}
+	if keys := strings.Join(entries[1].Keys, ","); keys != "k1,k2" {
+		t.Errorf("MSET keys=%s", keys)
+	}
+	if entries[2].Result != OutcomeProtocolError || entries[2].Error == "" {
+		t.Errorf("unexpected entry %+v", entries[2])
+	}
+}
+
+func Test_AuditAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cp := newTestAdminCluster("audit_auth_cluster")
+	cp.config.Audit_log = filepath.Join(dir, "audit.log")
+	cp.config.Client_connections = 1
+	cp.config.Users = []ClusterUser{{User: "alice", Password: "secret"}}
+	cp.audit = newAuditLog(cp.config)
+	cp.users = newClusterUsers(cp.config)
+
+	client, server := net.Pipe()
+	serveConn(cp, server)
+	br := bufio.NewReader(client)
+	for _, c := range []struct{ request, reply string }{
+		{"*4\r\n$4\r\nAUTH\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", "-proxy: wrong number of arguments for 'auth' command\r\n"},
+		{"*3\r\n$4\r\nAUTH\r\n$5\r\nalice\r\n$6\r\nsecrex\r\n", "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{"*3\r\n$4\r\nAUTH\r\n$5\r\nalice\r\n$6\r\nsecret\r\n", "+OK\r\n"},
+	} {
+		go client.Write([]byte(c.request))
+		if line, err := br.ReadString('\n'); err != nil || line != c.reply {
+			t.Fatalf("%q answered %q,%v", c.request, line, err)
+		}
+	}
+	client.Close()
+	waitFor(t, time.Second, func() bool { return atomic.LoadInt64(&cp.config.connections) == 0 })
+	cp.audit.Close()
+
+	entries := readAuditLog(t, cp.config.Audit_log)
+	if len(entries) != 3 || entries[0].User != auditUnauthenticated || entries[1].User != auditUnauthenticated || entries[1].Result != OutcomeRedisError ||
+		entries[2].User != "alice" || entries[2].Result != OutcomeOk {
+		t.Fatalf("entries=%+v", entries)
+	}
+	if p, _ := ioutil.ReadFile(cp.config.Audit_log); strings.Contains(string(p), "secre") {
+		t.Errorf("password written to the audit log: %s", p)
+	}
+}
+
+func Test_AuditArgsPolicy(t *testing.T) {
+	args := []interface{}{[]byte("k"), []byte("secret")}
+	if _, others := auditArgs("SET", args, AuditArgsNone); others != nil {
+		t.Errorf("none policy logged %v", others)
+	}
+	if _, others := auditArgs("SET", args, AuditArgsFull); len(others) != 1 || others[0] != "secret" {
+		t.Errorf("full policy logged %v", others)
+	}
+}
+
+func Test_RotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	rf, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if rf.full(int64(len(line))) {
+			if err := rf.rotate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf.Close()
+	for suffix, want := range map[string]string{"": "dddddddd\n", ".1": "cccccccc\n", ".2": "bbbbbbbb\n"} {
+		data, err := ioutil.ReadFile(path + suffix)
+		if err != nil || string(data) != want {
+			t.Errorf("%s%s=%q,%v, want %q", path, suffix, data, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than 2 backups kept,%v", err)
+	}
+}
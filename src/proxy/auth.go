@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"crypto/subtle"
+
+	"cluster"
+)
+
+// defaultUser is the user AUTH with a password only authenticates as.
+const defaultUser = "default"
+
+// ClusterUser is a user the clients of a cluster authenticate as with AUTH.
+type ClusterUser struct {
+	User     string
+	Password string `json:"-"`
+}
+
+var (
+	errAuthNotConfigured = cluster.Error("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	errWrongPass         = cluster.Error("WRONGPASS invalid username-password pair or user is disabled.")
+)
+
+// clusterUsers maps the users of a cluster to their password, nil if the
+// cluster has none.
+type clusterUsers map[string]string
+
+func newClusterUsers(proxyCluster *ProxyClusterConfig) clusterUsers {
+	if len(proxyCluster.Users) == 0 {
+		return nil
+	}
+	users := make(clusterUsers, len(proxyCluster.Users))
+	for _, user := range proxyCluster.Users {
+		users[user.User] = user.Password
+	}
+	return users
+}
+
+// auth checks the arguments of AUTH, AUTH is answered by the proxy and never
+// sent to the nodes. It returns the authenticated user, or an error reply and
+// an empty user if the credentials are wrong.
+func (users clusterUsers) auth(args []interface{}) (string, interface{}, error) {
+	var user, password []byte
+	switch len(args) {
+	case 1:
+		user, password = []byte(defaultUser), args[0].([]byte)
+	case 2:
+		user, password = args[0].([]byte), args[1].([]byte)
+	default:
+		return "", nil, ProtocolError("wrong number of arguments for 'auth' command")
+	}
+	if users == nil {
+		return "", errAuthNotConfigured, nil
+	}
+	expected, ok := users[string(user)]
+	if !ok {
+		// as slow as a wrong password, unknown users are not told apart
+		expected = string(password) + "x"
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), password) != 1 {
+		return "", errWrongPass, nil
+	}
+	return string(user), "OK", nil
+}
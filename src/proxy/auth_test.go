@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"cluster"
+)
+
+func authArgs(args string) []interface{} {
+	var request []interface{}
+	for _, arg := range strings.Fields(args) {
+		request = append(request, []byte(arg))
+	}
+	return request
+}
+
+func Test_ClusterUsersAuth(t *testing.T) {
+	proxyCluster := newTestProxyCluster("auth_cluster")
+	proxyCluster.Users = []ClusterUser{{User: defaultUser, Password: "pw"}, {User: "batch", Password: "batchpw"}}
+	users := newClusterUsers(proxyCluster)
+
+	for _, c := range []struct {
+		args  string
+		user  string
+		reply interface{}
+	}{
+		{"pw", defaultUser, "OK"},
+		{"batch batchpw", "batch", "OK"},
+		{"batch pw", "", errWrongPass},
+		{"other pw", "", errWrongPass},
+		{"wrong", "", errWrongPass},
+	} {
+		user, reply, err := users.auth(authArgs(c.args))
+		if err != nil || user != c.user || reply != c.reply {
+			t.Errorf("AUTH %s returned %s,%v,%v", c.args, user, reply, err)
+		}
+	}
+	if _, _, err := users.auth(nil); err == nil {
+		t.Errorf("AUTH without arguments accepted")
+	}
+	// AUTH fails like on a redis node without requirepass
+	user, reply, err := newClusterUsers(newTestProxyCluster("auth_cluster")).auth(authArgs("pw"))
+	if redisErr, ok := reply.(cluster.Error); user != "" || err != nil || !ok || !strings.HasPrefix(string(redisErr), "ERR AUTH") {
+		t.Errorf("AUTH without users returned %s,%v,%v", user, reply, err)
+	}
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cluster"
+	log "github.com/cihub/seelog"
+)
+
+// requests still running on a replaced cluster client get this long to finish.
+const backendCloseDelay = 10 * time.Second
+
+// backend holds the redis cluster client of a proxy cluster, the client is
+// replaced at runtime when the start nodes change.
+type backend struct {
+	proxyCluster *ProxyClusterConfig
+
+	// read timeout of the commands listed in command_timeouts
+	timeouts map[string]time.Duration
+
+	mu           sync.RWMutex
+	redisCluster *cluster.Cluster
+	servers      []string
+
+	// tracks the slot map and node health, read only commands are routed to
+	// replicas through it unless the read preference is master
+	replicas *replicaRouter
+	breakers *nodeBreakers
+	// nil if commands are not retried
+	retry *retryPolicy
+	// nil if reads are not hedged
+	hedger *hedger
+}
+
+func newBackend(proxyCluster *ProxyClusterConfig, servers []string) *backend {
+	b := &backend{
+		proxyCluster: proxyCluster,
+		timeouts:     commandTimeouts(proxyCluster),
+		breakers:     newNodeBreakers(proxyCluster),
+		retry:        newRetryPolicy(proxyCluster),
+		hedger:       newHedger(proxyCluster),
+	}
+	if err := b.Refresh(servers); err != nil {
+		log.Errorf("create redis cluster error,cluster=%s,servers=%v,error=%v", proxyCluster.Cluster, servers, err)
+	}
+	b.replicas = newReplicaRouter(proxyCluster, b.client, b.breakers)
+	return b
+}
+
+func (b *backend) Do(req *proxyRequest) (interface{}, error) {
+	return b.retry.Do(req, func() (interface{}, error) {
+		return b.do(req)
+	})
+}
+
+func (b *backend) do(req *proxyRequest) (interface{}, error) {
+	if b.hedger != nil && b.replicas != nil && IsCmdReadOnly(req.cmd) {
+		return b.hedger.Do(req, b.route, b.replicas)
+	}
+	return b.route(req)
+}
+
+func (b *backend) route(req *proxyRequest) (interface{}, error) {
+	if b.replicas != nil && b.proxyCluster.Read_preference != ReadPreferenceMaster && IsCmdReadOnly(req.cmd) {
+		return b.replicas.Do(func() (interface{}, error) {
+			return b.doMaster(req)
+		}, req)
+	}
+	return b.doMaster(req)
+}
+
+// doMaster sends req through the cluster client to the master of its slot,
+// req.node is the node that answered.
+func (b *backend) doMaster(req *proxyRequest) (interface{}, error) {
+	readTimeout, ok := b.timeouts[req.cmd]
+	if !ok {
+		readTimeout = time.Duration(b.proxyCluster.Read_timeout) * time.Millisecond
+	}
+	redisCluster := b.client()
+	if redisCluster == nil {
+		return nil, BackendDownError("backend cluster " + b.proxyCluster.Cluster + " is not available")
+	}
+	reply, node, err := redisCluster.DoStreamNode(readTimeout, req.cmd, req.args...)
+	req.node = node
+	if err == cluster.ErrTooManyRedirects {
+		return nil, BackendDownError("too many redirections for " + req.cmd + " on node " + node)
+	}
+	return reply, b.timeoutError(err, node, readTimeout)
+}
+
+// client returns the current cluster client, nil if none could be created.
+func (b *backend) client() *cluster.Cluster {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.redisCluster
+}
+
+// masterReachable tells whether master answers: as last pinged by the replica
+// router if it knows the node, else as long as its circuit breaker is not open.
+func (b *backend) masterReachable(master string) bool {
+	if b.replicas != nil {
+		if reachable, known := b.replicas.reachable(master); known {
+			return reachable
+		}
+	}
+	return !b.breakers.isOpen(master)
+}
+
+// recordRedirect is called by the cluster client for every MOVED and ASK.
+func (b *backend) recordRedirect(addr string, redirect string) {
+	if b.replicas != nil {
+		b.replicas.recordRedirect(addr, redirect)
+		return
+	}
+	GMonitor.RecordRedirect(b.proxyCluster.Cluster, addr, redirect)
+}
+
+func (b *backend) timeoutError(err error, node string, readTimeout time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return asTimeoutError(err, node, time.Duration(b.proxyCluster.Connect_timeout)*time.Millisecond,
+		readTimeout, time.Duration(b.proxyCluster.Write_timeout)*time.Millisecond)
+}
+
+func (b *backend) Servers() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.servers
+}
+
+// Refresh creates a cluster client for servers and swaps it in, nothing is
+// changed when servers are the same as the current ones.
+func (b *backend) Refresh(servers []string) error {
+	return b.refresh(servers, false)
+}
+
+// RefreshTopology recreates the cluster client from the current servers so
+// it reloads the slot map, the slot map of the replica router is reloaded too.
+func (b *backend) RefreshTopology() error {
+	if b.replicas != nil {
+		b.replicas.triggerRefresh()
+	}
+	return b.refresh(b.Servers(), true)
+}
+
+func (b *backend) refresh(servers []string, force bool) error {
+	servers = append([]string{}, servers...)
+	sort.Strings(servers)
+	b.mu.RLock()
+	same := b.redisCluster != nil && strings.Join(b.servers, ",") == strings.Join(servers, ",")
+	b.mu.RUnlock()
+	if same && !force {
+		return nil
+	}
+
+	redisCluster, err := b.createRedisCluster(servers)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	old := b.redisCluster
+	b.redisCluster = redisCluster
+	b.servers = servers
+	b.mu.Unlock()
+	log.Infof("redis cluster refreshed,cluster=%s,servers=%v", b.proxyCluster.Cluster, servers)
+
+	if old != nil {
+		time.AfterFunc(backendCloseDelay, old.Close)
+	}
+	return nil
+}
+
+func (b *backend) Close() {
+	if b.replicas != nil {
+		b.replicas.Close()
+	}
+	b.hedger.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.redisCluster != nil {
+		b.redisCluster.Close()
+	}
+	b.redisCluster = nil
+}
+
+func (b *backend) createRedisCluster(servers []string) (*cluster.Cluster, error) {
+	proxyCluster := b.proxyCluster
+	return cluster.NewCluster(
+		&cluster.Options{
+			StartNodes:   servers,
+			ConnTimeout:  time.Duration(proxyCluster.Connect_timeout) * time.Millisecond,
+			ReadTimeout:  time.Duration(proxyCluster.Read_timeout) * time.Millisecond,
+			WriteTimeout: time.Duration(proxyCluster.Write_timeout) * time.Millisecond,
+			PoolSize:     proxyCluster.Pool_size,
+			AliveTime:    60 * time.Second,
+			// not read past them, see bigKeys.rejected
+			ReplyMaxBytes:    proxyCluster.Reply_max_bytes,
+			ReplyMaxElements: proxyCluster.Reply_max_elements,
+			Breaker:          b.breakers,
+			OnRedirect:       b.recordRedirect,
+		})
+}
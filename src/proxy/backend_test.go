@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"cluster"
+)
+
+// clusterSlotsReply maps every slot to the master addr.
+func clusterSlotsReply(addr string) string {
+	return "*1\r\n" + slotRangeReply(0, 16383, addr)
+}
+
+// slotRangeReply is one entry of a CLUSTER SLOTS reply without replicas.
+func slotRangeReply(start, end int, addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+	return "*3\r\n:" + strconv.Itoa(start) + "\r\n:" + strconv.Itoa(end) + "\r\n*2\r\n$" +
+		strconv.Itoa(len(host)) + "\r\n" + host + "\r\n:" + port + "\r\n"
+}
+
+func Test_BackendRedirects(t *testing.T) {
+	key := "item_1"
+	slot := cluster.Slot([]byte(key))
+	// the slot moved from a to b and is migrating from b to c
+	c := startFakeRedis(t, func(cmd string, asking bool) string {
+		if cmd == "GET" && asking {
+			return "$1\r\nc\r\n"
+		}
+		return "-ERR unexpected\r\n"
+	})
+	b := startFakeRedis(t, func(cmd string, asking bool) string {
+		return "-ASK " + strconv.Itoa(slot) + " " + c + "\r\n"
+	})
+	var self atomic.Value
+	a := startFakeRedis(t, func(cmd string, asking bool) string {
+		switch cmd {
+		case "CLUSTER":
+			return clusterSlotsReply(self.Load().(string))
+		case "PING":
+			return "+PONG\r\n"
+		}
+		return "-MOVED " + strconv.Itoa(slot) + " " + b + "\r\n"
+	})
+	self.Store(a)
+	proxyCluster := newTestProxyCluster("redirect_cluster")
+	proxyCluster.Read_preference = ReadPreferenceMaster
+	backend := newBackend(proxyCluster, []string{a})
+	t.Cleanup(backend.Close)
+
+	req := slowRequest("GET", 0, key)
+	reply, err := backend.doMaster(req)
+	if err != nil || string(reply.(cluster.Raw)) != "$1\r\nc\r\n" || req.node != c {
+		t.Fatalf("redirected GET returned %q,%v from %s", reply, err, req.node)
+	}
+	if moved := atomic.LoadInt64(&backend.replicas.nodes[a].moved); moved != 1 {
+		t.Errorf("moved=%d", moved)
+	}
+
+	cp := newTestAdminCluster("redirect_admin_cluster")
+	cp.backend = backend
+	var topology struct {
+		Slots       []SlotRangeInfo
+		Nodes       []NodeHealth
+		RefreshedAt int64 `json:"refreshed_at"`
+	}
+	handler := adminAuth("secret", http.HandlerFunc(adminCluster))
+	adminRequest(t, handler, http.MethodGet, "/clusters/redirect_admin_cluster/topology", &topology)
+	if topology.RefreshedAt == 0 || len(topology.Slots) != 1 || topology.Slots[0].Master != a ||
+		len(topology.Nodes) != 1 || !topology.Nodes[0].Reachable {
+		t.Errorf("topology=%+v", topology)
+	}
+}
+
+func Test_BackendRedirectLoop(t *testing.T) {
+	var addr atomic.Value
+	self := startFakeRedis(t, func(cmd string, asking bool) string {
+		if cmd == "CLUSTER" {
+			return clusterSlotsReply(addr.Load().(string))
+		}
+		return "-ASK 0 " + addr.Load().(string) + "\r\n"
+	})
+	addr.Store(self)
+	backend := newBackend(newTestProxyCluster("redirect_loop_cluster"), []string{self})
+	t.Cleanup(backend.Close)
+	if _, err := backend.doMaster(slowRequest("GET", 0, "item_1")); commandOutcome(nil, err) != OutcomeBackendDown {
+		t.Errorf("redirection loop returned %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cluster"
+	log "github.com/cihub/seelog"
+)
+
+// big keys kept per cluster, the smallest one is evicted beyond it
+const bigKeysMaxLen = 1024
+
+// BigKey is a key whose replies went over the big key thresholds, bytes and
+// elements are the largest reply seen.
+type BigKey struct {
+	Key      string `json:"key"`
+	Slot     int    `json:"slot"`
+	Command  string `json:"command"`
+	Bytes    int    `json:"bytes"`
+	Elements int    `json:"elements"`
+	Count    int64  `json:"count"`
+	LastSeen int64  `json:"last_seen"`
+}
+
+// bigKeys watches the reply sizes of a cluster.
+type bigKeys struct {
+	cluster     string
+	bytes       int
+	elements    int
+	maxBytes    int
+	maxElements int
+
+	mu   sync.Mutex
+	keys map[string]*BigKey
+}
+
+// newBigKeys returns nil if neither thresholds nor limits are configured.
+func newBigKeys(proxyCluster *ProxyClusterConfig) *bigKeys {
+	if proxyCluster.Bigkey_bytes <= 0 && proxyCluster.Bigkey_elements <= 0 &&
+		proxyCluster.Reply_max_bytes <= 0 && proxyCluster.Reply_max_elements <= 0 {
+		return nil
+	}
+	return &bigKeys{
+		cluster:     proxyCluster.Cluster,
+		bytes:       proxyCluster.Bigkey_bytes,
+		elements:    proxyCluster.Bigkey_elements,
+		maxBytes:    proxyCluster.Reply_max_bytes,
+		maxElements: proxyCluster.Reply_max_elements,
+		keys:        make(map[string]*BigKey),
+	}
+}
+
+// replySize returns the payload bytes of reply and the number of elements of
+// an array reply.
+func replySize(reply interface{}) (int, int) {
+	switch v := reply.(type) {
+	case cluster.Raw:
+		return v.Size()
+	case []byte:
+		return len(v), 0
+	case string:
+		return len(v), 0
+	case []interface{}:
+		size := 0
+		for _, item := range v {
+			itemSize, _ := replySize(item)
+			size += itemSize
+		}
+		return size, len(v)
+	}
+	return 0, 0
+}
+
+// Check records the reply of req if it is big and turns it into an error if
+// it is over the hard limits. The backend pools stop reading a raw reply
+// over them at its header already, see rejected, Check catches the replies
+// only over them once merged from a split command.
+func (bk *bigKeys) Check(req *proxyRequest, reply interface{}) (interface{}, error) {
+	if bk == nil {
+		return reply, nil
+	}
+	if _, ok := reply.(*cluster.Stream); ok {
+		// its size is known once written, see streamed, the pool checks it
+		// against the limits while it is written
+		return reply, nil
+	}
+	size, elements := replySize(reply)
+	big := (bk.bytes > 0 && size >= bk.bytes) || (bk.elements > 0 && elements >= bk.elements)
+	if big && len(req.args) > 0 {
+		bk.record(req, size, elements)
+	}
+	var err error
+	if bk.maxBytes > 0 && size > bk.maxBytes {
+		err = ProtocolError("reply of " + strconv.Itoa(size) + " bytes exceeds reply_max_bytes")
+	} else if bk.maxElements > 0 && elements > bk.maxElements {
+		err = ProtocolError("reply of " + strconv.Itoa(elements) + " elements exceeds reply_max_elements")
+	}
+	if err != nil {
+		GMonitor.RecordOne(bk.cluster + ".reply_rejected")
+		// never written, the buffer goes back to the pool
+		cluster.Release(reply)
+		return nil, err
+	}
+	return reply, nil
+}
+
+// rejected turns a reply a backend pool refused to read for being over the
+// hard limits into the error Check answers with, other errors are returned
+// as they are.
+func (bk *bigKeys) rejected(err error) error {
+	tooLarge, ok := err.(cluster.ReplyTooLargeError)
+	if !ok || bk == nil {
+		return err
+	}
+	GMonitor.RecordOne(bk.cluster + ".reply_rejected")
+	if tooLarge.Elements > 0 {
+		return ProtocolError("reply of " + strconv.Itoa(tooLarge.Elements) + " elements exceeds reply_max_elements")
+	}
+	return ProtocolError("reply of at least " + strconv.Itoa(tooLarge.Bytes) + " bytes exceeds reply_max_bytes")
+}
+
+// streamed records the reply of req streamed to the client if it was big.
+func (bk *bigKeys) streamed(req *proxyRequest, stream *cluster.Stream) {
+	if bk == nil || len(req.args) == 0 {
+		return
+	}
+	size, elements := stream.Size()
+	if (bk.bytes > 0 && size >= bk.bytes) || (bk.elements > 0 && elements >= bk.elements) {
+		bk.record(req, size, elements)
+	}
+}
+
+func (bk *bigKeys) record(req *proxyRequest, size int, elements int) {
+	key := req.args[0].([]byte)
+	bk.mu.Lock()
+	entry, ok := bk.keys[string(key)]
+	grown := !ok || size > entry.Bytes || elements > entry.Elements
+	if !ok {
+		if len(bk.keys) >= bigKeysMaxLen {
+			bk.evictSmallest()
+		}
+		entry = &BigKey{Key: string(key), Slot: cluster.Slot(key)}
+		bk.keys[entry.Key] = entry
+	}
+	entry.Command = req.cmd
+	if size > entry.Bytes {
+		entry.Bytes = size
+	}
+	if elements > entry.Elements {
+		entry.Elements = elements
+	}
+	entry.Count++
+	entry.LastSeen = time.Now().Unix()
+	bk.mu.Unlock()
+
+	if grown {
+		log.Warnf("big key,cluster=%s,key=%q,slot=%d,cmd=%s,bytes=%d,elements=%d", bk.cluster, key, cluster.Slot(key), req.cmd, size, elements)
+		GMonitor.RecordOne(bk.cluster + ".bigkey")
+	}
+}
+
+func (bk *bigKeys) evictSmallest() {
+	var smallest *BigKey
+	for _, entry := range bk.keys {
+		if smallest == nil || entry.Bytes < smallest.Bytes {
+			smallest = entry
+		}
+	}
+	delete(bk.keys, smallest.Key)
+}
+
+// Top returns the n biggest keys by bytes, n < 0 returns all of them.
+func (bk *bigKeys) Top(n int) []BigKey {
+	bk.mu.Lock()
+	result := make([]BigKey, 0, len(bk.keys))
+	for _, entry := range bk.keys {
+		result = append(result, *entry)
+	}
+	bk.mu.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Bytes > result[j].Bytes })
+	if n >= 0 && n < len(result) {
+		result = result[:n]
+	}
+	return result
+}
+
+func (bk *bigKeys) Reset() {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+	bk.keys = make(map[string]*BigKey)
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"cluster"
+)
+
+func Test_BigKeys(t *testing.T) {
+	proxyCluster := newTestProxyCluster("bigkey_cluster")
+	proxyCluster.Bigkey_bytes = 10
+	proxyCluster.Bigkey_elements = 3
+	proxyCluster.Reply_max_elements = 5
+	bk := newBigKeys(proxyCluster)
+
+	small := &proxyRequest{cmd: "GET", args: []interface{}{[]byte("small")}}
+	if reply, err := bk.Check(small, []byte("123")); err != nil || string(reply.([]byte)) != "123" {
+		t.Errorf("small reply changed to %v,%v", reply, err)
+	}
+	big := &proxyRequest{cmd: "GET", args: []interface{}{[]byte("big")}}
+	bk.Check(big, []byte("0123456789abcdef"))
+	hash := &proxyRequest{cmd: "HGETALL", args: []interface{}{[]byte("hash")}}
+	bk.Check(hash, []interface{}{[]byte("f1"), []byte("v1"), []byte("f2"), []byte("v2")})
+
+	top := bk.Top(-1)
+	if len(top) != 2 || top[0].Key != "big" || top[0].Bytes != 16 {
+		t.Fatalf("big keys=%+v", top)
+	}
+	if top[1].Key != "hash" || top[1].Elements != 4 || top[1].Bytes != 8 || top[1].Command != "HGETALL" {
+		t.Errorf("unexpected big key %+v", top[1])
+	}
+
+	huge := make([]interface{}, 6)
+	for i := range huge {
+		huge[i] = []byte("v")
+	}
+	if _, err := bk.Check(hash, huge); err == nil {
+		t.Error("reply over reply_max_elements accepted")
+	}
+
+	bk.Reset()
+	if len(bk.Top(-1)) != 0 {
+		t.Error("big keys left after reset")
+	}
+}
+
+func Test_BigKeysDisabled(t *testing.T) {
+	bk := newBigKeys(newTestProxyCluster("bigkey_disabled"))
+	if bk != nil {
+		t.Fatal("big keys enabled without thresholds")
+	}
+	if reply, err := bk.Check(&proxyRequest{cmd: "GET"}, []byte("v")); err != nil || reply == nil {
+		t.Errorf("disabled check changed the reply,%v,%v", reply, err)
+	}
+}
+
+func Test_ProcessReplyLimits(t *testing.T) {
+	var self atomic.Value
+	node := startFakeRedis(t, func(cmd string, asking bool) string {
+		switch cmd {
+		case "CLUSTER":
+			return clusterSlotsReply(self.Load().(string))
+		case "GET":
+			return "$16\r\n0123456789abcdef\r\n"
+		case "HGETALL":
+			return "*6\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\ne\r\n$1\r\nf\r\n"
+		}
+		return "$1\r\nv\r\n"
+	})
+	self.Store(node)
+	proxyCluster := newTestProxyCluster("reply_limit_cluster")
+	proxyCluster.Read_preference = ReadPreferenceMaster
+	proxyCluster.Reply_max_bytes = 10
+	proxyCluster.Reply_max_elements = 5
+	proxyCluster.Server_failure_limit = 1
+	proxyCluster.Server_retry_timeout = 60000
+	b := newBackend(proxyCluster, []string{node})
+	t.Cleanup(b.Close)
+	cp := newClusterProxy(proxyCluster, nil, b)
+
+	for _, c := range []struct{ cmd, err string }{
+		{"GET", "proxy: reply of at least 16 bytes exceeds reply_max_bytes"},
+		{"HGETALL", "proxy: reply of 6 elements exceeds reply_max_elements"},
+	} {
+		if reply, err := process(cp, slowRequest(c.cmd, 0, "k")); err == nil || err.Error() != c.err {
+			t.Errorf("%s returned %q,%v", c.cmd, reply, err)
+		}
+	}
+	// the connections left with unread replies were closed, not reused
+	reply, err := process(cp, slowRequest("LRANGE", 0, "k", "0", "-1"))
+	if err != nil || string(reply.(cluster.Raw)) != "$1\r\nv\r\n" {
+		t.Fatalf("command after the rejected replies returned %q,%v", reply, err)
+	}
+	if b.breakers.isOpen(node) {
+		t.Error("rejected replies opened the circuit breaker")
+	}
+}
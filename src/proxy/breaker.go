@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cluster"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	BreakerClosed int32 = iota
+	// commands to the node fail fast until server_retry_timeout has passed
+	BreakerOpen
+	// one probe command is let through, its result closes or opens the breaker again
+	BreakerHalfOpen
+)
+
+var breakerStateNames = []string{"closed", "open", "half_open"}
+
+// circuitBreaker stops sending commands to a node after server_failure_limit
+// consecutive failures.
+type circuitBreaker struct {
+	cluster string
+	node    string
+
+	// atomic, read without the lock on the hot path
+	state    int32
+	failures int32
+
+	mu sync.Mutex
+	// when the breaker opened or the last probe was let through
+	openedAt time.Time
+	opens    int64
+}
+
+// nodeBreakers holds the circuit breakers of the nodes of a cluster, a nil
+// nodeBreakers lets everything through.
+type nodeBreakers struct {
+	cluster      string
+	failureLimit int32
+	retryTimeout time.Duration
+
+	// node address -> *circuitBreaker
+	breakers sync.Map
+}
+
+func newNodeBreakers(proxyCluster *ProxyClusterConfig) *nodeBreakers {
+	return &nodeBreakers{
+		cluster:      proxyCluster.Cluster,
+		failureLimit: int32(proxyCluster.Server_failure_limit),
+		retryTimeout: time.Duration(proxyCluster.Server_retry_timeout) * time.Millisecond,
+	}
+}
+
+func (nb *nodeBreakers) get(node string) *circuitBreaker {
+	if cb, ok := nb.breakers.Load(node); ok {
+		return cb.(*circuitBreaker)
+	}
+	cb, _ := nb.breakers.LoadOrStore(node, &circuitBreaker{cluster: nb.cluster, node: node})
+	return cb.(*circuitBreaker)
+}
+
+// Allow returns an error if commands to node must fail fast, an unknown node
+// is always allowed.
+func (nb *nodeBreakers) Allow(node string) error {
+	if nb == nil || node == "" {
+		return nil
+	}
+	cb := nb.get(node)
+	if atomic.LoadInt32(&cb.state) == BreakerClosed {
+		return nil
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	// a probe that never reported back does not keep the breaker half open forever
+	if cb.state != BreakerClosed && time.Since(cb.openedAt) >= nb.retryTimeout {
+		cb.openedAt = time.Now()
+		cb.setState(BreakerHalfOpen)
+		return nil
+	}
+	if cb.state == BreakerClosed {
+		return nil
+	}
+	return BackendDownError("node " + node + " is down, circuit breaker " + breakerStateNames[cb.state])
+}
+
+// isOpen tells whether commands to node fail fast, unlike Allow it never lets
+// a probe through.
+func (nb *nodeBreakers) isOpen(node string) bool {
+	if nb == nil {
+		return false
+	}
+	cb, ok := nb.breakers.Load(node)
+	return ok && atomic.LoadInt32(&cb.(*circuitBreaker).state) == BreakerOpen
+}
+
+// Record counts the result of a command sent to node, err is the error of
+// the call and not a redis error reply. An exhausted pool and a reply over
+// the reply limits are not counted, they say nothing about node.
+func (nb *nodeBreakers) Record(node string, err error) {
+	if nb == nil || node == "" || err == cluster.ErrPoolExhausted {
+		return
+	}
+	if _, ok := err.(cluster.ReplyTooLargeError); ok {
+		return
+	}
+	cb := nb.get(node)
+	if err == nil && atomic.LoadInt32(&cb.state) == BreakerClosed && atomic.LoadInt32(&cb.failures) == 0 {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if err == nil {
+		atomic.StoreInt32(&cb.failures, 0)
+		if cb.state != BreakerClosed {
+			cb.setState(BreakerClosed)
+		}
+		return
+	}
+	failures := atomic.AddInt32(&cb.failures, 1)
+	if cb.state == BreakerHalfOpen || (cb.state == BreakerClosed && failures >= nb.failureLimit) {
+		cb.openedAt = time.Now()
+		cb.opens++
+		cb.setState(BreakerOpen)
+		log.Warnf("circuit breaker open,cluster=%s,node=%s,failures=%d,error=%v", cb.cluster, cb.node, failures, err)
+	}
+}
+
+// setState must be called with mu held.
+func (cb *circuitBreaker) setState(state int32) {
+	atomic.StoreInt32(&cb.state, state)
+	if state == BreakerClosed {
+		log.Infof("circuit breaker closed,cluster=%s,node=%s", cb.cluster, cb.node)
+	}
+	GMonitor.RecordBreakerState(cb.cluster, cb.node, breakerStateNames[state])
+}
+
+// BreakerInfo is the admin api view of a circuit breaker.
+type BreakerInfo struct {
+	Node     string `json:"node"`
+	State    string `json:"state"`
+	Failures int32  `json:"failures"`
+	Opens    int64  `json:"opens"`
+	// unix seconds of the last open or probe, 0 if it never opened
+	OpenedAt int64 `json:"opened_at"`
+}
+
+// States returns the breakers of every node seen so far sorted by node.
+func (nb *nodeBreakers) States() []BreakerInfo {
+	result := make([]BreakerInfo, 0)
+	if nb == nil {
+		return result
+	}
+	nb.breakers.Range(func(_, value interface{}) bool {
+		cb := value.(*circuitBreaker)
+		cb.mu.Lock()
+		info := BreakerInfo{
+			Node:     cb.node,
+			State:    breakerStateNames[cb.state],
+			Failures: atomic.LoadInt32(&cb.failures),
+			Opens:    cb.opens,
+		}
+		if !cb.openedAt.IsZero() {
+			info.OpenedAt = cb.openedAt.Unix()
+		}
+		cb.mu.Unlock()
+		result = append(result, info)
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].Node < result[j].Node })
+	return result
+}
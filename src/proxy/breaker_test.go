@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestBreakers() *nodeBreakers {
+	proxyCluster := newTestProxyCluster("breaker_cluster")
+	proxyCluster.Server_failure_limit = 2
+	proxyCluster.Server_retry_timeout = 50
+	return newNodeBreakers(proxyCluster)
+}
+
+func Test_CircuitBreaker(t *testing.T) {
+	nb := newTestBreakers()
+	node := "10.0.0.1:7000"
+	failure := errors.New("connection refused")
+
+	nb.Record(node, failure)
+	nb.Record(node, nil)
+	nb.Record(node, failure)
+	if err := nb.Allow(node); err != nil {
+		t.Fatalf("breaker opened before consecutive failures,%v", err)
+	}
+	nb.Record(node, failure)
+	err := nb.Allow(node)
+	if err == nil || commandOutcome(nil, err) != OutcomeBackendDown {
+		t.Fatalf("open breaker returned %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := nb.Allow(node); err != nil {
+		t.Fatalf("probe after the retry timeout rejected,%v", err)
+	}
+	if err := nb.Allow(node); err == nil {
+		t.Error("second command let through while probing")
+	}
+	nb.Record(node, failure)
+	if err := nb.Allow(node); err == nil {
+		t.Error("failed probe did not open the breaker again")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	nb.Allow(node)
+	nb.Record(node, nil)
+	if err := nb.Allow(node); err != nil {
+		t.Errorf("successful probe did not close the breaker,%v", err)
+	}
+
+	states := nb.States()
+	if len(states) != 1 || states[0].State != "closed" || states[0].Opens != 2 || states[0].OpenedAt == 0 {
+		t.Errorf("states=%+v", states)
+	}
+	if err := nb.Allow(""); err != nil {
+		t.Errorf("unknown node rejected,%v", err)
+	}
+	if err := (*nodeBreakers)(nil).Allow(node); err != nil {
+		t.Errorf("nil breakers rejected,%v", err)
+	}
+}
+
+func Test_AdminBreakers(t *testing.T) {
+	cp := newTestAdminCluster("breaker_admin_cluster")
+	cp.backend.breakers = newTestBreakers()
+	cp.backend.breakers.Record("10.0.0.1:7000", errors.New("timeout"))
+	cp.backend.breakers.Record("10.0.0.1:7000", errors.New("timeout"))
+
+	var states []BreakerInfo
+	handler := adminAuth("secret", http.HandlerFunc(adminCluster))
+	adminRequest(t, handler, http.MethodGet, "/clusters/breaker_admin_cluster/breakers", &states)
+	if len(states) != 1 || states[0].Node != "10.0.0.1:7000" || states[0].State != "open" || states[0].Failures != 2 {
+		t.Errorf("breakers=%+v", states)
+	}
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clusterProxy is the running proxy of one cluster, the admin api inspects
+// and controls it.
+type clusterProxy struct {
+	config   *ProxyClusterConfig
+	listener net.Listener
+	backend  *backend
+	slowlog  *slowlog
+	// nil if hot key detection is disabled
+	hotKeys *hotKeys
+	// nil if big key detection is disabled
+	bigKeys *bigKeys
+	// nil if the audit log is disabled
+	audit   *auditLog
+	monitor *monitorHub
+	// nil if the cluster has no rate limits
+	limiter *rateLimiter
+	// nil if the cluster has no users, AUTH fails then
+	users clusterUsers
+
+	// session id -> *sessionInfo
+	sessions      sync.Map
+	nextSessionId int64
+}
+
+var clusterProxies = struct {
+	sync.RWMutex
+	m map[string]*clusterProxy
+}{m: make(map[string]*clusterProxy)}
+
+func newClusterProxy(proxyCluster *ProxyClusterConfig, listener net.Listener, redisCluster *backend) *clusterProxy {
+	cp := &clusterProxy{
+		config:   proxyCluster,
+		listener: listener,
+		backend:  redisCluster,
+		slowlog:  newSlowlog(proxyCluster),
+		hotKeys:  newHotKeys(proxyCluster),
+		bigKeys:  newBigKeys(proxyCluster),
+		audit:    newAuditLog(proxyCluster),
+		monitor:  newMonitorHub(proxyCluster.Cluster),
+		limiter:  newRateLimiter(proxyCluster),
+		users:    newClusterUsers(proxyCluster),
+	}
+	clusterProxies.Lock()
+	clusterProxies.m[proxyCluster.Cluster] = cp
+	clusterProxies.Unlock()
+	return cp
+}
+
+func getClusterProxy(cluster string) *clusterProxy {
+	clusterProxies.RLock()
+	defer clusterProxies.RUnlock()
+	return clusterProxies.m[cluster]
+}
+
+// allClusterProxies returns the running cluster proxies sorted by cluster name.
+func allClusterProxies() []*clusterProxy {
+	clusterProxies.RLock()
+	result := make([]*clusterProxy, 0, len(clusterProxies.m))
+	for _, cp := range clusterProxies.m {
+		result = append(result, cp)
+	}
+	clusterProxies.RUnlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].config.Cluster < result[j].config.Cluster })
+	return result
+}
+
+// sessionInfo tracks a client session for the admin api.
+type sessionInfo struct {
+	id      int64
+	session ClientSession
+	created time.Time
+	// unix nanos of the last command
+	lastActive int64
+	commands   int64
+	// sessionIdle, sessionBusy or sessionClosing, updated atomically
+	state int32
+}
+
+const (
+	// waiting for the next command
+	sessionIdle int32 = iota
+	// serving a command
+	sessionBusy
+	// closed between two commands by a drain
+	sessionClosing
+)
+
+// SessionInfo is the admin api view of a client session.
+type SessionInfo struct {
+	Id       int64   `json:"id"`
+	Addr     string  `json:"addr"`
+	Age      float64 `json:"age"`
+	Idle     float64 `json:"idle"`
+	Commands int64   `json:"commands"`
+}
+
+func (cp *clusterProxy) addSession(session ClientSession) *sessionInfo {
+	now := time.Now()
+	info := &sessionInfo{
+		id:         atomic.AddInt64(&cp.nextSessionId, 1),
+		session:    session,
+		created:    now,
+		lastActive: now.UnixNano(),
+	}
+	cp.sessions.Store(info.id, info)
+	return info
+}
+
+func (cp *clusterProxy) removeSession(info *sessionInfo) {
+	cp.sessions.Delete(info.id)
+}
+
+// active marks the session busy with a command, false if a drain closed it
+// in the meantime and the command must not be served.
+func (info *sessionInfo) active(now time.Time) bool {
+	if !atomic.CompareAndSwapInt32(&info.state, sessionIdle, sessionBusy) {
+		return false
+	}
+	atomic.AddInt64(&info.commands, 1)
+	atomic.StoreInt64(&info.lastActive, now.UnixNano())
+	return true
+}
+
+// idle marks the session waiting for its next command.
+func (info *sessionInfo) idle() {
+	atomic.CompareAndSwapInt32(&info.state, sessionBusy, sessionIdle)
+}
+
+// closeIdleSessions closes the sessions waiting for their next command and
+// returns how many it closed, busy sessions are left to finish their command.
+func (cp *clusterProxy) closeIdleSessions() int {
+	closed := 0
+	cp.sessions.Range(func(key, value interface{}) bool {
+		info := value.(*sessionInfo)
+		if atomic.CompareAndSwapInt32(&info.state, sessionIdle, sessionClosing) {
+			info.session.Close()
+			closed++
+		}
+		return true
+	})
+	return closed
+}
+
+// Sessions lists the open client sessions sorted by id, ages are seconds.
+func (cp *clusterProxy) Sessions() []SessionInfo {
+	now := time.Now()
+	result := make([]SessionInfo, 0)
+	cp.sessions.Range(func(key, value interface{}) bool {
+		info := value.(*sessionInfo)
+		result = append(result, SessionInfo{
+			Id:       info.id,
+			Addr:     info.session.RemoteAddr(),
+			Age:      now.Sub(info.created).Seconds(),
+			Idle:     now.Sub(time.Unix(0, atomic.LoadInt64(&info.lastActive))).Seconds(),
+			Commands: atomic.LoadInt64(&info.commands),
+		})
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result
+}
+
+// KillSession closes the connection of a session, false if there is no such session.
+func (cp *clusterProxy) KillSession(id int64) bool {
+	value, ok := cp.sessions.Load(id)
+	if !ok {
+		return false
+	}
+	value.(*sessionInfo).session.Close()
+	return true
+}
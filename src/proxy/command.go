@@ -1,12 +1,19 @@
 package proxy
 
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
 /**map[command]forbidden*/
 var commands = map[string]bool{
 	"CLUSTER":   true, //
 	"READONLY":  true, //
 	"READWRITE": true, //
 
-	"AUTH":   true, //
 	"ECHO":   true, //
 	"SELECT": true, //
 
@@ -52,12 +59,10 @@ var commands = map[string]bool{
 	"FLUSHDB":  true, //
 	"INFO":     true, //
 	"LASTSAVE": true, //
-	"MONITOR":  true, //
 	"ROLE":     true, //
 	"SAVE":     true, //
 	"SHUTDOWN": true, //
 	"SLAVEOF":  true, //
-	"SLOWLOG":  true, //
 	"SYNC":     true, //
 	"TIME":     true, //
 
@@ -75,11 +80,177 @@ var commands = map[string]bool{
 
 }
 
+// forbiddenCommands holds the map[command]forbidden in use, it is replaced as
+// a whole when a command is toggled at runtime.
+var forbiddenCommands atomic.Value
+
+var forbiddenMu sync.Mutex
+
+func init() {
+	forbiddenCommands.Store(commands)
+}
+
 func IsCmdForbidden(cmd string) bool {
-	supported, ok := commands[cmd]
+	supported, ok := forbiddenCommands.Load().(map[string]bool)[cmd]
 	if ok {
 		return supported
 	} else {
 		return false
 	}
 }
+
+// SetCmdForbidden forbids or allows cmd from now on.
+func SetCmdForbidden(cmd string, forbidden bool) {
+	forbiddenMu.Lock()
+	defer forbiddenMu.Unlock()
+	current := forbiddenCommands.Load().(map[string]bool)
+	next := make(map[string]bool, len(current)+1)
+	for k, v := range current {
+		next[k] = v
+	}
+	next[cmd] = forbidden
+	forbiddenCommands.Store(next)
+}
+
+// ForbiddenCommands returns the commands currently forbidden, sorted.
+func ForbiddenCommands() []string {
+	result := make([]string, 0)
+	for cmd, forbidden := range forbiddenCommands.Load().(map[string]bool) {
+		if forbidden {
+			result = append(result, cmd)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+/**map[command]readonly, commands allowed to be served by replicas*/
+var readOnlyCommands = map[string]bool{
+	"BITCOUNT":         true, //
+	"BITPOS":           true, //
+	"DUMP":             true, //
+	"EXISTS":           true, //
+	"GET":              true, //
+	"GETBIT":           true, //
+	"GETRANGE":         true, //
+	"HEXISTS":          true, //
+	"HGET":             true, //
+	"HGETALL":          true, //
+	"HKEYS":            true, //
+	"HLEN":             true, //
+	"HMGET":            true, //
+	"HSCAN":            true, //
+	"HVALS":            true, //
+	"LINDEX":           true, //
+	"LLEN":             true, //
+	"LRANGE":           true, //
+	"MGET":             true, //
+	"PTTL":             true, //
+	"SCARD":            true, //
+	"SISMEMBER":        true, //
+	"SMEMBERS":         true, //
+	"SRANDMEMBER":      true, //
+	"SSCAN":            true, //
+	"STRLEN":           true, //
+	"SUBSTR":           true, //
+	"TTL":              true, //
+	"TYPE":             true, //
+	"ZCARD":            true, //
+	"ZCOUNT":           true, //
+	"ZLEXCOUNT":        true, //
+	"ZRANGE":           true, //
+	"ZRANGEBYLEX":      true, //
+	"ZRANGEBYSCORE":    true, //
+	"ZRANK":            true, //
+	"ZREVRANGE":        true, //
+	"ZREVRANGEBYLEX":   true, //
+	"ZREVRANGEBYSCORE": true, //
+	"ZREVRANK":         true, //
+	"ZSCAN":            true, //
+	"ZSCORE":           true, //
+}
+
+func IsCmdReadOnly(cmd string) bool {
+	return readOnlyCommands[cmd]
+}
+
+/**map[command]idempotent, writes leaving the same data and getting the same
+reply when run twice, e.g. DEL or SADD are not: a retry after a first attempt
+that lost its reply counts nothing removed or added*/
+var idempotentCommands = map[string]bool{
+	"SET":    true, // unless NX, XX or GET, see IsCmdIdempotent
+	"SETEX":  true, //
+	"PSETEX": true, //
+	"MSET":   true, //
+	"HMSET":  true, //
+	"LSET":   true, //
+}
+
+// IsCmdIdempotent tells whether cmd with args can be sent again after a
+// failure, read only commands are idempotent.
+func IsCmdIdempotent(cmd string, args []interface{}) bool {
+	if readOnlyCommands[cmd] {
+		return true
+	}
+	if !idempotentCommands[cmd] {
+		return false
+	}
+	if cmd == "SET" {
+		// SET ... GET replies the value the first attempt wrote, SET ... NX or XX
+		// replies nil once the first attempt succeeded
+		for i := 2; i < len(args); i++ {
+			if p, ok := args[i].([]byte); ok && (strings.EqualFold(string(p), "GET") ||
+				strings.EqualFold(string(p), "NX") || strings.EqualFold(string(p), "XX")) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// otherCommands are the commands in none of the maps above that are still
+// looked up without allocating.
+var otherCommands = []string{
+	"APPEND", "DECR", "DECRBY", "DEL", "EXPIRE", "EXPIREAT", "GETSET", "HDEL", "HINCRBY",
+	"HINCRBYFLOAT", "HSET", "HSETNX", "INCR", "INCRBY", "INCRBYFLOAT", "LINSERT", "LPOP",
+	"LPUSH", "LPUSHX", "LREM", "LTRIM", "MONITOR", "MSETNX", "PERSIST", "PEXPIRE", "PEXPIREAT",
+	"PING", "QUIT", "RESTORE", "RPOP", "RPUSH", "RPUSHX", "SADD", "SETBIT", "SETNX", "SETRANGE",
+	"SORT", "SPOP", "SREM", "TOUCH", "UNLINK", "ZADD", "ZINCRBY", "ZREM", "ZREMRANGEBYLEX",
+	"ZREMRANGEBYRANK", "ZREMRANGEBYSCORE",
+}
+
+// maxCommandLen is the longest command name looked up without allocating.
+const maxCommandLen = 32
+
+// internedCommands maps the upper case name of the known commands to itself.
+var internedCommands = make(map[string]string)
+
+func init() {
+	for _, table := range []map[string]bool{commands, readOnlyCommands, idempotentCommands} {
+		for cmd := range table {
+			internedCommands[cmd] = cmd
+		}
+	}
+	for _, cmd := range otherCommands {
+		internedCommands[cmd] = cmd
+	}
+}
+
+// commandName returns name trimmed and in upper case, the known commands are
+// found without allocating.
+func commandName(name []byte) string {
+	name = bytes.TrimSpace(name)
+	if len(name) <= maxCommandLen {
+		var upper [maxCommandLen]byte
+		for i, c := range name {
+			if 'a' <= c && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+			upper[i] = c
+		}
+		if cmd, ok := internedCommands[string(upper[:len(name)])]; ok {
+			return cmd
+		}
+	}
+	return strings.ToUpper(string(name))
+}
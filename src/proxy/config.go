@@ -14,51 +14,173 @@ import (
 //attention! .yaml just support lowercase.
 type ProxyConfig struct {
 	Zookeeper_servers    []string
+	Registry             string
+	Registry_root        string
+	Registry_file        string
 	Cpu_num              int
 	Client_connections   int
 	Timeout              int
+	Connect_timeout      int
+	Read_timeout         int
+	Write_timeout        int
+	Command_timeouts     map[string]int
+	Pool_size            int
+	Retry_max_attempts   int
+	Retry_backoff_ms     int
+	Retry_max_backoff_ms int
+	Retry_jitter         float64
+	Hedge_percentile     float64
+	Hedge_min_delay_ms   int
+	Hedge_budget         float64
 	Backlog              int
+	Client_idle_timeout  int
+	Client_write_timeout int
+	Tcp_keepalive        int
 	Server_retry_timeout int
 	Server_failure_limit int
+	Register_interval    int
+	Metrics_listen       string
+	Monitor_max_commands int
+	Slowlog_threshold_ms int
+	Slowlog_max_len      int
+	Slowlog_logger       string
+	Hotkey_top_k         int
+	Hotkey_window        int
+	Hotkey_qps_threshold int
+	Bigkey_bytes         int
+	Bigkey_elements      int
+	Reply_max_bytes      int
+	Reply_max_elements   int
+	Audit_args           string
+	Audit_max_size_mb    int
+	Audit_max_backups    int
+	Rate_limit_action    string
+	Rate_limit_delay_ms  int
+	Rate_limit_error     string
+	Admin_listen         string
+	Admin_token          string `json:"-"`
+	Admin_pprof          bool
+	Drain_timeout        int
+	Tracing_endpoint     string
+	Tracing_sample_rate  float64
+	Tracing_insecure     bool
 	Proxy_clusters       []ProxyClusterConfig
 }
 type ProxyClusterConfig struct {
 	Cluster              string
 	Listen               string
+	Advertise            string
 	Servers              []string
+	Servers_path         string
 	Prefix               string
+	Read_preference      string
+	Replica_max_lag      int
 
 	Client_connections   int
 	Timeout              int
+	Connect_timeout      int
+	Read_timeout         int
+	Write_timeout        int
+	Command_timeouts     map[string]int
+	Pool_size            int
+	Retry_max_attempts   int
+	Retry_backoff_ms     int
+	Retry_max_backoff_ms int
+	Retry_jitter         float64
+	Hedge_percentile     float64
+	Hedge_min_delay_ms   int
+	Hedge_budget         float64
 	Backlog              int
+	Client_idle_timeout  int
+	Client_write_timeout int
+	Tcp_keepalive        int
 	Server_retry_timeout int
 	Server_failure_limit int
 	PrefixBytes          []byte
+	Register_interval    int
+	Slowlog_threshold_ms int
+	Slowlog_max_len      int
+	Hotkey_top_k         int
+	Hotkey_window        int
+	Hotkey_qps_threshold int
+	Bigkey_bytes         int
+	Bigkey_elements      int
+	Reply_max_bytes      int
+	Reply_max_elements   int
+	Audit_log            string
+	Audit_args           string
+	Audit_max_size_mb    int
+	Audit_max_backups    int
+	Rate_limit           RateLimitRule
+	Rate_limit_clients   []RateLimitRule
+	Rate_limit_users     []RateLimitRule
+	Rate_limit_action    string
+	Rate_limit_delay_ms  int
+	Rate_limit_error     string
+	Users                []ClusterUser
+
+	connections          int64
 }
 
+// ConfigFile is read at startup and on every reload.
+const ConfigFile = "./redis.yaml"
+
 func NewProxyConfig() *ProxyConfig {
+	config, err := LoadProxyConfig(ConfigFile)
+	if err != nil {
+		log.Errorf("error: %v", err)
+		os.Exit(1)
+	}
+	return config
+}
+
+// LoadProxyConfig reads the config file and fills in the defaults.
+func LoadProxyConfig(path string) (*ProxyConfig, error) {
 	config := &ProxyConfig{
 		Cpu_num:0,
 		Client_connections:102400,
 		Timeout:2000,
 		Backlog:1024,
+		Pool_size:1024,
+		Retry_max_attempts:1,
+		Retry_backoff_ms:10,
+		Retry_max_backoff_ms:100,
+		Retry_jitter:0.5,
+		Hedge_min_delay_ms:1,
+		Hedge_budget:5,
+		Tcp_keepalive:300,
 		Server_retry_timeout:200,
 		Server_failure_limit:2,
+		Register_interval:10,
+		Registry_root:"/gcache/proxy",
+		Registry_file:"./endpoints.json",
+		Slowlog_max_len:128,
+		Hotkey_window:60,
+		Audit_args:AuditArgsRedacted,
+		Audit_max_size_mb:100,
+		Audit_max_backups:10,
+		Rate_limit_action:RateLimitReject,
+		Rate_limit_delay_ms:100,
+		Rate_limit_error:"ERR rate limit exceeded",
+		Tracing_sample_rate:0.01,
 	}
-	filepath, _ := filepath.Abs("./redis.yaml")
+	filepath, _ := filepath.Abs(path)
 	log.Infof("config filepath: %s", filepath)
-	file, err := os.Open(filepath)
+	data, err := ioutil.ReadFile(filepath)
 	if err != nil {
-		log.Errorf("error: %v", err)
-		os.Exit(1)
+		return nil, err
 	}
-	data, err := ioutil.ReadAll(file)
 	log.Infof("config yaml:\n---------- ----------\n%s\n---------- ----------", string(data))
-	if err != nil {
-		log.Errorf("error: %v", err)
-		os.Exit(1)
+	if err = yaml.Unmarshal([]byte(data), config); err != nil {
+		return nil, err
+	}
+	if config.Registry == "" {
+		if len(config.Zookeeper_servers) > 0 {
+			config.Registry = RegistryZookeeper
+		} else {
+			config.Registry = RegistryNone
+		}
 	}
-	err = yaml.Unmarshal([]byte(data), config)
 	for i, _ := range config.Proxy_clusters {
 		pc := &config.Proxy_clusters[i]
 		if pc.Client_connections <= 0 {
@@ -70,25 +192,153 @@ func NewProxyConfig() *ProxyConfig {
 		if pc.Backlog <= 0 {
 			pc.Backlog = config.Backlog
 		}
+		// connect_timeout, read_timeout and write_timeout default to timeout
+		if pc.Connect_timeout <= 0 {
+			pc.Connect_timeout = config.Connect_timeout
+		}
+		if pc.Connect_timeout <= 0 {
+			pc.Connect_timeout = pc.Timeout
+		}
+		if pc.Read_timeout <= 0 {
+			pc.Read_timeout = config.Read_timeout
+		}
+		if pc.Read_timeout <= 0 {
+			pc.Read_timeout = pc.Timeout
+		}
+		if pc.Write_timeout <= 0 {
+			pc.Write_timeout = config.Write_timeout
+		}
+		if pc.Write_timeout <= 0 {
+			pc.Write_timeout = pc.Timeout
+		}
+		if pc.Command_timeouts == nil {
+			pc.Command_timeouts = config.Command_timeouts
+		}
+		if pc.Pool_size <= 0 {
+			pc.Pool_size = config.Pool_size
+		}
+		if pc.Retry_max_attempts <= 0 {
+			pc.Retry_max_attempts = config.Retry_max_attempts
+		}
+		if pc.Retry_backoff_ms <= 0 {
+			pc.Retry_backoff_ms = config.Retry_backoff_ms
+		}
+		if pc.Retry_max_backoff_ms <= 0 {
+			pc.Retry_max_backoff_ms = config.Retry_max_backoff_ms
+		}
+		if pc.Retry_jitter <= 0 {
+			pc.Retry_jitter = config.Retry_jitter
+		}
+		// a negative percentile disables hedging for a single cluster
+		if pc.Hedge_percentile == 0 {
+			pc.Hedge_percentile = config.Hedge_percentile
+		}
+		if pc.Hedge_min_delay_ms <= 0 {
+			pc.Hedge_min_delay_ms = config.Hedge_min_delay_ms
+		}
+		if pc.Hedge_budget <= 0 {
+			pc.Hedge_budget = config.Hedge_budget
+		}
+		if pc.Client_write_timeout == 0 {
+			pc.Client_write_timeout = config.Client_write_timeout
+		}
+		// a negative idle timeout or keepalive disables it for a single cluster
+		if pc.Client_idle_timeout == 0 {
+			pc.Client_idle_timeout = config.Client_idle_timeout
+		}
+		if pc.Tcp_keepalive == 0 {
+			pc.Tcp_keepalive = config.Tcp_keepalive
+		}
 		if pc.Server_retry_timeout <= 0 {
 			pc.Server_retry_timeout = config.Server_retry_timeout
 		}
 		if pc.Server_failure_limit <= 0 {
 			pc.Server_failure_limit = config.Server_failure_limit
 		}
+		switch pc.Read_preference {
+		case ReadPreferenceMaster, ReadPreferencePreferReplica, ReadPreferenceReplicaOnly, ReadPreferenceNearest:
+		case "":
+			pc.Read_preference = ReadPreferenceMaster
+		default:
+			log.Errorf("unknown read_preference %s of cluster %s, read from master", pc.Read_preference, pc.Cluster)
+			pc.Read_preference = ReadPreferenceMaster
+		}
+		if pc.Replica_max_lag <= 0 {
+			pc.Replica_max_lag = 10
+		}
+		if pc.Register_interval <= 0 {
+			pc.Register_interval = config.Register_interval
+		}
+		// a negative threshold disables the slowlog of a single cluster
+		if pc.Slowlog_threshold_ms == 0 {
+			pc.Slowlog_threshold_ms = config.Slowlog_threshold_ms
+		}
+		if pc.Slowlog_max_len <= 0 {
+			pc.Slowlog_max_len = config.Slowlog_max_len
+		}
+		if pc.Hotkey_top_k == 0 {
+			pc.Hotkey_top_k = config.Hotkey_top_k
+		}
+		if pc.Hotkey_window <= 0 {
+			pc.Hotkey_window = config.Hotkey_window
+		}
+		if pc.Hotkey_qps_threshold == 0 {
+			pc.Hotkey_qps_threshold = config.Hotkey_qps_threshold
+		}
+		if pc.Bigkey_bytes == 0 {
+			pc.Bigkey_bytes = config.Bigkey_bytes
+		}
+		if pc.Bigkey_elements == 0 {
+			pc.Bigkey_elements = config.Bigkey_elements
+		}
+		if pc.Reply_max_bytes == 0 {
+			pc.Reply_max_bytes = config.Reply_max_bytes
+		}
+		if pc.Reply_max_elements == 0 {
+			pc.Reply_max_elements = config.Reply_max_elements
+		}
+		if pc.Audit_args == "" {
+			pc.Audit_args = config.Audit_args
+		}
+		switch pc.Audit_args {
+		case AuditArgsNone, AuditArgsRedacted, AuditArgsFull:
+		default:
+			log.Errorf("unknown audit_args %s of cluster %s, args are redacted", pc.Audit_args, pc.Cluster)
+			pc.Audit_args = AuditArgsRedacted
+		}
+		if pc.Audit_max_size_mb <= 0 {
+			pc.Audit_max_size_mb = config.Audit_max_size_mb
+		}
+		if pc.Audit_max_backups <= 0 {
+			pc.Audit_max_backups = config.Audit_max_backups
+		}
+		if pc.Rate_limit_action == "" {
+			pc.Rate_limit_action = config.Rate_limit_action
+		}
+		switch pc.Rate_limit_action {
+		case RateLimitReject, RateLimitDelay:
+		default:
+			log.Errorf("unknown rate_limit_action %s of cluster %s, reject", pc.Rate_limit_action, pc.Cluster)
+			pc.Rate_limit_action = RateLimitReject
+		}
+		if pc.Rate_limit_delay_ms <= 0 {
+			pc.Rate_limit_delay_ms = config.Rate_limit_delay_ms
+		}
+		if pc.Rate_limit_error == "" {
+			pc.Rate_limit_error = config.Rate_limit_error
+		}
 		if (pc.Prefix != "") {
 			pc.PrefixBytes = []byte(pc.Prefix)
 		}
 		pc.Listen = strings.Replace(pc.Listen, "localhost", getOutboundIP(), 1)
 		pc.Listen = strings.Replace(pc.Listen, "127.0.0.1", getOutboundIP(), 1)
+		if pc.Advertise == "" {
+			pc.Advertise = pc.Listen
+		}
 	}
 	jsonResult, _ := json.Marshal(config)
 	log.Infof("config json:\n%v", string(jsonResult))
-	if err != nil {
-		log.Errorf("error: %v", err)
-		os.Exit(1)
-	}
-	return config
+	return config, nil
 }
 
 func getOutboundIP() string {
@@ -10,6 +10,20 @@ func (pe ProtocolError) Error() string {
 	return fmt.Sprintf("proxy: %s", string(pe))
 }
 
+// BackendDownError means no backend node was able to serve the command.
+type BackendDownError string
+
+func (be BackendDownError) Error() string {
+	return fmt.Sprintf("proxy: %s", string(be))
+}
+
+// RateLimitedError is sent as is to clients over their rate limit.
+type RateLimitedError string
+
+func (re RateLimitedError) Error() string {
+	return string(re)
+}
+
 type movedError struct {
 	Slot    int64
 	Address string
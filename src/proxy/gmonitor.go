@@ -1,99 +1,333 @@
 package proxy
 
 import (
-	"github.com/streamrail/concurrent-map"
-	log "github.com/cihub/seelog"
+	"math"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/samuel/go-zookeeper/zk"
 )
 
 type Monitor interface {
 	RecordOne(name string)
-	RecordOneAndRt(name string, rtMilliseconds int)
-	RecordManyAndRt(name string, count int, rtMilliseconds int)
+	RecordOneAndRt(name string, rt time.Duration)
+	RecordManyAndRt(name string, count int, rt time.Duration)
+	// RecordCommand records one proxied command, outcome is one of the Outcome* constants.
+	RecordCommand(cluster string, cmd string, outcome string, rt time.Duration, bytesIn int, bytesOut int)
+	RecordConnection(cluster string, delta int)
+	RecordNodeLatency(cluster string, node string, rt time.Duration)
+	RecordRedirect(cluster string, node string, redirect string)
+	// RecordRateLimit records a command delayed or rejected by a read or write rate limit.
+	RecordRateLimit(cluster string, scope string, kind string, action string)
+	// RecordBreakerState records a circuit breaker of a node changing state.
+	RecordBreakerState(cluster string, node string, state string)
+	// RecordZookeeperState records the zookeeper session changing state.
+	RecordZookeeperState(state zk.State)
+	// RecordRegistration records whether the registry node of cluster exists.
+	RecordRegistration(cluster string, registered bool)
+	QPS(name string) float32
 	Close()
 }
 
-var GMonitor = newMonitor()
+var GMonitor = newPrometheusMonitor(newMonitor())
+
+const monitorInterval = 10 * time.Second
+
+// keys idle for this many intervals are dropped
+const monitorIdleIntervals = 6
 
-var done chan bool
+const monitorShardCount = 32
 
 func newMonitor() Monitor {
-	done = startTicker(func() {
-		results := dumpAndClear()
-		for k, v := range results {
-			item := v.(*MonitorItem)
-			log.Infof("monitor item,key=%s,qps=%f,count=%d,rt=%d", k, computeQPS(item), item.TotalCount, item.TotalRt)
+	monitor := newShardedMonitor(monitorInterval)
+	monitor.start(func(snapshots map[string]*MonitorSnapshot) {
+		for k, snapshot := range snapshots {
+			log.Infof("monitor item,key=%s,qps=%.2f,count=%d,avgRt=%.3fms,p50=%.3fms,p90=%.3fms,p99=%.3fms,p999=%.3fms,max=%.3fms,bytesIn=%d,bytesOut=%d",
+				k, snapshot.Qps, snapshot.Count, snapshot.AvgRt, snapshot.P50, snapshot.P90, snapshot.P99, snapshot.P999, snapshot.Max, snapshot.BytesIn, snapshot.BytesOut)
 		}
 	})
-	return &MonitorItem{}
+	return monitor
+}
+
+// MonitorSnapshot is what happened to one key during one interval, times are
+// milliseconds with microsecond precision.
+type MonitorSnapshot struct {
+	Count int64   `json:"count"`
+	Qps   float32 `json:"qps"`
+	AvgRt float64 `json:"avg_rt"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	P999  float64 `json:"p999"`
+	Max   float64 `json:"max"`
+
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// monitorItem is updated with atomic operations only, so recording never
+// blocks on the ticker dumping it.
+type monitorItem struct {
+	count    int64
+	totalRt  int64
+	maxRt    int64
+	bytesIn  int64
+	bytesOut int64
+	// only touched by the ticker
+	idle      int32
+	histogram latencyHistogram
 }
 
-func computeQPS(item *MonitorItem) float32 {
-	if item.TotalRt > 0 {
-		return float32(item.TotalCount / item.TotalRt * 1000.0);
-	} else {
-		return -1.0
+// dropped items have their count set to this, writers racing with the drop
+// notice it and record into a fresh item.
+const monitorItemDropped = math.MinInt64 / 2
+
+func (item *monitorItem) record(count int64, rtMicros int64) bool {
+	if atomic.AddInt64(&item.count, count) < 0 {
+		return false
 	}
+	atomic.AddInt64(&item.totalRt, rtMicros*count)
+	for {
+		max := atomic.LoadInt64(&item.maxRt)
+		if rtMicros <= max || atomic.CompareAndSwapInt64(&item.maxRt, max, rtMicros) {
+			break
+		}
+	}
+	item.histogram.Record(rtMicros, count)
+	return true
 }
 
-var monitorItems = cmap.New()
+func (item *monitorItem) dumpAndClear(interval time.Duration) *MonitorSnapshot {
+	count := atomic.SwapInt64(&item.count, 0)
+	totalRt := atomic.SwapInt64(&item.totalRt, 0)
+	maxRt := atomic.SwapInt64(&item.maxRt, 0)
+	histogram := item.histogram.dumpAndClear()
+	snapshot := &MonitorSnapshot{
+		Count:    count,
+		Qps:      computeQPS(count, interval),
+		AvgRt:    -1,
+		Max:      micros2Millis(maxRt),
+		BytesIn:  atomic.SwapInt64(&item.bytesIn, 0),
+		BytesOut: atomic.SwapInt64(&item.bytesOut, 0),
+	}
+	if count > 0 {
+		snapshot.AvgRt = micros2Millis(totalRt) / float64(count)
+	}
+	percentile := func(q float64) float64 {
+		v := histogram.Percentile(q)
+		if v > maxRt {
+			v = maxRt
+		}
+		return micros2Millis(v)
+	}
+	snapshot.P50 = percentile(0.5)
+	snapshot.P90 = percentile(0.9)
+	snapshot.P99 = percentile(0.99)
+	snapshot.P999 = percentile(0.999)
+	return snapshot
+}
 
-type MonitorItem struct {
-	TotalCount int
-	TotalRt    int
+func computeQPS(count int64, interval time.Duration) float32 {
+	return float32(float64(count) / interval.Seconds())
 }
 
-func (monitorItem *MonitorItem) RecordOne(name string) {
-	monitorItem.RecordManyAndRt(name, 1, 0)
+func micros2Millis(micros int64) float64 {
+	return float64(micros) / 1000
 }
 
-func (monitorItem *MonitorItem) Close() {
-	done <- true
+// shardedMonitor spreads the keys over shards of sync.Map, recording into an
+// existing key takes no lock at all.
+type shardedMonitor struct {
+	interval time.Duration
+	shards   [monitorShardCount]sync.Map
+	// map[string]*MonitorSnapshot of the last finished interval
+	last      atomic.Value
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-func (monitorItem *MonitorItem) RecordManyAndRt(name string, count int, rt int) {
-	result, ok := monitorItems.Get(name)
-	if !ok {
-		result = &MonitorItem{}
-		monitorItems.Set(name, result)
+func newShardedMonitor(interval time.Duration) *shardedMonitor {
+	monitor := &shardedMonitor{
+		interval: interval,
+		done:     make(chan struct{}),
 	}
-	item := result.(*MonitorItem)
-	item.TotalCount++
-	item.TotalRt += rt
+	monitor.last.Store(map[string]*MonitorSnapshot{})
+	return monitor
 }
 
-func (monitorItem *MonitorItem) RecordOneAndRt(name string, rt int) {
-	monitorItem.RecordManyAndRt(name, 1, rt)
+func (monitor *shardedMonitor) shard(name string) *sync.Map {
+	// fnv-1a, inlined to keep recording free of allocations
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return &monitor.shards[h%monitorShardCount]
 }
 
-func dumpAndClear() map[string]interface{} {
-	result := monitorItems.Items()
-	for _, key := range monitorItems.Keys() {
-		result, _ := monitorItems.Get(key)
-		item := result.(*MonitorItem)
-		if item.TotalCount == 0 {
-			monitorItems.Remove(key)
-		} else {
-			monitorItems.Set(key, &MonitorItem{})
+func (monitor *shardedMonitor) item(name string) *monitorItem {
+	shard := monitor.shard(name)
+	if item, ok := shard.Load(name); ok {
+		return item.(*monitorItem)
+	}
+	item, _ := shard.LoadOrStore(name, &monitorItem{})
+	return item.(*monitorItem)
+}
+
+func (monitor *shardedMonitor) RecordOne(name string) {
+	monitor.RecordManyAndRt(name, 1, 0)
+}
+
+func (monitor *shardedMonitor) RecordOneAndRt(name string, rt time.Duration) {
+	monitor.RecordManyAndRt(name, 1, rt)
+}
+
+func (monitor *shardedMonitor) RecordManyAndRt(name string, count int, rt time.Duration) {
+	for {
+		if monitor.item(name).record(int64(count), int64(rt/time.Microsecond)) {
+			return
 		}
 	}
+}
+
+// RecordCommand records into the cluster key and the cluster.command.outcome key.
+func (monitor *shardedMonitor) RecordCommand(cluster string, cmd string, outcome string, rt time.Duration, bytesIn int, bytesOut int) {
+	monitor.RecordOneAndRt(cluster, rt)
+	for {
+		item := monitor.item(cluster + "." + cmd + "." + outcome)
+		if item.record(1, int64(rt/time.Microsecond)) {
+			atomic.AddInt64(&item.bytesIn, int64(bytesIn))
+			atomic.AddInt64(&item.bytesOut, int64(bytesOut))
+			return
+		}
+	}
+}
+
+func (monitor *shardedMonitor) RecordConnection(cluster string, delta int) {
+	if delta > 0 {
+		monitor.RecordOne(cluster + ".connection")
+	}
+}
+
+func (monitor *shardedMonitor) RecordNodeLatency(cluster string, node string, rt time.Duration) {
+	monitor.RecordOneAndRt(cluster+"."+node, rt)
+}
+
+func (monitor *shardedMonitor) RecordRedirect(cluster string, node string, redirect string) {
+	monitor.RecordOne(cluster + "." + node + "." + redirect)
+}
+
+func (monitor *shardedMonitor) RecordRateLimit(cluster string, scope string, kind string, action string) {
+	monitor.RecordOne(cluster + ".ratelimit." + scope + "." + kind + "." + action)
+}
+
+func (monitor *shardedMonitor) RecordBreakerState(cluster string, node string, state string) {
+	monitor.RecordOne(cluster + "." + node + ".breaker_" + state)
+}
+
+// RecordZookeeperState is a gauge of the prometheus monitor only, the
+// expirations are counted by the registrar.
+func (monitor *shardedMonitor) RecordZookeeperState(state zk.State) {}
+
+// RecordRegistration is a gauge of the prometheus monitor only, the
+// registrations are counted by the registrar.
+func (monitor *shardedMonitor) RecordRegistration(cluster string, registered bool) {}
+
+func (monitor *shardedMonitor) QPS(name string) float32 {
+	if snapshot, ok := monitor.Snapshots()[name]; ok {
+		return snapshot.Qps
+	}
+	return 0
+}
+
+// Snapshots returns the keys recorded during the last finished interval.
+func (monitor *shardedMonitor) Snapshots() map[string]*MonitorSnapshot {
+	return monitor.last.Load().(map[string]*MonitorSnapshot)
+}
+
+func (monitor *shardedMonitor) Close() {
+	monitor.closeOnce.Do(func() {
+		close(monitor.done)
+	})
+}
+
+// dumpAndClear snapshots and resets every key, keys idle for a while are dropped.
+func (monitor *shardedMonitor) dumpAndClear() map[string]*MonitorSnapshot {
+	result := make(map[string]*MonitorSnapshot)
+	for i := range monitor.shards {
+		shard := &monitor.shards[i]
+		shard.Range(func(key, value interface{}) bool {
+			item := value.(*monitorItem)
+			snapshot := item.dumpAndClear(monitor.interval)
+			if snapshot.Count > 0 {
+				item.idle = 0
+				result[key.(string)] = snapshot
+			} else {
+				item.idle++
+				if item.idle >= monitorIdleIntervals && atomic.CompareAndSwapInt64(&item.count, 0, monitorItemDropped) {
+					shard.Delete(key)
+				}
+			}
+			return true
+		})
+	}
+	monitor.last.Store(result)
 	return result
 }
 
-func startTicker(f func()) chan bool {
-	done := make(chan bool, 1)
+func (monitor *shardedMonitor) start(f func(snapshots map[string]*MonitorSnapshot)) {
 	go func() {
-		ticker := time.NewTicker(time.Second * 10)
+		ticker := time.NewTicker(monitor.interval)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				f()
-			case <-done:
+				f(monitor.dumpAndClear())
+			case <-monitor.done:
 				log.Info("GMonitor log closed")
 				return
 			}
 		}
 	}()
-	return done
+}
+
+// monitorOtherCommand replaces command names beyond the monitor command limit.
+const monitorOtherCommand = "OTHER"
+
+var monitorCommands = &commandNames{limit: 256}
+
+// SetMonitorMaxCommands caps the number of distinct command names used as
+// monitor keys, so clients sending garbage can not blow up the key space.
+func SetMonitorMaxCommands(limit int) {
+	if limit > 0 {
+		atomic.StoreInt64(&monitorCommands.limit, int64(limit))
+	}
+}
+
+// monitorCommandName returns cmd if it is one of the first limit command
+// names seen, monitorOtherCommand otherwise.
+func monitorCommandName(cmd string) string {
+	return monitorCommands.name(cmd)
+}
+
+type commandNames struct {
+	limit int64
+	count int64
+	seen  sync.Map
+}
+
+func (names *commandNames) name(cmd string) string {
+	if _, ok := names.seen.Load(cmd); ok {
+		return cmd
+	}
+	if atomic.AddInt64(&names.count, 1) > atomic.LoadInt64(&names.limit) {
+		atomic.AddInt64(&names.count, -1)
+		return monitorOtherCommand
+	}
+	if _, loaded := names.seen.LoadOrStore(cmd, true); loaded {
+		atomic.AddInt64(&names.count, -1)
+	}
+	return cmd
 }
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"cluster"
+	log "github.com/cihub/seelog"
+)
+
+// set once the proxy started draining, it never becomes ready again
+var draining int32
+
+var drainTimeout = 10 * time.Second
+
+// names of the configured clusters, readiness requires all of them
+var configuredClusters []string
+
+var signalOnce sync.Once
+
+// InitHealth must be called before the clusters are started.
+func InitHealth(config *ProxyConfig) {
+	if config.Drain_timeout > 0 {
+		drainTimeout = time.Duration(config.Drain_timeout) * time.Second
+	}
+	for _, pc := range config.Proxy_clusters {
+		configuredClusters = append(configuredClusters, pc.Cluster)
+	}
+}
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// ReadinessStatus is the answer of /readyz, reasons lists everything not ready.
+type ReadinessStatus struct {
+	Ready    bool     `json:"ready"`
+	Draining bool     `json:"draining"`
+	Reasons  []string `json:"reasons"`
+}
+
+// readiness checks that every cluster in clusters has a bound listener, a
+// cluster client, a full slot map and a reachable master for every slot range.
+func readiness(clusters []string) ReadinessStatus {
+	status := ReadinessStatus{Draining: isDraining(), Reasons: []string{}}
+	if status.Draining {
+		status.Reasons = append(status.Reasons, "draining")
+	}
+	for _, cluster := range clusters {
+		cp := getClusterProxy(cluster)
+		if cp == nil || cp.listener == nil {
+			status.Reasons = append(status.Reasons, cluster+": listener not bound")
+			continue
+		}
+		status.Reasons = append(status.Reasons, cp.notReady()...)
+	}
+	status.Ready = len(status.Reasons) == 0
+	return status
+}
+
+func (cp *clusterProxy) notReady() []string {
+	name := cp.config.Cluster
+	redisCluster := cp.backend.client()
+	if redisCluster == nil {
+		return []string{name + ": no redis cluster client"}
+	}
+	slots := append([]cluster.SlotRange{}, redisCluster.SlotRanges()...)
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Start < slots[j].Start })
+	var reasons []string
+	next := 0
+	for _, slotRange := range slots {
+		if slotRange.Start > next {
+			break
+		}
+		next = slotRange.End + 1
+		if !cp.backend.masterReachable(slotRange.Master) {
+			reasons = append(reasons, name+": master "+slotRange.Master+" of slots "+
+				strconv.Itoa(slotRange.Start)+"-"+strconv.Itoa(slotRange.End)+" unreachable")
+		}
+	}
+	if next < slotCount {
+		reasons = append(reasons, name+": slot "+strconv.Itoa(next)+" not covered by the slot map")
+	}
+	return reasons
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, map[string]interface{}{"alive": true})
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := readiness(configuredClusters)
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJson(w, status)
+}
+
+// pingStatus answers PING HEALTHZ and PING READYZ with the status of the http
+// endpoints, any other PING is answered with PONG.
+func pingStatus(args []interface{}) (interface{}, error) {
+	if len(args) == 1 {
+		switch string(args[0].([]byte)) {
+		case "HEALTHZ", "healthz":
+			return "OK", nil
+		case "READYZ", "readyz":
+			status := readiness(configuredClusters)
+			if !status.Ready {
+				return nil, ProtocolError("not ready " + status.Reasons[0])
+			}
+			return "READY", nil
+		}
+	}
+	return "PONG", nil
+}
+
+// signalNotify drains the proxy on SIGINT or SIGTERM: it turns not ready,
+// leaves the registry, stops accepting, closes the client connections between
+// two commands and waits up to drainTimeout for them. It exits 0 if every
+// connection was closed in time, 1 otherwise.
+func signalNotify(registry Registry) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, os.Kill)
+	go func() {
+		sig := <-c
+		log.Infof("Got A %v Signal! ", sig.String())
+		clean := drain(registry)
+		log.Flush()
+		if clean {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}()
+}
+
+// drain returns false if connections were still open after drainTimeout.
+func drain(registry Registry) bool {
+	atomic.StoreInt32(&draining, 1)
+	registry.Close()
+	cps := allClusterProxies()
+	for _, cp := range cps {
+		if cp.listener != nil {
+			cp.listener.Close()
+		}
+	}
+	clean := drainSessions(cps, drainTimeout)
+	for _, cp := range cps {
+		cp.backend.Close()
+		cp.audit.Close()
+	}
+	stopTracing()
+	GMonitor.Close()
+	return clean
+}
+
+// drainSessions closes the sessions of cps as soon as they are idle and
+// returns true once all of their connections are closed, false if some are
+// still open after timeout.
+func drainSessions(cps []*clusterProxy, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		var connections int64
+		for _, cp := range cps {
+			cp.closeIdleSessions()
+			connections += atomic.LoadInt64(&cp.config.connections)
+		}
+		if connections == 0 {
+			log.Infof("drained")
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			log.Warnf("drain timeout,connections=%d", connections)
+			return false
+		}
+		log.Infof("draining,connections=%d", connections)
+		time.Sleep(100 * time.Millisecond)
+	}
+}
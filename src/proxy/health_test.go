@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Readiness(t *testing.T) {
+	// the slots 8192-16383 are served by a master the proxy never reaches
+	down := "127.0.0.1:1"
+	var partial int32
+	var self atomic.Value
+	up := startFakeRedis(t, func(cmd string, asking bool) string {
+		reply := "*1\r\n" + slotRangeReply(0, 8191, self.Load().(string))
+		if atomic.LoadInt32(&partial) == 0 {
+			reply = "*2\r\n" + slotRangeReply(0, 8191, self.Load().(string)) + slotRangeReply(8192, 16383, down)
+		}
+		return reply
+	})
+	self.Store(up)
+	proxyCluster := newTestProxyCluster("ready_cluster")
+	proxyCluster.Slowlog_max_len = 8
+	proxyCluster.Server_failure_limit = 1
+	proxyCluster.Server_retry_timeout = 60000
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if status := readiness([]string{"ready_cluster"}); status.Ready {
+		t.Fatal("cluster not started yet is ready")
+	}
+	// without a replica router, reachability comes from the circuit breakers
+	b := &backend{proxyCluster: proxyCluster, breakers: newNodeBreakers(proxyCluster)}
+	if err := b.Refresh([]string{up}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Close)
+	newClusterProxy(proxyCluster, ln, b)
+	if status := readiness([]string{"ready_cluster"}); !status.Ready {
+		t.Fatalf("cluster not ready,%v", status.Reasons)
+	}
+
+	b.breakers.Record(down, BackendDownError("connection refused"))
+	status := readiness([]string{"ready_cluster"})
+	if status.Ready || len(status.Reasons) != 1 || !strings.Contains(status.Reasons[0], "8192-16383") {
+		t.Errorf("unreachable master not reported,%v", status.Reasons)
+	}
+	// the pings of the replica router win over the breakers
+	b.replicas = &replicaRouter{nodes: map[string]*replicaNode{down: {addr: down, latency: 1000}}, done: make(chan struct{})}
+	if status := readiness([]string{"ready_cluster"}); !status.Ready {
+		t.Errorf("master answering pings not ready,%v", status.Reasons)
+	}
+
+	atomic.StoreInt32(&partial, 1)
+	if err := b.client().Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if status := readiness([]string{"ready_cluster"}); status.Ready || !strings.Contains(status.Reasons[0], "slot 8192") {
+		t.Errorf("ready with an incomplete slot map,%v", status.Reasons)
+	}
+
+	atomic.StoreInt32(&draining, 1)
+	defer atomic.StoreInt32(&draining, 0)
+	if status := readiness([]string{"ready_cluster"}); status.Ready || !status.Draining {
+		t.Error("ready while draining")
+	}
+	if _, err := pingStatus([]interface{}{[]byte("READYZ")}); err == nil {
+		t.Error("PING READYZ succeeded while draining")
+	}
+	if reply, _ := pingStatus([]interface{}{[]byte("HEALTHZ")}); reply != "OK" {
+		t.Errorf("PING HEALTHZ=%v", reply)
+	}
+}
+
+func Test_DrainSessions(t *testing.T) {
+	cp := newTestAdminCluster("drain_cluster")
+	cp.config.Client_connections = 2
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		serveConn(cp, server)
+		clients = append(clients, client)
+	}
+	waitFor(t, time.Second, func() bool { return len(cp.Sessions()) == 2 })
+
+	// a session stuck in a command keeps the drain waiting
+	var busy *sessionInfo
+	cp.sessions.Range(func(key, value interface{}) bool {
+		busy = value.(*sessionInfo)
+		return false
+	})
+	atomic.StoreInt32(&busy.state, sessionBusy)
+	atomic.StoreInt32(&draining, 1)
+	defer atomic.StoreInt32(&draining, 0)
+	if drainSessions([]*clusterProxy{cp}, 200*time.Millisecond) {
+		t.Fatal("drained with a busy session")
+	}
+	if n := atomic.LoadInt64(&cp.config.connections); n != 1 {
+		t.Fatalf("%d connections left, want the busy one", n)
+	}
+
+	atomic.StoreInt32(&busy.state, sessionIdle)
+	if !drainSessions([]*clusterProxy{cp}, time.Second) {
+		t.Fatalf("%d connections left after the drain", atomic.LoadInt64(&cp.config.connections))
+	}
+	for _, client := range clients {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("session not closed,%v", err)
+		}
+	}
+}
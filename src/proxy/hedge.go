@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cluster"
+)
+
+const (
+	// the hedge delay is recomputed from the read latencies of every period
+	hedgePeriod = time.Second
+	// periods with fewer reads keep the previous delay
+	hedgeMinSamples = 100
+	// hedges the budget can save up, in thousandths of a hedge
+	hedgeMaxCredits = 10 * 1000
+)
+
+// hedger duplicates slow reads of a cluster reading from masters to a replica
+// of the same slot, the first reply wins.
+type hedger struct {
+	cluster    string
+	percentile float64
+	minDelay   time.Duration
+	// thousandths of a hedge earned by every read
+	creditPerRead int64
+
+	// read latencies of the current period in microseconds
+	latencies latencyHistogram
+	// atomic, nanoseconds, 0 until the first period with enough reads
+	delay int64
+	// atomic, thousandths of a hedge
+	credits int64
+
+	done chan struct{}
+}
+
+// newHedger returns nil if hedge_percentile is not set or the cluster reads
+// from replicas, reads are spread over the replicas then.
+func newHedger(proxyCluster *ProxyClusterConfig) *hedger {
+	if proxyCluster.Hedge_percentile <= 0 || proxyCluster.Read_preference != ReadPreferenceMaster {
+		return nil
+	}
+	h := &hedger{
+		cluster:       proxyCluster.Cluster,
+		percentile:    proxyCluster.Hedge_percentile / 100,
+		minDelay:      time.Duration(proxyCluster.Hedge_min_delay_ms) * time.Millisecond,
+		creditPerRead: int64(proxyCluster.Hedge_budget * 10),
+		done:          make(chan struct{}),
+	}
+	go h.updateLoop()
+	return h
+}
+
+type hedgeResult struct {
+	reply interface{}
+	err   error
+	node  string
+}
+
+// hedgeCall is the state of one read that may be hedged, it goes back to
+// hedgeCalls once the read and both calls are done.
+type hedgeCall struct {
+	results chan hedgeResult
+	timer   *time.Timer
+	// the request of the primary call
+	req proxyRequest
+	// atomic, the calls running plus Do
+	refs int32
+}
+
+var hedgeCalls = sync.Pool{New: func() interface{} {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return &hedgeCall{results: make(chan hedgeResult, 2), timer: timer}
+}}
+
+func (call *hedgeCall) runPrimary(h *hedger, primary func(req *proxyRequest) (interface{}, error)) {
+	reply, err := h.timed(&call.req, primary)
+	call.results <- hedgeResult{reply, err, call.req.node}
+	call.release()
+}
+
+func (call *hedgeCall) runHedge(router *replicaRouter, node *replicaNode, cmd string, args []interface{}) {
+	reply, err := node.pool.DoStream(router.timeouts[cmd], cmd, args...)
+	router.breakers.Record(node.addr, err)
+	call.results <- hedgeResult{reply, err, node.addr}
+	call.release()
+}
+
+func (call *hedgeCall) stopTimer() {
+	if !call.timer.Stop() {
+		select {
+		case <-call.timer.C:
+		default:
+		}
+	}
+}
+
+// release puts call back once nothing uses it anymore, a losing result
+// nobody read is released, a streamed one holds a backend connection.
+func (call *hedgeCall) release() {
+	if atomic.AddInt32(&call.refs, -1) > 0 {
+		return
+	}
+	for len(call.results) > 0 {
+		r := <-call.results
+		cluster.Release(r.reply)
+	}
+	call.req = proxyRequest{}
+	hedgeCalls.Put(call)
+}
+
+// failed tells whether the other reply is worth waiting for.
+func (r hedgeResult) failed() bool {
+	if r.err != nil {
+		return true
+	}
+	redisErr, ok := cluster.ReplyError(r.reply)
+	return ok && isRedirect(redisErr)
+}
+
+// Do runs the read only req through primary, a duplicate goes to a replica
+// once primary takes longer than the hedge delay and the budget allows it.
+func (h *hedger) Do(req *proxyRequest, primary func(req *proxyRequest) (interface{}, error), router *replicaRouter) (interface{}, error) {
+	h.earn()
+	delay := time.Duration(atomic.LoadInt64(&h.delay))
+	slot, ok := commandSlot(req.cmd, req.args)
+	if delay <= 0 || !ok {
+		return h.timed(req, primary)
+	}
+
+	call := hedgeCalls.Get().(*hedgeCall)
+	call.req = *req
+	call.refs = 2
+	go call.runPrimary(h, primary)
+	call.timer.Reset(delay)
+	select {
+	case r := <-call.results:
+		call.stopTimer()
+		call.release()
+		req.node = r.node
+		return r.reply, r.err
+	case <-call.timer.C:
+	}
+
+	node := router.hedgeReplica(slot)
+	if node == nil || !h.spend() {
+		r := <-call.results
+		call.release()
+		req.node = r.node
+		return r.reply, r.err
+	}
+	// the losing call may still run when req is returned, the session must
+	// not reuse the buffer req.args point into
+	if req.keepArgs != nil {
+		req.keepArgs()
+	}
+	GMonitor.RecordOne(h.cluster + ".hedge")
+	atomic.AddInt32(&call.refs, 1)
+	go call.runHedge(router, node, req.cmd, req.args)
+	r := <-call.results
+	if r.failed() {
+		cluster.Release(r.reply)
+		r = <-call.results
+	}
+	call.release()
+	if r.node == node.addr {
+		GMonitor.RecordOne(h.cluster + ".hedge_won")
+	}
+	req.node = r.node
+	return r.reply, r.err
+}
+
+func (h *hedger) timed(req *proxyRequest, primary func(req *proxyRequest) (interface{}, error)) (interface{}, error) {
+	begin := time.Now()
+	reply, err := primary(req)
+	h.latencies.Record(int64(time.Since(begin)/time.Microsecond), 1)
+	return reply, err
+}
+
+func (h *hedger) earn() {
+	if atomic.AddInt64(&h.credits, h.creditPerRead) > hedgeMaxCredits {
+		atomic.StoreInt64(&h.credits, hedgeMaxCredits)
+	}
+}
+
+// spend takes a hedge from the budget.
+func (h *hedger) spend() bool {
+	if atomic.AddInt64(&h.credits, -1000) < 0 {
+		atomic.AddInt64(&h.credits, 1000)
+		GMonitor.RecordOne(h.cluster + ".hedge_budget_exhausted")
+		return false
+	}
+	return true
+}
+
+// update sets the delay to the hedge_percentile latency of the last period.
+func (h *hedger) update() {
+	snapshot := h.latencies.dumpAndClear()
+	if snapshot.total < hedgeMinSamples {
+		return
+	}
+	delay := time.Duration(snapshot.Percentile(h.percentile)) * time.Microsecond
+	if delay < h.minDelay {
+		delay = h.minDelay
+	}
+	atomic.StoreInt64(&h.delay, int64(delay))
+}
+
+func (h *hedger) updateLoop() {
+	ticker := time.NewTicker(hedgePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.update()
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *hedger) Close() {
+	if h != nil {
+		close(h.done)
+	}
+}
+
+// hedgeReplica returns a fresh replica of slot to send a hedged read to, nil
+// if there is none.
+func (router *replicaRouter) hedgeReplica(slot int) *replicaNode {
+	router.mu.RLock()
+	defer router.mu.RUnlock()
+	slotRange, ok := router.findSlot(slot)
+	if !ok {
+		return nil
+	}
+	maxLag := int64(router.proxyCluster.Replica_max_lag)
+	candidates := make([]*replicaNode, 0, len(slotRange.replicas))
+	for _, addr := range slotRange.replicas {
+		node := router.nodes[addr]
+		lag := atomic.LoadInt64(&node.lag)
+		if node.pool != nil && lag >= 0 && lag <= maxLag && atomic.LoadInt64(&node.latency) > 0 && router.breakers.Allow(addr) == nil {
+			candidates = append(candidates, node)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
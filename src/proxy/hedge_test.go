@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cluster"
+)
+
+// startFakeRedis serves every command with the raw RESP reply of handle,
+// asking tells whether ASKING came right before. READONLY and ASKING get +OK.
+func startFakeRedis(t *testing.T, handle func(cmd string, asking bool) string) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				session := NewSession(conn, -1, -1)
+				asking := false
+				for {
+					request, err := session.ParseRequest()
+					if err != nil {
+						return
+					}
+					switch cmd := string(request[0].([]byte)); cmd {
+					case "READONLY", "ASKING":
+						conn.Write([]byte("+OK\r\n"))
+						asking = cmd == "ASKING"
+					default:
+						conn.Write([]byte(handle(cmd, asking)))
+						asking = false
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func newTestHedger(t *testing.T) (*hedger, *replicaRouter, string) {
+	proxyCluster := newTestProxyCluster("hedge_cluster")
+	proxyCluster.Read_preference = ReadPreferenceMaster
+	proxyCluster.Hedge_percentile = 99
+	proxyCluster.Hedge_budget = 100
+	h := newHedger(proxyCluster)
+	t.Cleanup(h.Close)
+	atomic.StoreInt64(&h.delay, int64(10*time.Millisecond))
+
+	replica := startFakeRedis(t, func(string, bool) string { return "$5\r\nhedge\r\n" })
+	router := newTestReplicaRouter(ReadPreferenceMaster)
+	router.nodes[replica] = &replicaNode{addr: replica, latency: 1000, lag: 0,
+		pool: cluster.NewPool(replica, 1, time.Second, time.Second, time.Second, "READONLY")}
+	router.slots[0].replicas = []string{replica}
+	return h, router, replica
+}
+
+func slowPrimary(delay time.Duration) func(req *proxyRequest) (interface{}, error) {
+	return func(req *proxyRequest) (interface{}, error) {
+		time.Sleep(delay)
+		req.node = "m1:7000"
+		return cluster.Raw("$7\r\nprimary\r\n"), nil
+	}
+}
+
+func Test_HedgedRead(t *testing.T) {
+	h, router, replica := newTestHedger(t)
+	// served by m1:7000 and the fake replica
+	key := "item_1"
+	if cluster.Slot([]byte(key)) > 8191 {
+		t.Fatalf("key %s is not in the first slot range", key)
+	}
+
+	kept := 0
+	req := slowRequest("GET", 0, key)
+	req.keepArgs = func() { kept++ }
+	start := time.Now()
+	reply, err := h.Do(req, slowPrimary(300*time.Millisecond), router)
+	if err != nil || string(reply.(cluster.Raw)) != "$5\r\nhedge\r\n" || req.node != replica {
+		t.Fatalf("hedged read returned %q,%v from %s", reply, err, req.node)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("hedged read took %v", elapsed)
+	}
+	if kept != 1 {
+		t.Errorf("hedged read kept its arguments %d times", kept)
+	}
+
+	req = slowRequest("GET", 0, key)
+	req.keepArgs = func() { kept++ }
+	reply, err = h.Do(req, slowPrimary(0), router)
+	if err != nil || string(reply.(cluster.Raw)) != "$7\r\nprimary\r\n" || req.node != "m1:7000" {
+		t.Errorf("fast read returned %q,%v from %s", reply, err, req.node)
+	}
+	if kept != 1 {
+		t.Error("fast read kept its arguments")
+	}
+
+	// the budget is spent, slow reads wait for the primary
+	atomic.StoreInt64(&h.credits, 0)
+	h.creditPerRead = 0
+	req = slowRequest("GET", 0, key)
+	reply, err = h.Do(req, slowPrimary(30*time.Millisecond), router)
+	if err != nil || string(reply.(cluster.Raw)) != "$7\r\nprimary\r\n" {
+		t.Errorf("read over budget returned %q,%v", reply, err)
+	}
+}
+
+func Test_HedgerDelay(t *testing.T) {
+	proxyCluster := newTestProxyCluster("hedge_cluster")
+	proxyCluster.Read_preference = ReadPreferenceMaster
+	proxyCluster.Hedge_percentile = 90
+	proxyCluster.Hedge_min_delay_ms = 1
+	h := newHedger(proxyCluster)
+	defer h.Close()
+
+	for i := 0; i < hedgeMinSamples-1; i++ {
+		h.latencies.Record(5000, 1)
+	}
+	h.update()
+	if h.delay != 0 {
+		t.Errorf("delay set from %d samples", hedgeMinSamples-1)
+	}
+	for i := 0; i < 90; i++ {
+		h.latencies.Record(100, 1)
+	}
+	h.latencies.Record(20000, 10)
+	h.update()
+	if delay := time.Duration(h.delay); delay != time.Millisecond {
+		t.Errorf("delay %v, want the 1ms floor over the 90th percentile", delay)
+	}
+
+	proxyCluster.Read_preference = ReadPreferencePreferReplica
+	if newHedger(proxyCluster) != nil {
+		t.Error("reads from replicas are hedged")
+	}
+}
+
+func BenchmarkHedgerFastRead(b *testing.B) {
+	proxyCluster := newTestProxyCluster("hedge_bench_cluster")
+	proxyCluster.Read_preference = ReadPreferenceMaster
+	proxyCluster.Hedge_percentile = 99
+	h := newHedger(proxyCluster)
+	defer h.Close()
+	atomic.StoreInt64(&h.delay, int64(time.Second))
+	router := newTestReplicaRouter(ReadPreferenceMaster)
+	req := slowRequest("GET", 0, "item_1")
+	reply := cluster.Raw("$7\r\nprimary\r\n")
+	primary := func(req *proxyRequest) (interface{}, error) { return reply, nil }
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.Do(req, primary, router)
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+const (
+	histogramSubBits    = 4
+	histogramSubBuckets = 1 << histogramSubBits
+	// ~71 minutes, larger values are recorded as this one
+	histogramMaxValue = 1<<32 - 1
+	histogramBuckets  = (32-histogramSubBits)*histogramSubBuckets + histogramSubBuckets
+)
+
+// latencyHistogram is a log-linear histogram of microseconds in the spirit of
+// HdrHistogram, every power of two is split into 16 buckets so a recorded
+// value is off by less than 1/16. All operations are atomic.
+type latencyHistogram struct {
+	buckets [histogramBuckets]int64
+}
+
+func histogramIndex(v int64) int {
+	if v < histogramSubBuckets {
+		if v < 0 {
+			return 0
+		}
+		return int(v)
+	}
+	if v > histogramMaxValue {
+		v = histogramMaxValue
+	}
+	shift := bits.Len64(uint64(v)) - histogramSubBits - 1
+	return (shift+1)*histogramSubBuckets + int(v>>uint(shift)) - histogramSubBuckets
+}
+
+// histogramUpperBound is the highest value recorded into bucket idx.
+func histogramUpperBound(idx int) int64 {
+	if idx < histogramSubBuckets {
+		return int64(idx)
+	}
+	shift := uint(idx/histogramSubBuckets - 1)
+	mantissa := int64(idx%histogramSubBuckets + histogramSubBuckets)
+	return (mantissa+1)<<shift - 1
+}
+
+func (h *latencyHistogram) Record(v int64, count int64) {
+	atomic.AddInt64(&h.buckets[histogramIndex(v)], count)
+}
+
+// dumpAndClear moves the counts into a plain snapshot and resets the histogram.
+func (h *latencyHistogram) dumpAndClear() *histogramSnapshot {
+	snapshot := &histogramSnapshot{}
+	for i := range h.buckets {
+		if atomic.LoadInt64(&h.buckets[i]) == 0 {
+			continue
+		}
+		count := atomic.SwapInt64(&h.buckets[i], 0)
+		snapshot.buckets[i] = count
+		snapshot.total += count
+	}
+	return snapshot
+}
+
+type histogramSnapshot struct {
+	buckets [histogramBuckets]int64
+	total   int64
+}
+
+// Percentile returns the value below which q (0..1) of the recorded values fall.
+func (s *histogramSnapshot) Percentile(q float64) int64 {
+	if s.total == 0 {
+		return 0
+	}
+	target := int64(q*float64(s.total) + 0.5)
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	for i, count := range s.buckets {
+		seen += count
+		if seen >= target {
+			return histogramUpperBound(i)
+		}
+	}
+	return histogramMaxValue
+}
@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+
+	"cluster"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	sketchDepth = 4
+	// counters per row of the sketch of a shard
+	sketchWidth = 512
+	// keys are spread by hash over shards locked independently of each other
+	hotKeyShards = 8
+	// a window is made of this many buckets, the oldest one is dropped on every rotation
+	hotKeyBuckets = 6
+)
+
+// countMinSketch estimates key counts in fixed memory, estimates are never
+// below the real count.
+type countMinSketch struct {
+	counts [sketchDepth][sketchWidth]uint32
+}
+
+func sketchHashes(key []byte) (uint32, uint32) {
+	// fnv-1a, the second hash is derived from the first one
+	h := uint64(14695981039346656037)
+	for _, b := range key {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	return uint32(h), uint32(h>>32) | 1
+}
+
+// add counts the key hashed to h1, h2 once and returns its estimate.
+func (sketch *countMinSketch) add(h1, h2 uint32) uint32 {
+	min := ^uint32(0)
+	for i := 0; i < sketchDepth; i++ {
+		idx := (h1 + uint32(i)*h2) % sketchWidth
+		sketch.counts[i][idx]++
+		if sketch.counts[i][idx] < min {
+			min = sketch.counts[i][idx]
+		}
+	}
+	return min
+}
+
+func (sketch *countMinSketch) estimate(h1, h2 uint32) uint32 {
+	min := ^uint32(0)
+	for i := 0; i < sketchDepth; i++ {
+		if c := sketch.counts[i][(h1+uint32(i)*h2)%sketchWidth]; c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+type topKEntry struct {
+	key   string
+	count uint32
+	index int
+}
+
+// topK is a min heap of the k keys with the highest estimates.
+type topK struct {
+	k       int
+	entries []*topKEntry
+	keys    map[string]*topKEntry
+}
+
+func newTopK(k int) *topK {
+	return &topK{k: k, keys: make(map[string]*topKEntry, k)}
+}
+
+func (t *topK) Len() int           { return len(t.entries) }
+func (t *topK) Less(i, j int) bool { return t.entries[i].count < t.entries[j].count }
+func (t *topK) Swap(i, j int) {
+	t.entries[i], t.entries[j] = t.entries[j], t.entries[i]
+	t.entries[i].index = i
+	t.entries[j].index = j
+}
+func (t *topK) Push(x interface{}) {
+	entry := x.(*topKEntry)
+	entry.index = len(t.entries)
+	t.entries = append(t.entries, entry)
+}
+func (t *topK) Pop() interface{} {
+	entry := t.entries[len(t.entries)-1]
+	t.entries = t.entries[:len(t.entries)-1]
+	return entry
+}
+
+// offer updates key with its new estimate, the key string is only allocated
+// when key enters the heap.
+func (t *topK) offer(key []byte, count uint32) {
+	if entry, ok := t.keys[string(key)]; ok {
+		entry.count = count
+		heap.Fix(t, entry.index)
+		return
+	}
+	if len(t.entries) < t.k {
+		entry := &topKEntry{key: string(key), count: count}
+		t.keys[entry.key] = entry
+		heap.Push(t, entry)
+		return
+	}
+	if min := t.entries[0]; count > min.count {
+		delete(t.keys, min.key)
+		min.key = string(key)
+		min.count = count
+		t.keys[min.key] = min
+		heap.Fix(t, 0)
+	}
+}
+
+type hotKeyBucket struct {
+	sketch  countMinSketch
+	top     *topK
+	alerted map[string]bool
+}
+
+// HotKey is a key of the hot key report, qps is averaged over the window.
+type HotKey struct {
+	Key   string  `json:"key"`
+	Slot  int     `json:"slot"`
+	Count int64   `json:"count"`
+	Qps   float64 `json:"qps"`
+}
+
+// hotKeyShard holds the buckets of the keys hashed to it, a key is counted
+// in a single shard so its estimate never needs the others.
+type hotKeyShard struct {
+	mu      sync.Mutex
+	buckets []*hotKeyBucket
+}
+
+// hotKeys tracks the hottest keys of a cluster over a sliding window.
+type hotKeys struct {
+	cluster      string
+	k            int
+	bucketPeriod time.Duration
+	// keys above this qps within a bucket are logged, 0 disables it
+	qpsThreshold int
+
+	shards [hotKeyShards]hotKeyShard
+
+	mu sync.Mutex
+	// buckets per shard and start of the current one
+	buckets     int
+	bucketStart time.Time
+
+	done chan struct{}
+}
+
+// newHotKeys returns nil if hot key detection is disabled for the cluster.
+func newHotKeys(proxyCluster *ProxyClusterConfig) *hotKeys {
+	if proxyCluster.Hotkey_top_k <= 0 {
+		return nil
+	}
+	window := time.Duration(proxyCluster.Hotkey_window) * time.Second
+	if window <= 0 {
+		window = time.Minute
+	}
+	hk := &hotKeys{
+		cluster:      proxyCluster.Cluster,
+		k:            proxyCluster.Hotkey_top_k,
+		bucketPeriod: window / hotKeyBuckets,
+		qpsThreshold: proxyCluster.Hotkey_qps_threshold,
+		done:         make(chan struct{}),
+	}
+	hk.rotate(time.Now())
+	go hk.rotateLoop()
+	return hk
+}
+
+// Record counts one access to key, nil hotKeys record nothing.
+func (hk *hotKeys) Record(key []byte) {
+	if hk == nil {
+		return
+	}
+	h1, h2 := sketchHashes(key)
+	// the low bits of h1 and h2 pick the counters, the shard comes from others
+	shard := &hk.shards[(h2>>16)%hotKeyShards]
+	shard.mu.Lock()
+	bucket := shard.buckets[len(shard.buckets)-1]
+	count := bucket.sketch.add(h1, h2)
+	bucket.top.offer(key, count)
+	alert := hk.qpsThreshold > 0 && float64(count) > float64(hk.qpsThreshold)*hk.bucketPeriod.Seconds() && !bucket.alerted[string(key)]
+	if alert {
+		bucket.alerted[string(key)] = true
+	}
+	shard.mu.Unlock()
+	if alert {
+		log.Warnf("hot key,cluster=%s,key=%q,slot=%d,count=%d,period=%v", hk.cluster, key, cluster.Slot(key), count, hk.bucketPeriod)
+		GMonitor.RecordOne(hk.cluster + ".hotkey")
+	}
+}
+
+// Top returns the n hottest keys of the window, the hottest first.
+func (hk *hotKeys) Top(n int) []HotKey {
+	hk.mu.Lock()
+	window := hk.bucketPeriod*time.Duration(hk.buckets-1) + time.Since(hk.bucketStart)
+	hk.mu.Unlock()
+	result := make([]HotKey, 0)
+	for i := range hk.shards {
+		result = append(result, hk.shards[i].top(window)...)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Count > result[j].Count })
+	if n < 0 || n > hk.k {
+		n = hk.k
+	}
+	if n < len(result) {
+		result = result[:n]
+	}
+	return result
+}
+
+// top returns the keys of the top-K of every bucket of the shard counted over
+// the whole window.
+func (shard *hotKeyShard) top(window time.Duration) []HotKey {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	seen := make(map[string]bool)
+	var result []HotKey
+	for _, bucket := range shard.buckets {
+		for _, entry := range bucket.top.entries {
+			if seen[entry.key] {
+				continue
+			}
+			seen[entry.key] = true
+			h1, h2 := sketchHashes([]byte(entry.key))
+			var count int64
+			for _, b := range shard.buckets {
+				count += int64(b.sketch.estimate(h1, h2))
+			}
+			result = append(result, HotKey{
+				Key:   entry.key,
+				Slot:  cluster.Slot([]byte(entry.key)),
+				Count: count,
+				Qps:   float64(count) / window.Seconds(),
+			})
+		}
+	}
+	return result
+}
+
+func (hk *hotKeys) rotate(now time.Time) {
+	var buckets int
+	for i := range hk.shards {
+		shard := &hk.shards[i]
+		bucket := &hotKeyBucket{top: newTopK(hk.k), alerted: make(map[string]bool)}
+		shard.mu.Lock()
+		shard.buckets = append(shard.buckets, bucket)
+		if len(shard.buckets) > hotKeyBuckets {
+			shard.buckets = shard.buckets[1:]
+		}
+		buckets = len(shard.buckets)
+		shard.mu.Unlock()
+	}
+	hk.mu.Lock()
+	hk.buckets = buckets
+	hk.bucketStart = now
+	hk.mu.Unlock()
+}
+
+func (hk *hotKeys) rotateLoop() {
+	ticker := time.NewTicker(hk.bucketPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			hk.rotate(now)
+		case <-hk.done:
+			return
+		}
+	}
+}
+
+func (hk *hotKeys) Close() {
+	if hk != nil {
+		close(hk.done)
+	}
+}
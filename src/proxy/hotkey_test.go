@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"cluster"
+)
+
+func Test_CountMinSketch(t *testing.T) {
+	var sketch countMinSketch
+	for i := 0; i < 1000; i++ {
+		sketch.add(sketchHashes([]byte("key" + strconv.Itoa(i%100))))
+	}
+	for i := 0; i < 100; i++ {
+		if c := sketch.estimate(sketchHashes([]byte("key" + strconv.Itoa(i)))); c < 10 {
+			t.Errorf("key%d estimated %d, below the real count 10", i, c)
+		}
+	}
+}
+
+func Test_HotKeys(t *testing.T) {
+	proxyCluster := newTestProxyCluster("hotkey_cluster")
+	proxyCluster.Hotkey_top_k = 3
+	proxyCluster.Hotkey_window = 60
+	hk := newHotKeys(proxyCluster)
+	defer hk.Close()
+
+	for i := 0; i < 5000; i++ {
+		hk.Record([]byte("cold" + strconv.Itoa(i)))
+	}
+	for i := 0; i < 300; i++ {
+		hk.Record([]byte("hot1"))
+		if i%2 == 0 {
+			hk.Record([]byte("hot2"))
+		}
+		if i%3 == 0 {
+			hk.Record([]byte("hot3"))
+		}
+	}
+	top := hk.Top(-1)
+	if len(top) != 3 {
+		t.Fatalf("top=%+v", top)
+	}
+	for i, key := range []string{"hot1", "hot2", "hot3"} {
+		if top[i].Key != key {
+			t.Errorf("top %d is %s, want %s", i, top[i].Key, key)
+		}
+	}
+	if top[0].Count < 300 || top[0].Slot != cluster.Slot([]byte("hot1")) {
+		t.Errorf("unexpected hot key %+v", top[0])
+	}
+
+	// the counts stay in the window across rotations and fall out after it
+	for i := 1; i < hotKeyBuckets; i++ {
+		hk.rotate(time.Now())
+	}
+	if top := hk.Top(1); len(top) != 1 || top[0].Key != "hot1" {
+		t.Errorf("hot key lost within the window,%+v", top)
+	}
+	hk.rotate(time.Now())
+	if top := hk.Top(1); len(top) != 0 {
+		t.Errorf("hot key still reported after the window,%+v", top)
+	}
+}
+
+func Test_HotKeysDisabled(t *testing.T) {
+	hk := newHotKeys(newTestProxyCluster("hotkey_disabled"))
+	if hk != nil {
+		t.Fatal("hot keys enabled without hotkey_top_k")
+	}
+	hk.Record([]byte("key"))
+	hk.Close()
+}
+
+func BenchmarkHotKeysRecord(b *testing.B) {
+	proxyCluster := newTestProxyCluster("hotkey_bench")
+	proxyCluster.Hotkey_top_k = 16
+	hk := newHotKeys(proxyCluster)
+	defer hk.Close()
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = []byte("key" + strconv.Itoa(i))
+	}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			hk.Record(keys[i%len(keys)])
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+const Version = "0.2.0"
+
+var startTime = time.Now()
+
+// ProxyMetadata is the payload of the ephemeral zookeeper node, clients use it
+// to discover proxies and pick the least loaded one.
+type ProxyMetadata struct {
+	Address     string   `json:"address"`
+	Cluster     string   `json:"cluster"`
+	Prefix      string   `json:"prefix"`
+	Version     string   `json:"version"`
+	StartTime   int64    `json:"start_time"`
+	UpdateTime  int64    `json:"update_time"`
+	Features    []string `json:"features"`
+	Connections int64    `json:"connections"`
+	Qps         float32  `json:"qps"`
+}
+
+func NewProxyMetadata(proxyCluster *ProxyClusterConfig) *ProxyMetadata {
+	return &ProxyMetadata{
+		Address:     proxyCluster.Advertise,
+		Cluster:     proxyCluster.Cluster,
+		Prefix:      proxyCluster.Prefix,
+		Version:     Version,
+		StartTime:   startTime.UnixNano() / int64(time.Millisecond),
+		UpdateTime:  time.Now().UnixNano() / int64(time.Millisecond),
+		Features:    supportedFeatures(proxyCluster),
+		Connections: atomic.LoadInt64(&proxyCluster.connections),
+		Qps:         GMonitor.QPS(proxyCluster.Cluster),
+	}
+}
+
+func (metadata *ProxyMetadata) Bytes() []byte {
+	data, err := json.Marshal(metadata)
+	Must(err)
+	return data
+}
+
+func supportedFeatures(proxyCluster *ProxyClusterConfig) []string {
+	features := []string{"cluster"}
+	if proxyCluster.PrefixBytes != nil {
+		features = append(features, "prefix")
+	}
+	return features
+}
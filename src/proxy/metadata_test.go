@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func Test_ProxyMetadata(t *testing.T) {
+	proxyCluster := newTestProxyCluster("metadata_cluster")
+	proxyCluster.Prefix = "4D"
+	proxyCluster.PrefixBytes = []byte("4D")
+	proxyCluster.connections = 3
+	// 50 commands in the last interval of 10s
+	GMonitor.RecordManyAndRt("metadata_cluster", 50, 0)
+	GMonitor.(*prometheusMonitor).Monitor.(*shardedMonitor).dumpAndClear()
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	data := NewProxyMetadata(proxyCluster).Bytes()
+	var payload map[string]interface{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		t.Fatalf("payload is not json: %q", data)
+	}
+	for field, want := range map[string]interface{}{
+		"address":     "10.0.0.1:6679",
+		"cluster":     "metadata_cluster",
+		"prefix":      "4D",
+		"version":     Version,
+		"start_time":  float64(startTime.UnixNano() / int64(time.Millisecond)),
+		"connections": float64(3),
+		"qps":         float64(5),
+	} {
+		if payload[field] != want {
+			t.Errorf("%s=%v, want %v", field, payload[field], want)
+		}
+	}
+	if updated, _ := payload["update_time"].(float64); int64(updated) < before {
+		t.Errorf("update_time=%v before %d", payload["update_time"], before)
+	}
+	features, _ := payload["features"].([]interface{})
+	if len(features) != 2 || features[0] != "cluster" || features[1] != "prefix" {
+		t.Errorf("features=%v", payload["features"])
+	}
+	if len(payload) != 9 {
+		t.Errorf("unexpected fields in %s", data)
+	}
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"cluster"
+	log "github.com/cihub/seelog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const metricsNamespace = "redis_proxy"
+
+const (
+	OutcomeOk            = "ok"
+	OutcomeRedisError    = "redis_error"
+	OutcomeProtocolError = "protocol_error"
+	OutcomeTimeout       = "timeout"
+	// a TimeoutError is connect_timeout, read_timeout or write_timeout
+	OutcomeConnectTimeout = "connect_timeout"
+	OutcomeReadTimeout    = "read_timeout"
+	OutcomeWriteTimeout   = "write_timeout"
+	OutcomeBackendDown    = "backend_down"
+	OutcomeRateLimited    = "rate_limited"
+)
+
+// latency buckets from 100us to ~3.3s
+var latencyBuckets = prometheus.ExponentialBuckets(0.0001, 2, 16)
+
+// prometheusMonitor exports everything recorded through Monitor as
+// prometheus metrics and passes it on to the next Monitor.
+type prometheusMonitor struct {
+	Monitor
+
+	events            *prometheus.CounterVec
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	errors            *prometheus.CounterVec
+	bytesIn           *prometheus.CounterVec
+	bytesOut          *prometheus.CounterVec
+	activeConnections *prometheus.GaugeVec
+	totalConnections  *prometheus.CounterVec
+	nodeLatency       *prometheus.HistogramVec
+	redirects         *prometheus.CounterVec
+	rateLimited       *prometheus.CounterVec
+	breakerState      *prometheus.GaugeVec
+	zookeeperState    prometheus.Gauge
+	registered        *prometheus.GaugeVec
+}
+
+func newPrometheusMonitor(next Monitor) Monitor {
+	monitor := &prometheusMonitor{
+		Monitor: next,
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "events_total",
+			Help:      "Events recorded by name, e.g. zookeeper.expired.",
+		}, []string{"event"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Commands proxied per cluster, command and outcome.",
+		}, []string{"cluster", "command", "outcome"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Latency of proxied commands per cluster and command.",
+			Buckets:   latencyBuckets,
+		}, []string{"cluster", "command"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "errors_total",
+			Help:      "Failed commands per cluster and error type.",
+		}, []string{"cluster", "type"}),
+		bytesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "received_bytes_total",
+			Help:      "Request bytes received from clients per cluster and command.",
+		}, []string{"cluster", "command"}),
+		bytesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sent_bytes_total",
+			Help:      "Reply bytes sent to clients per cluster and command.",
+		}, []string{"cluster", "command"}),
+		activeConnections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "connections_active",
+			Help:      "Client connections currently open.",
+		}, []string{"cluster"}),
+		totalConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "connections_total",
+			Help:      "Client connections accepted.",
+		}, []string{"cluster"}),
+		nodeLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "backend_latency_seconds",
+			Help:      "Round trip latency of backend redis nodes.",
+			Buckets:   latencyBuckets,
+		}, []string{"cluster", "node"}),
+		redirects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "redirects_total",
+			Help:      "MOVED and ASK redirections per backend node.",
+		}, []string{"cluster", "node", "type"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rate_limited_total",
+			Help:      "Commands delayed or rejected by a rate limit per cluster, limit scope and command type.",
+		}, []string{"cluster", "scope", "type", "action"}),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "circuit_breaker_state",
+			Help:      "Circuit breaker of a backend node, 0 closed, 1 open, 2 half open.",
+		}, []string{"cluster", "node"}),
+		zookeeperState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "zookeeper_session_state",
+			Help:      "Zookeeper session state as numbered by the client, 101 has session, 100 connected, 1 connecting, 0 disconnected, -112 expired, -1 unknown.",
+		}),
+		registered: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "registered",
+			Help:      "1 if the registry node of the cluster exists, 0 while it is being registered again.",
+		}, []string{"cluster"}),
+	}
+	prometheus.MustRegister(monitor.events, monitor.requests, monitor.requestDuration, monitor.errors, monitor.bytesIn, monitor.bytesOut,
+		monitor.activeConnections, monitor.totalConnections, monitor.nodeLatency, monitor.redirects, monitor.rateLimited,
+		monitor.breakerState, monitor.zookeeperState, monitor.registered)
+	return monitor
+}
+
+func (monitor *prometheusMonitor) RecordOne(name string) {
+	monitor.events.WithLabelValues(name).Inc()
+	monitor.Monitor.RecordOne(name)
+}
+
+func (monitor *prometheusMonitor) RecordCommand(cluster string, cmd string, outcome string, rt time.Duration, bytesIn int, bytesOut int) {
+	monitor.requests.WithLabelValues(cluster, cmd, outcome).Inc()
+	monitor.requestDuration.WithLabelValues(cluster, cmd).Observe(rt.Seconds())
+	if outcome != OutcomeOk {
+		monitor.errors.WithLabelValues(cluster, outcome).Inc()
+	}
+	monitor.bytesIn.WithLabelValues(cluster, cmd).Add(float64(bytesIn))
+	monitor.bytesOut.WithLabelValues(cluster, cmd).Add(float64(bytesOut))
+	monitor.Monitor.RecordCommand(cluster, cmd, outcome, rt, bytesIn, bytesOut)
+}
+
+func (monitor *prometheusMonitor) RecordConnection(cluster string, delta int) {
+	monitor.activeConnections.WithLabelValues(cluster).Add(float64(delta))
+	if delta > 0 {
+		monitor.totalConnections.WithLabelValues(cluster).Add(float64(delta))
+	}
+	monitor.Monitor.RecordConnection(cluster, delta)
+}
+
+func (monitor *prometheusMonitor) RecordNodeLatency(cluster string, node string, rt time.Duration) {
+	monitor.nodeLatency.WithLabelValues(cluster, node).Observe(rt.Seconds())
+	monitor.Monitor.RecordNodeLatency(cluster, node, rt)
+}
+
+func (monitor *prometheusMonitor) RecordRedirect(cluster string, node string, redirect string) {
+	monitor.redirects.WithLabelValues(cluster, node, redirect).Inc()
+	monitor.Monitor.RecordRedirect(cluster, node, redirect)
+}
+
+func (monitor *prometheusMonitor) RecordRateLimit(cluster string, scope string, kind string, action string) {
+	monitor.rateLimited.WithLabelValues(cluster, scope, kind, action).Inc()
+	monitor.Monitor.RecordRateLimit(cluster, scope, kind, action)
+}
+
+func (monitor *prometheusMonitor) RecordBreakerState(cluster string, node string, state string) {
+	for i, name := range breakerStateNames {
+		if name == state {
+			monitor.breakerState.WithLabelValues(cluster, node).Set(float64(i))
+		}
+	}
+	monitor.Monitor.RecordBreakerState(cluster, node, state)
+}
+
+func (monitor *prometheusMonitor) RecordZookeeperState(state zk.State) {
+	monitor.zookeeperState.Set(float64(state))
+	monitor.Monitor.RecordZookeeperState(state)
+}
+
+func (monitor *prometheusMonitor) RecordRegistration(cluster string, registered bool) {
+	var value float64
+	if registered {
+		value = 1
+	}
+	monitor.registered.WithLabelValues(cluster).Set(value)
+	monitor.Monitor.RecordRegistration(cluster, registered)
+}
+
+// commandOutcome classifies the result of process.
+func commandOutcome(reply interface{}, err error) string {
+	if err == nil {
+		if _, ok := cluster.ReplyError(reply); ok {
+			return OutcomeRedisError
+		}
+		return OutcomeOk
+	}
+	if _, ok := err.(ProtocolError); ok {
+		return OutcomeProtocolError
+	}
+	if _, ok := err.(RateLimitedError); ok {
+		return OutcomeRateLimited
+	}
+	if te, ok := err.(TimeoutError); ok {
+		return te.Op + "_timeout"
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return OutcomeTimeout
+	}
+	return OutcomeBackendDown
+}
+
+// StartMetricsServer serves /metrics for prometheus on addr.
+func StartMetricsServer(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Infof("metrics server started,listen=%s", addr)
+	go func() {
+		log.Error(http.ListenAndServe(addr, mux))
+	}()
+}
@@ -1,21 +1,131 @@
 package proxy
 
 import (
+	"sync"
 	"testing"
 	"time"
 )
 
 func Test_Monitor(t *testing.T) {
-	GMonitor.RecordOne("a")
-	GMonitor.RecordOne("a")
-	GMonitor.RecordOne("b")
-	GMonitor.RecordOneAndRt("b", 2000)
-	cc, _ := monitorItems.MarshalJSON()
-	time.Sleep(time.Second * 11)
-
-	time.Sleep(time.Second * 1)
-	GMonitor.RecordOneAndRt("b", 2)
-	time.Sleep(time.Second * 11)
-	GMonitor.Close()
-	t.Error(string(cc))
+	monitor := newShardedMonitor(time.Second * 10)
+	monitor.RecordOne("a")
+	monitor.RecordOne("a")
+	monitor.RecordOne("b")
+	monitor.RecordOneAndRt("b", 2000*time.Millisecond)
+	monitor.RecordManyAndRt("c", 5, 300*time.Microsecond)
+
+	results := monitor.dumpAndClear()
+	if results["a"].Count != 2 || results["b"].Count != 2 || results["c"].Count != 5 {
+		t.Errorf("unexpected counts a=%d,b=%d,c=%d", results["a"].Count, results["b"].Count, results["c"].Count)
+	}
+	if results["b"].Max != 2000 || results["b"].AvgRt != 1000 {
+		t.Errorf("unexpected rt of b,max=%f,avg=%f", results["b"].Max, results["b"].AvgRt)
+	}
+	if results["c"].AvgRt != 0.3 || results["c"].P99 != 0.3 {
+		t.Errorf("rt must keep microseconds,avg=%f,p99=%f", results["c"].AvgRt, results["c"].P99)
+	}
+	if qps := monitor.QPS("c"); qps != 0.5 {
+		t.Errorf("qps of 5 requests in 10s is %f", qps)
+	}
+
+	monitor.RecordOneAndRt("b", 2*time.Millisecond)
+	results = monitor.dumpAndClear()
+	if _, ok := results["a"]; ok || results["b"].Count != 1 {
+		t.Errorf("items must be cleared after dump %v", results)
+	}
+}
+
+func Test_MonitorPercentiles(t *testing.T) {
+	monitor := newShardedMonitor(time.Second)
+	for i := 1; i <= 1000; i++ {
+		monitor.RecordOneAndRt("a", time.Duration(i)*time.Millisecond)
+	}
+	snapshot := monitor.dumpAndClear()["a"]
+	expected := map[string][2]float64{
+		"p50":  {snapshot.P50, 500},
+		"p90":  {snapshot.P90, 900},
+		"p99":  {snapshot.P99, 990},
+		"p999": {snapshot.P999, 999},
+	}
+	for name, values := range expected {
+		// log-linear buckets are off by less than 1/16
+		if values[0] < values[1] || values[0] > values[1]*17/16 {
+			t.Errorf("%s is %f, expected about %f", name, values[0], values[1])
+		}
+	}
+	if snapshot.Max != 1000 {
+		t.Errorf("max is %f", snapshot.Max)
+	}
+}
+
+func Test_MonitorConcurrent(t *testing.T) {
+	monitor := newShardedMonitor(time.Second)
+	var wg sync.WaitGroup
+	var total int64
+	done := make(chan struct{})
+	dumped := make(chan struct{})
+	go func() {
+		defer close(dumped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			results := monitor.dumpAndClear()
+			total += results["a"].countOrZero()
+		}
+	}()
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10000; j++ {
+				monitor.RecordOneAndRt("a", time.Microsecond)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-dumped
+	total += monitor.dumpAndClear()["a"].countOrZero()
+	if total != 80000 {
+		t.Errorf("lost records, total=%d", total)
+	}
+}
+
+func (snapshot *MonitorSnapshot) countOrZero() int64 {
+	if snapshot == nil {
+		return 0
+	}
+	return snapshot.Count
+}
+
+func Test_MonitorRecordCommand(t *testing.T) {
+	monitor := newShardedMonitor(time.Second)
+	monitor.RecordCommand("item_cluster", "GET", OutcomeOk, time.Millisecond, 30, 10)
+	monitor.RecordCommand("item_cluster", "GET", OutcomeOk, time.Millisecond, 30, 12)
+	monitor.RecordCommand("item_cluster", "GET", OutcomeTimeout, time.Second, 30, 0)
+
+	results := monitor.dumpAndClear()
+	if results["item_cluster"].Count != 3 {
+		t.Errorf("cluster key must count every command, got %d", results["item_cluster"].Count)
+	}
+	ok := results["item_cluster.GET.ok"]
+	if ok == nil || ok.Count != 2 || ok.BytesIn != 60 || ok.BytesOut != 22 {
+		t.Errorf("unexpected GET.ok %+v", ok)
+	}
+	if timeout := results["item_cluster.GET.timeout"]; timeout == nil || timeout.Max != 1000 {
+		t.Errorf("unexpected GET.timeout %+v", timeout)
+	}
+}
+
+func Test_MonitorCommandNameLimit(t *testing.T) {
+	names := &commandNames{limit: 2}
+	if names.name("GET") != "GET" || names.name("SET") != "SET" || names.name("GET") != "GET" {
+		t.Error("commands under the limit must be kept")
+	}
+	if name := names.name("\x00garbage"); name != monitorOtherCommand {
+		t.Errorf("commands over the limit must be folded, got %s", name)
+	}
 }
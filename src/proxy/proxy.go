@@ -1,96 +1,78 @@
 package proxy
 
 import (
-	"github.com/carlvine500/redis-go-cluster"
 	"github.com/samuel/go-zookeeper/zk"
 	log "github.com/cihub/seelog"
 	"net"
-	"strings"
 	"time"
-	"os"
-	"os/signal"
-	"syscall"
 	"bytes"
 	"fmt"
+	"sync/atomic"
+	"cluster"
 )
 
-func StartRedisClusterProxy(proxyCluster *ProxyClusterConfig, zkConn *zk.Conn) {
+func StartRedisClusterProxy(proxyCluster *ProxyClusterConfig, registry Registry, zkConn *zk.Conn) {
 
 	ln, err := net.Listen("tcp4", proxyCluster.Listen)
 	if err != nil {
-		log.Error(err.Error())
+		// the cluster stays not ready
+		log.Errorf("listen error,cluster=%s,listen=%s,error=%v", proxyCluster.Cluster, proxyCluster.Listen, err)
+		return
 	}
-	redisCluster, _ := createRedisCluster(proxyCluster)
-	registerIntoZookeeper(zkConn, proxyCluster)
-	signalNotify(zkConn, redisCluster)
-
-	channels := make(chan net.Conn, proxyCluster.Client_connections)
-	go func() {
-		for conn := range channels {
-			go handleRequest(conn, redisCluster, proxyCluster)
-		}
-	}()
+	redisCluster := newBackend(proxyCluster, proxyCluster.Servers)
+	cp := newClusterProxy(proxyCluster, ln, redisCluster)
+	if proxyCluster.Servers_path != "" && zkConn != nil {
+		go watchServers(zkConn, proxyCluster.Servers_path, func(servers []string) {
+			if err := redisCluster.Refresh(servers); err != nil {
+				log.Errorf("refresh redis cluster error,cluster=%s,servers=%v,error=%v", proxyCluster.Cluster, servers, err)
+			}
+		})
+	}
+	Must(registry.Register(proxyCluster))
+	signalOnce.Do(func() {
+		signalNotify(registry)
+	})
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if isDraining() {
+				log.Infof("listener closed for draining,cluster=%s", proxyCluster.Cluster)
+				return
+			}
 			log.Error("accept error", err.Error())
 		} else {
-			channels <- conn
+			serveConn(cp, conn)
 		}
 	}
 
 }
 
-func signalNotify(zkConn *zk.Conn, redisCluster *redis.Cluster) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM, os.Kill)
-	go func() {
-		for sig := range c {
-			log.Infof("Got A %v Signal! ", sig.String())
-			zkConn.Close()
-			redisCluster.Close()
-			GMonitor.Close()
-			log.Flush()
-			os.Exit(1)
-		}
-	}()
-}
-
-func registerIntoZookeeper(zkConn *zk.Conn, proxyCluster *ProxyClusterConfig) {
-	if zkConn == nil {
+// serveConn serves an accepted connection, or rejects it like redis does once
+// client_connections clients are connected to the cluster.
+func serveConn(cp *clusterProxy, conn net.Conn) {
+	proxyCluster := cp.config
+	if atomic.AddInt64(&proxyCluster.connections, 1) > int64(proxyCluster.Client_connections) {
+		atomic.AddInt64(&proxyCluster.connections, -1)
+		GMonitor.RecordOne(proxyCluster.Cluster + ".rejected_connections")
+		log.Warnf("max number of clients reached,cluster=%s,remote=%v,max=%d", proxyCluster.Cluster, conn.RemoteAddr(), proxyCluster.Client_connections)
+		// off the accept loop, a slow client must not hold it up
+		go func() {
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			conn.Write([]byte("-ERR max number of clients reached\r\n"))
+			conn.Close()
+		}()
 		return
 	}
-	proxyClusterPath := "/gcache/proxy" + "/" + proxyCluster.Cluster
-	ensureExsists(zkConn, proxyClusterPath)
-
-	serverPath := proxyClusterPath + "/" + proxyCluster.Listen
-	_, err := zkConn.Create(serverPath, []byte("here"), int32(zk.FlagEphemeral), zk.WorldACL(zk.PermAll))
-	if err != nil && strings.Contains(err.Error(), "node already exists") {
-		//skip
-	} else {
-		Must(err)
-	}
-	log.Infof("registed into zookeeper,path=%s", serverPath)
-}
-
-func ensureExsists(zkConn *zk.Conn, path string) {
-	pathArr := strings.Split(path, "/")
-	existsPathDepth := 0
-	for i := len(pathArr); i > 0; i-- {
-		tmpPath := strings.Join(pathArr[0:i], "/")
-		exist, _, err := zkConn.Exists(tmpPath)
-		Must(err)
-		if (exist) {
-			existsPathDepth = i
-			break
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if proxyCluster.Tcp_keepalive > 0 {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(time.Duration(proxyCluster.Tcp_keepalive) * time.Second)
+		} else {
+			tcpConn.SetKeepAlive(false)
 		}
 	}
-	for i := existsPathDepth + 1; i < len(pathArr) + 1; i++ {
-		tmpPath := strings.Join(pathArr[0:i], "/")
-		_, err := zkConn.Create(tmpPath, []byte{}, int32(0), zk.WorldACL(zk.PermAll))
-		Must(err)
-	}
+	go handleRequest(conn, cp)
 }
 
 func Must(err error) {
@@ -99,12 +81,66 @@ func Must(err error) {
 	}
 }
 
-func handleRequest(conn net.Conn, redisCluster *redis.Cluster, proxyCluster *ProxyClusterConfig) {
-	session := NewSession(conn, -1, -1)
+// proxyRequest is one client command on its way to the backend.
+type proxyRequest struct {
+	cmd  string
+	args []interface{}
+	// backend node serving the command, empty if unknown
+	node string
+	// user the session authenticated as, empty before AUTH
+	user string
+	// rate limits the command is charged to
+	budgets []*rateBudget
+	// makes args outlive the request, see ClientSession.KeepRequest
+	keepArgs func()
+
+	start     time.Time
+	parseTime time.Duration
+	// from the end of parsing to the backend call
+	routeTime time.Duration
+	// from the end of parsing to the backend reply, routeTime included
+	backendTime time.Duration
+	writeTime   time.Duration
+}
+
+func handleRequest(conn net.Conn, cp *clusterProxy) {
+	proxyCluster := cp.config
+	// the connection has been counted by serveConn
+	session := NewSession(conn, int64(proxyCluster.Client_idle_timeout)*1000, int64(proxyCluster.Client_write_timeout))
+	info := cp.addSession(session)
+	GMonitor.RecordConnection(proxyCluster.Cluster, 1)
+	defer func() {
+		cp.removeSession(info)
+		atomic.AddInt64(&proxyCluster.connections, -1)
+		GMonitor.RecordConnection(proxyCluster.Cluster, -1)
+	}()
+	// empty until the session authenticates
+	var user string
+	budgets := cp.limiter.sessionBudgets(session, user)
 	log.Infof("connection created, remote:%v, at:%v", session.RemoteAddr(), time.Now().Format(time.Stamp))
+	// reused for every request of the session
+	req := &proxyRequest{}
+	keepArgs := session.KeepRequest
+	// one recover for the session, a panic ends it like any other error
+	var cmd string
+	var request []interface{}
+	defer func() {
+		if err := recover(); err != nil {
+			session.Response(nil, ProtocolError(fmt.Sprintf("Unknow Error,%v", err)), cmd)
+			log.Errorf("Unknow Error[E],cmd=%s,request=%v,error=%s", cmd, request, err)
+		}
+	}()
 	for {
-		beginTime := time.Now().UnixNano()
-		request, reqErr := session.ParseRequest()
+		info.idle()
+		if isDraining() {
+			// between two commands, the drain closes the session
+			session.Close()
+			log.Infof("connection closed for draining, remote:%v, at:%v", session.RemoteAddr(), time.Now().Format(time.Stamp))
+			return
+		}
+		var reqErr error
+		request, reqErr = session.ParseRequest()
+		beginTime := time.Now()
 
 		if reqErr != nil {
 			if protocolErr, ok := reqErr.(ProtocolError); ok {
@@ -112,65 +148,114 @@ func handleRequest(conn net.Conn, redisCluster *redis.Cluster, proxyCluster *Pro
 				return
 			}
 			session.Close()
+			if netErr, ok := reqErr.(net.Error); ok && netErr.Timeout() {
+				GMonitor.RecordOne(proxyCluster.Cluster + ".idle_timeout")
+				log.Infof("connection idle timeout, remote:%v, at:%v", session.RemoteAddr(), time.Now().Format(time.Stamp))
+				return
+			}
 			log.Infof("connection closed, remote:%v, at:%v", session.RemoteAddr(), time.Now().Format(time.Stamp))
 			return
 		}
+		if !info.active(beginTime) {
+			// closed by the drain while the command was parsed, it is not served
+			log.Infof("connection closed for draining, remote:%v, at:%v", session.RemoteAddr(), time.Now().Format(time.Stamp))
+			return
+		}
 
-		var cmd = strings.ToUpper(strings.TrimSpace(string(request[0].([]uint8))))
-		defer func() {
-			if err := recover(); err != nil {
-				session.Response(nil, ProtocolError(fmt.Sprintf("Unknow Error,%v\r\n")), cmd)
-				log.Errorf("Unknow Error[E],cmd=%s,request=%v,error=%s", cmd, request, err)
-			}
-		}()
+		cmd = commandName(request[0].([]uint8))
 
-		var args []interface{} = request[1:]
-		var reply, err = process(redisCluster, cmd, proxyCluster.PrefixBytes, args...)
+		*req = proxyRequest{cmd: cmd, args: request[1:], user: user, budgets: budgets, keepArgs: keepArgs, start: session.RequestStart()}
+		req.parseTime = beginTime.Sub(req.start)
+		// a forbidden MONITOR is refused by process like any other command
+		if cmd == "MONITOR" && !IsCmdForbidden(cmd) {
+			// it only waits for QUIT from now on, the drain may close it
+			info.idle()
+			serveMonitor(cp, session)
+			return
+		}
+		if cmd == "AUTH" && !IsCmdForbidden(cmd) {
+			// answered by the proxy, the password is kept out of the monitor,
+			// the slowlog and the audit log, a failed AUTH keeps the user
+			authed, reply, err := cp.users.auth(req.args)
+			if authed != "" {
+				user = authed
+				budgets = cp.limiter.sessionBudgets(session, user)
+			}
+			req.args, req.user = nil, user
+			written := session.BytesWritten()
+			session.Response(reply, err, cmd)
+			GMonitor.RecordCommand(proxyCluster.Cluster, monitorCommandName(cmd), commandOutcome(reply, err), time.Since(beginTime),
+				requestSize(request), int(session.BytesWritten()-written))
+			cp.audit.Record(session, req, reply, err)
+			continue
+		}
+		// before process, it prefixes the key in place
+		cp.monitor.Publish(session, req)
+		bytesIn := requestSize(request)
+		var reply, err = process(cp, req)
+		rt := time.Since(beginTime)
+		req.backendTime = rt
 
-		endTime := time.Now().UnixNano()
-		GMonitor.RecordOneAndRt(proxyCluster.Listen, int((endTime - beginTime) / 1000 / 1000))
+		written := session.BytesWritten()
 		session.Response(reply, err, cmd)
+		req.writeTime = time.Since(beginTime) - rt
+		outcome := commandOutcome(reply, err)
+		GMonitor.RecordCommand(proxyCluster.Cluster, monitorCommandName(cmd), outcome, rt,
+			bytesIn, int(session.BytesWritten()-written))
+		cp.slowlog.Record(session, req)
+		cp.audit.Record(session, req, reply, err)
+		traceRequest(proxyCluster.Cluster, session, req, outcome)
+		if stream, ok := reply.(*cluster.Stream); ok {
+			// its size is known once written
+			cp.bigKeys.streamed(req, stream)
+		}
+		// written and recorded, the buffer or the connection goes back to its pool
+		cluster.Release(reply)
 	}
 }
 
 func B2S(bs []uint8) string {
-	ba := []byte{}
-	for _, b := range bs {
-		ba = append(ba, byte(b))
+	return string(bs)
+}
+
+// prefixKeys prefixes every key of args in place, multi key commands are split
+// by slot afterwards so each of their keys must carry the prefix.
+func prefixKeys(prefix []byte, cmd string, args []interface{}) {
+	isKey := commandKeyPositions(cmd)
+	for i, arg := range args {
+		if isKey(i) {
+			args[i] = bytes.Join([][]byte{prefix, arg.([]byte)}, []byte(":"))
+		}
 	}
-	return string(ba)
 }
 
-func process(redisCluster *redis.Cluster, cmd string, prefixBytes []byte, args ...interface{}) (interface{}, error) {
+func process(cp *clusterProxy, req *proxyRequest) (interface{}, error) {
 	// TODO avoid string 处理逻辑,全部使用bytes
 	switch {
-	case IsCmdForbidden(cmd):
-		return nil, ProtocolError("unsupported cmd " + cmd)
-	case cmd == "QUIT":
+	case IsCmdForbidden(req.cmd):
+		return nil, ProtocolError("unsupported cmd " + req.cmd)
+	case req.cmd == "SLOWLOG":
+		// answered by the proxy, the slowlog of the backend nodes is not reachable through it
+		return cp.slowlog.command(req.args)
+	case req.cmd == "QUIT":
 		return nil, ProtocolError("client issue QUIT")
-	case cmd == "PING":
-		return "PONG", nil
+	case req.cmd == "PING":
+		return pingStatus(req.args)
 	}
 
-	if (prefixBytes != nil) {
-		args[0] = bytes.Join([][]byte{prefixBytes, args[0].([]byte)}, []byte(":"))
+	if err := cp.limiter.Take(req); err != nil {
+		return nil, err
 	}
-	// TODO 慢查询，性能统计页面
-	return redisCluster.Do(cmd, args...)
-}
-
-func createRedisCluster(proxyCluster *ProxyClusterConfig) (*redis.Cluster, error) {
-	cluster, err := redis.NewCluster(
-		&redis.Options{
-			StartNodes:   proxyCluster.Servers,
-			ConnTimeout:  time.Duration(proxyCluster.Timeout) * time.Millisecond,
-			ReadTimeout:  time.Duration(proxyCluster.Server_retry_timeout) * time.Millisecond,
-			WriteTimeout: time.Duration(proxyCluster.Server_retry_timeout) * time.Millisecond,
-			KeepAlive:    proxyCluster.Backlog,
-			AliveTime:    60 * time.Second,
-		})
-
-	return cluster, err
+	if (cp.config.PrefixBytes != nil) {
+		prefixKeys(cp.config.PrefixBytes, req.cmd, req.args)
+	}
+	if len(req.args) > 0 {
+		cp.hotKeys.Record(req.args[0].([]byte))
+	}
+	req.routeTime = time.Since(req.start.Add(req.parseTime))
+	reply, err := cp.backend.Do(req)
+	if err != nil {
+		return reply, cp.bigKeys.rejected(err)
+	}
+	return cp.bigKeys.Check(req, reply)
 }
-
-
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cluster"
+)
+
+func Test_ServeConnMaxClients(t *testing.T) {
+	cp := newTestAdminCluster("max_clients_cluster")
+	cp.config.Client_connections = 1
+
+	first, server := net.Pipe()
+	serveConn(cp, server)
+	second, server := net.Pipe()
+	defer second.Close()
+	serveConn(cp, server)
+
+	line, err := bufio.NewReader(second).ReadString('\n')
+	if err != nil || line != "-ERR max number of clients reached\r\n" {
+		t.Fatalf("second client got %q,%v", line, err)
+	}
+	if n := atomic.LoadInt64(&cp.config.connections); n != 1 {
+		t.Errorf("connections=%d, want 1", n)
+	}
+	first.Close()
+	waitFor(t, time.Second, func() bool { return atomic.LoadInt64(&cp.config.connections) == 0 })
+}
+
+func Test_SessionReadTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	session := NewSession(server, 400, -1)
+
+	go client.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	if _, err := session.ParseRequest(); err != nil {
+		t.Fatalf("ParseRequest error %v", err)
+	}
+	first := session.(*clientSession).readDeadline.at
+	go client.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	if _, err := session.ParseRequest(); err != nil {
+		t.Fatalf("ParseRequest error %v", err)
+	}
+	if session.(*clientSession).readDeadline.at != first {
+		t.Errorf("read deadline moved within an eighth of the timeout")
+	}
+
+	start := time.Now()
+	_, err := session.ParseRequest()
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("idle session got %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("idle session closed after %v", elapsed)
+	}
+}
+
+func Test_ParseReplyRaw(t *testing.T) {
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	frame := "*2\r\n$2\r\nid\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n"
+	ParseReply(bw, cluster.Raw(frame), nil, "XRANGE")
+	ParseReply(bw, cluster.Raw("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"), nil, "GET")
+	bw.Flush()
+	if buf.String() != frame+"-WRONGTYPE Operation against a key holding the wrong kind of value\r\n" {
+		t.Errorf("raw replies written as %q", buf.String())
+	}
+}
+
+func Test_ProcessPrefixesEveryKey(t *testing.T) {
+	var mu sync.Mutex
+	stored := make(map[string]string)
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	self := ln.Addr().String()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				session := NewSession(conn, -1, -1)
+				for {
+					request, err := session.ParseRequest()
+					if err != nil {
+						return
+					}
+					switch string(request[0].([]byte)) {
+					case "CLUSTER":
+						conn.Write([]byte(clusterSlotsReply(self)))
+					case "MSET":
+						mu.Lock()
+						for i := 1; i+1 < len(request); i += 2 {
+							stored[string(request[i].([]byte))] = string(request[i+1].([]byte))
+						}
+						mu.Unlock()
+						conn.Write([]byte("+OK\r\n"))
+					default:
+						conn.Write([]byte("-ERR unexpected\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	proxyCluster := newTestProxyCluster("prefix_cluster")
+	proxyCluster.Read_preference = ReadPreferenceMaster
+	proxyCluster.PrefixBytes = []byte("4D")
+	b := newBackend(proxyCluster, []string{self})
+	t.Cleanup(b.Close)
+	cp := newClusterProxy(proxyCluster, nil, b)
+	if cluster.Slot([]byte("4D:a")) == cluster.Slot([]byte("4D:b")) {
+		t.Fatal("prefixed keys in the same slot, the MSET is not split")
+	}
+
+	req := slowRequest("MSET", 0, "a", "1", "b", "2")
+	if reply, err := process(cp, req); err != nil || string(reply.(cluster.Raw)) != "+OK\r\n" {
+		t.Fatalf("MSET returned %q,%v", reply, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(stored) != 2 || stored["4D:a"] != "1" || stored["4D:b"] != "2" {
+		t.Errorf("stored %v", stored)
+	}
+}
+
+func Test_ResponseStreamsLargeReplies(t *testing.T) {
+	value := strings.Repeat("x", 200000)
+	frame := "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+	var self atomic.Value
+	node := startFakeRedis(t, func(cmd string, asking bool) string {
+		if cmd == "CLUSTER" {
+			return clusterSlotsReply(self.Load().(string))
+		}
+		return frame
+	})
+	self.Store(node)
+	proxyCluster := newTestProxyCluster("stream_cluster")
+	proxyCluster.Read_preference = ReadPreferenceMaster
+	proxyCluster.Client_connections = 1
+	// a stream never given back would hold the only connection
+	proxyCluster.Pool_size = 1
+	proxyCluster.Connect_timeout = 100
+	proxyCluster.Bigkey_bytes = 1000
+	b := newBackend(proxyCluster, []string{node})
+	t.Cleanup(b.Close)
+	cp := newClusterProxy(proxyCluster, nil, b)
+
+	client, server := net.Pipe()
+	serveConn(cp, server)
+	br := bufio.NewReader(client)
+	for i := 0; i < 2; i++ {
+		go client.Write([]byte("*2\r\n$3\r\nGET\r\n$3\r\nbig\r\n"))
+		reply := make([]byte, len(frame))
+		if _, err := io.ReadFull(br, reply); err != nil || string(reply) != frame {
+			t.Fatalf("GET %d answered %d bytes,%v", i, len(reply), err)
+		}
+	}
+	client.Close()
+	waitFor(t, time.Second, func() bool { return atomic.LoadInt64(&proxyCluster.connections) == 0 })
+	if top := cp.bigKeys.Top(-1); len(top) != 1 || top[0].Key != "big" || top[0].Bytes != len(value) || top[0].Count != 2 {
+		t.Errorf("big keys=%+v", top)
+	}
+}
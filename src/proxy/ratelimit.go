@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// commands over the budget are answered with rate_limit_error
+	RateLimitReject = "reject"
+	// commands over the budget wait for it, up to rate_limit_delay_ms
+	RateLimitDelay = "delay"
+)
+
+// RateLimitRule is a token bucket budget with separate buckets for reads and
+// writes, 0 qps is unlimited.
+type RateLimitRule struct {
+	// rate_limit_clients only, an ip or a cidr, all of its clients share the budget
+	Cidr string
+	// rate_limit_users only, one of the users the sessions authenticate as
+	User      string
+	Read_qps  float64
+	Write_qps float64
+	// tokens a bucket holds, default one second of qps
+	Burst float64
+}
+
+// tokenBucket is filled with rate tokens per second up to burst.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil, an unlimited bucket, if rate is not positive.
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = rate
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take takes a token and returns how long the caller has to wait until it is
+// available. The token is not taken if that is longer than maxWait.
+func (tb *tokenBucket) take(now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	if tb == nil {
+		return 0, true
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if now.After(tb.last) {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+		tb.last = now
+	}
+	// tokens go negative while callers wait for them
+	tokens := tb.tokens - 1
+	var wait time.Duration
+	if tokens < 0 {
+		wait = time.Duration(-tokens / tb.rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return wait, false
+	}
+	tb.tokens = tokens
+	return wait, true
+}
+
+// giveBack returns a token taken for a command that was rejected anyway.
+func (tb *tokenBucket) giveBack() {
+	if tb == nil {
+		return
+	}
+	tb.mu.Lock()
+	if tb.tokens++; tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.mu.Unlock()
+}
+
+type rateBudget struct {
+	// cluster, client or user
+	scope string
+	read  *tokenBucket
+	write *tokenBucket
+}
+
+// newRateBudget returns nil if rule limits nothing.
+func newRateBudget(scope string, rule RateLimitRule) *rateBudget {
+	if rule.Read_qps <= 0 && rule.Write_qps <= 0 {
+		return nil
+	}
+	return &rateBudget{
+		scope: scope,
+		read:  newTokenBucket(rule.Read_qps, rule.Burst),
+		write: newTokenBucket(rule.Write_qps, rule.Burst),
+	}
+}
+
+func (budget *rateBudget) bucket(write bool) *tokenBucket {
+	if write {
+		return budget.write
+	}
+	return budget.read
+}
+
+type clientRateLimit struct {
+	network *net.IPNet
+	budget  *rateBudget
+}
+
+// rateLimiter holds the rate limits of a cluster.
+type rateLimiter struct {
+	cluster  string
+	action   string
+	maxDelay time.Duration
+	err      RateLimitedError
+
+	budget  *rateBudget
+	clients []clientRateLimit
+	users   map[string]*rateBudget
+}
+
+// newRateLimiter returns nil if the cluster has no rate limits.
+func newRateLimiter(proxyCluster *ProxyClusterConfig) *rateLimiter {
+	rl := &rateLimiter{
+		cluster:  proxyCluster.Cluster,
+		action:   proxyCluster.Rate_limit_action,
+		maxDelay: time.Duration(proxyCluster.Rate_limit_delay_ms) * time.Millisecond,
+		err:      RateLimitedError(proxyCluster.Rate_limit_error),
+		budget:   newRateBudget("cluster", proxyCluster.Rate_limit),
+		users:    make(map[string]*rateBudget),
+	}
+	for _, rule := range proxyCluster.Rate_limit_clients {
+		network, err := parseCidr(rule.Cidr)
+		if err != nil {
+			log.Errorf("bad rate_limit_clients cidr,cluster=%s,cidr=%s,error=%v", proxyCluster.Cluster, rule.Cidr, err)
+			continue
+		}
+		if budget := newRateBudget("client", rule); budget != nil {
+			rl.clients = append(rl.clients, clientRateLimit{network: network, budget: budget})
+		}
+	}
+	for _, rule := range proxyCluster.Rate_limit_users {
+		if rule.User == "" {
+			log.Errorf("rate_limit_users rule without user,cluster=%s", proxyCluster.Cluster)
+			continue
+		}
+		if budget := newRateBudget("user", rule); budget != nil {
+			rl.users[rule.User] = budget
+		}
+	}
+	if rl.budget == nil && len(rl.clients) == 0 && len(rl.users) == 0 {
+		return nil
+	}
+	return rl
+}
+
+// parseCidr parses a cidr or a single ip.
+func parseCidr(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: cidr}
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	return network, err
+}
+
+// sessionBudgets returns the budgets a session is charged to: the cluster,
+// the first client rule matching its ip and its authenticated user, empty
+// before AUTH. It is resolved when the session starts and again after AUTH,
+// not per command.
+func (rl *rateLimiter) sessionBudgets(session ClientSession, user string) []*rateBudget {
+	if rl == nil {
+		return nil
+	}
+	var budgets []*rateBudget
+	if rl.budget != nil {
+		budgets = append(budgets, rl.budget)
+	}
+	if host, _, err := net.SplitHostPort(session.RemoteAddr()); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			for _, client := range rl.clients {
+				if client.network.Contains(ip) {
+					budgets = append(budgets, client.budget)
+					break
+				}
+			}
+		}
+	}
+	if budget, ok := rl.users[user]; ok {
+		budgets = append(budgets, budget)
+	}
+	return budgets
+}
+
+// Take charges req to its budgets, it delays the command or rejects it with
+// rate_limit_error once a budget is spent.
+func (rl *rateLimiter) Take(req *proxyRequest) error {
+	if rl == nil || len(req.budgets) == 0 {
+		return nil
+	}
+	write := !IsCmdReadOnly(req.cmd)
+	kind := "read"
+	if write {
+		kind = "write"
+	}
+	var maxWait time.Duration
+	if rl.action == RateLimitDelay {
+		maxWait = rl.maxDelay
+	}
+	now := time.Now()
+	var wait time.Duration
+	var waitScope string
+	for i, budget := range req.budgets {
+		w, ok := budget.bucket(write).take(now, maxWait)
+		if !ok {
+			for _, taken := range req.budgets[:i] {
+				taken.bucket(write).giveBack()
+			}
+			GMonitor.RecordRateLimit(rl.cluster, budget.scope, kind, "rejected")
+			return rl.err
+		}
+		if w > wait {
+			wait, waitScope = w, budget.scope
+		}
+	}
+	if wait > 0 {
+		GMonitor.RecordRateLimit(rl.cluster, waitScope, kind, "delayed")
+		time.Sleep(wait)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_TokenBucket(t *testing.T) {
+	tb := newTokenBucket(10, 2)
+	now := tb.last
+	for i := 0; i < 2; i++ {
+		if wait, ok := tb.take(now, 0); !ok || wait != 0 {
+			t.Fatalf("take %d within burst returned %v,%v", i, wait, ok)
+		}
+	}
+	if wait, ok := tb.take(now, 0); ok || wait != 100*time.Millisecond {
+		t.Errorf("take over burst returned %v,%v", wait, ok)
+	}
+	if wait, ok := tb.take(now, 200*time.Millisecond); !ok || wait != 100*time.Millisecond {
+		t.Errorf("delayed take returned %v,%v", wait, ok)
+	}
+	// the delayed take owes a token, a second refills 10 up to the burst
+	if wait, ok := tb.take(now.Add(time.Second), 0); !ok || wait != 0 {
+		t.Errorf("take after refill returned %v,%v", wait, ok)
+	}
+	if wait, ok := (*tokenBucket)(nil).take(now, 0); !ok || wait != 0 {
+		t.Errorf("unlimited bucket returned %v,%v", wait, ok)
+	}
+}
+
+func newTestRateLimiter(action string) *rateLimiter {
+	proxyCluster := newTestProxyCluster("ratelimit_cluster")
+	proxyCluster.Rate_limit = RateLimitRule{Read_qps: 1000, Write_qps: 1}
+	proxyCluster.Rate_limit_clients = []RateLimitRule{
+		{Cidr: "bad"},
+		{Cidr: "10.0.0.0/8", Read_qps: 1},
+	}
+	proxyCluster.Rate_limit_action = action
+	proxyCluster.Rate_limit_delay_ms = 2000
+	proxyCluster.Rate_limit_error = "ERR slow down"
+	return newRateLimiter(proxyCluster)
+}
+
+func Test_RateLimiterReject(t *testing.T) {
+	rl := newTestRateLimiter(RateLimitReject)
+	limited := rl.sessionBudgets(&fakeSession{addr: "10.1.2.3:50000"}, "")
+	other := rl.sessionBudgets(&fakeSession{addr: "192.168.0.1:50000"}, "")
+	if len(limited) != 2 || len(other) != 1 {
+		t.Fatalf("budgets %d and %d, want 2 and 1", len(limited), len(other))
+	}
+
+	get := &proxyRequest{cmd: "GET", budgets: limited}
+	if err := rl.Take(get); err != nil {
+		t.Fatalf("first GET rejected,%v", err)
+	}
+	err := rl.Take(get)
+	if err == nil || err.Error() != "ERR slow down" || commandOutcome(nil, err) != OutcomeRateLimited {
+		t.Fatalf("second GET returned %v", err)
+	}
+	// the cluster token of the rejected GET was given back
+	if tokens := limited[0].read.tokens; tokens < 999 {
+		t.Errorf("cluster read bucket has %v tokens", tokens)
+	}
+	if err := rl.Take(&proxyRequest{cmd: "GET", budgets: other}); err != nil {
+		t.Errorf("GET of another client rejected,%v", err)
+	}
+
+	if err := rl.Take(&proxyRequest{cmd: "SET", budgets: other}); err != nil {
+		t.Fatalf("first SET rejected,%v", err)
+	}
+	if err := rl.Take(&proxyRequest{cmd: "SET", budgets: limited}); err == nil {
+		t.Errorf("SET over the cluster write budget accepted")
+	}
+	if err := (*rateLimiter)(nil).Take(get); err != nil {
+		t.Errorf("nil limiter returned %v", err)
+	}
+}
+
+func Test_RateLimiterDelay(t *testing.T) {
+	proxyCluster := newTestProxyCluster("ratelimit_cluster")
+	proxyCluster.Rate_limit = RateLimitRule{Read_qps: 20, Burst: 1}
+	proxyCluster.Rate_limit_action = RateLimitDelay
+	proxyCluster.Rate_limit_delay_ms = 100
+	rl := newRateLimiter(proxyCluster)
+	req := &proxyRequest{cmd: "GET", budgets: rl.sessionBudgets(&fakeSession{addr: "10.1.2.3:50000"}, "")}
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := rl.Take(req); err != nil {
+			t.Fatalf("GET %d rejected,%v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("second GET delayed %v, want about 50ms", elapsed)
+	}
+	// commands of other sessions queue up until the delay would be over 100ms
+	bucket := req.budgets[0].read
+	bucket.take(time.Now(), time.Second)
+	bucket.take(time.Now(), time.Second)
+	if err := rl.Take(req); err == nil {
+		t.Errorf("GET over the longest delay accepted")
+	}
+}
+
+func Test_RateLimiterUsers(t *testing.T) {
+	proxyCluster := newTestProxyCluster("ratelimit_cluster")
+	proxyCluster.Rate_limit_users = []RateLimitRule{{User: "batch", Write_qps: 1}}
+	rl := newRateLimiter(proxyCluster)
+	session := &fakeSession{addr: "10.1.2.3:50000"}
+	if budgets := rl.sessionBudgets(session, ""); len(budgets) != 0 {
+		t.Fatalf("unauthenticated session charged to %d budgets", len(budgets))
+	}
+	budgets := rl.sessionBudgets(session, "batch")
+	if len(budgets) != 1 || budgets[0].scope != "user" {
+		t.Fatalf("batch user charged to %+v", budgets)
+	}
+}
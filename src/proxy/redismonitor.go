@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// lines buffered per MONITOR client, lines beyond it are dropped
+const monitorBufferSize = 1024
+
+// monitorHub streams the commands of a cluster to its MONITOR clients.
+type monitorHub struct {
+	cluster string
+
+	// number of subscribers, publishing is free while it is 0
+	count       int32
+	mu          sync.RWMutex
+	subscribers map[*monitorSubscriber]struct{}
+}
+
+type monitorSubscriber struct {
+	lines   chan string
+	dropped int64
+}
+
+func newMonitorHub(cluster string) *monitorHub {
+	return &monitorHub{cluster: cluster, subscribers: make(map[*monitorSubscriber]struct{})}
+}
+
+func (hub *monitorHub) subscribe() *monitorSubscriber {
+	sub := &monitorSubscriber{lines: make(chan string, monitorBufferSize)}
+	hub.mu.Lock()
+	hub.subscribers[sub] = struct{}{}
+	atomic.StoreInt32(&hub.count, int32(len(hub.subscribers)))
+	hub.mu.Unlock()
+	return sub
+}
+
+func (hub *monitorHub) unsubscribe(sub *monitorSubscriber) {
+	hub.mu.Lock()
+	delete(hub.subscribers, sub)
+	atomic.StoreInt32(&hub.count, int32(len(hub.subscribers)))
+	hub.mu.Unlock()
+}
+
+// Publish sends req to every subscriber without blocking, subscribers with a
+// full buffer miss the line.
+func (hub *monitorHub) Publish(session ClientSession, req *proxyRequest) {
+	if atomic.LoadInt32(&hub.count) == 0 {
+		return
+	}
+	line := formatMonitorLine(req.start, hub.cluster, session.RemoteAddr(), req.cmd, req.args)
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	for sub := range hub.subscribers {
+		select {
+		case sub.lines <- line:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+			GMonitor.RecordOne(hub.cluster + ".monitor_dropped")
+		}
+	}
+}
+
+// formatMonitorLine formats a command like redis MONITOR does, the cluster
+// takes the place of the db:
+//
+//	1339518083.107412 [item_cluster 127.0.0.1:60866] "SET" "key" "value"
+func formatMonitorLine(t time.Time, cluster string, client string, cmd string, args []interface{}) string {
+	var b strings.Builder
+	b.WriteString(strconv.FormatInt(t.Unix(), 10))
+	b.WriteByte('.')
+	micros := strconv.Itoa(t.Nanosecond() / 1000)
+	b.WriteString(strings.Repeat("0", 6-len(micros)))
+	b.WriteString(micros)
+	b.WriteString(" [")
+	b.WriteString(cluster)
+	b.WriteByte(' ')
+	b.WriteString(client)
+	b.WriteString("] ")
+	writeQuoted(&b, []byte(cmd))
+	for _, arg := range args {
+		b.WriteByte(' ')
+		p, _ := arg.([]byte)
+		writeQuoted(&b, p)
+	}
+	return b.String()
+}
+
+// writeQuoted quotes p the way redis sdscatrepr does.
+func writeQuoted(b *strings.Builder, p []byte) {
+	const hex = "0123456789abcdef"
+	b.WriteByte('"')
+	for _, c := range p {
+		switch c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case '\t':
+			b.WriteString("\\t")
+		case '\a':
+			b.WriteString("\\a")
+		case '\b':
+			b.WriteString("\\b")
+		default:
+			if c < 0x20 || c >= 0x7f {
+				b.WriteString("\\x")
+				b.WriteByte(hex[c>>4])
+				b.WriteByte(hex[c&0xf])
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+// serveMonitor turns session into a MONITOR session until the client quits
+// or disconnects.
+func serveMonitor(cp *clusterProxy, session ClientSession) {
+	// like redis, monitor clients are never closed for being idle
+	session.SetReadTimeout(0)
+	sub := cp.monitor.subscribe()
+	defer cp.monitor.unsubscribe(sub)
+	session.Response("OK", nil, "MONITOR")
+	log.Infof("monitor started,cluster=%s,remote=%s", cp.config.Cluster, session.RemoteAddr())
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			// like redis, commands other than QUIT are ignored by a monitor session
+			request, err := session.ParseRequest()
+			if err != nil || commandName(request[0].([]byte)) == "QUIT" {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case line := <-sub.lines:
+			session.Response(line, nil, "MONITOR")
+		case <-closed:
+			session.Close()
+			log.Infof("monitor stopped,cluster=%s,remote=%s,dropped=%d", cp.config.Cluster, session.RemoteAddr(), atomic.LoadInt64(&sub.dropped))
+			return
+		}
+	}
+}
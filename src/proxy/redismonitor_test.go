@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_FormatMonitorLine(t *testing.T) {
+	line := formatMonitorLine(time.Unix(1339518083, 7412000), "item_cluster", "127.0.0.1:60866",
+		"SET", []interface{}{[]byte("key"), []byte("a \"b\"\n\x01")})
+	want := `1339518083.007412 [item_cluster 127.0.0.1:60866] "SET" "key" "a \"b\"\n\x01"`
+	if line != want {
+		t.Errorf("line=%s\nwant=%s", line, want)
+	}
+}
+
+func Test_MonitorHubDropsOnOverflow(t *testing.T) {
+	hub := newMonitorHub("monitor_cluster")
+	session := &fakeSession{addr: "127.0.0.1:50000"}
+	req := &proxyRequest{cmd: "GET", args: []interface{}{[]byte("k")}, start: time.Now()}
+	hub.Publish(session, req)
+
+	sub := hub.subscribe()
+	for i := 0; i < monitorBufferSize+10; i++ {
+		hub.Publish(session, req)
+	}
+	if len(sub.lines) != monitorBufferSize || sub.dropped != 10 {
+		t.Errorf("buffered=%d,dropped=%d", len(sub.lines), sub.dropped)
+	}
+	hub.unsubscribe(sub)
+	if hub.count != 0 {
+		t.Errorf("%d subscribers left", hub.count)
+	}
+}
+
+func Test_ServeMonitor(t *testing.T) {
+	cp := newTestAdminCluster("monitor_cluster")
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		serveMonitor(cp, NewSession(server, -1, -1))
+		close(done)
+	}()
+
+	reader := bufio.NewReader(client)
+	if line, err := reader.ReadString('\n'); err != nil || line != "+OK\r\n" {
+		t.Fatalf("MONITOR answered %q,%v", line, err)
+	}
+	waitFor(t, time.Second, func() bool { return atomic.LoadInt32(&cp.monitor.count) == 1 })
+	req := &proxyRequest{cmd: "GET", args: []interface{}{[]byte("k")}, start: time.Unix(1, 0)}
+	cp.monitor.Publish(&fakeSession{addr: "10.0.0.2:1234"}, req)
+	if line, err := reader.ReadString('\n'); err != nil || line != "+1.000000 [monitor_cluster 10.0.0.2:1234] \"GET\" \"k\"\r\n" {
+		t.Fatalf("monitor line %q,%v", line, err)
+	}
+
+	client.Write([]byte("*1\r\n$4\r\nQUIT\r\n"))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("monitor session still running after QUIT")
+	}
+}
+
+func Test_MonitorForbidden(t *testing.T) {
+	SetCmdForbidden("MONITOR", true)
+	defer SetCmdForbidden("MONITOR", false)
+	cp := newTestAdminCluster("monitor_forbidden_cluster")
+	cp.config.Client_connections = 1
+	client, server := net.Pipe()
+	serveConn(cp, server)
+
+	go client.Write([]byte("*1\r\n$7\r\nMONITOR\r\n"))
+	if line, err := bufio.NewReader(client).ReadString('\n'); err != nil || line != "-proxy: unsupported cmd MONITOR\r\n" {
+		t.Fatalf("forbidden MONITOR answered %q,%v", line, err)
+	}
+	if n := atomic.LoadInt32(&cp.monitor.count); n != 0 {
+		t.Errorf("%d monitor subscribers", n)
+	}
+	// the session traces the refused MONITOR after answering it
+	client.Close()
+	waitFor(t, time.Second, func() bool { return atomic.LoadInt64(&cp.config.connections) == 0 })
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const (
+	RegistryNone      = "none"
+	RegistryFile      = "file"
+	RegistryZookeeper = "zookeeper"
+)
+
+// Registry publishes the proxy clusters, so clients are able to discover them.
+type Registry interface {
+	Register(proxyCluster *ProxyClusterConfig) error
+	Close()
+}
+
+func NewRegistry(config *ProxyConfig, zkConn *zk.Conn, zkEvents <-chan zk.Event) Registry {
+	switch config.Registry {
+	case RegistryZookeeper:
+		if zkConn == nil {
+			panic("zookeeper registry requires zookeeper_servers")
+		}
+		return NewZookeeperRegistrar(zkConn, zkEvents, config.Registry_root)
+	case RegistryFile:
+		return NewFileRegistry(config.Registry_file)
+	default:
+		log.Info("registry disabled")
+		return noopRegistry{}
+	}
+}
+
+type noopRegistry struct{}
+
+func (noopRegistry) Register(proxyCluster *ProxyClusterConfig) error {
+	return nil
+}
+
+func (noopRegistry) Close() {}
+
+// FileRegistry writes the metadata of all registered clusters into a json
+// endpoints file, it is rewritten periodically with the current load by a
+// single loop started with the first cluster.
+type FileRegistry struct {
+	path string
+
+	mu       sync.Mutex
+	clusters []*ProxyClusterConfig
+
+	refreshOnce sync.Once
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+func NewFileRegistry(path string) *FileRegistry {
+	return &FileRegistry{
+		path: path,
+		done: make(chan struct{}),
+	}
+}
+
+func (registry *FileRegistry) Register(proxyCluster *ProxyClusterConfig) error {
+	registry.mu.Lock()
+	registry.clusters = append(registry.clusters, proxyCluster)
+	registry.mu.Unlock()
+	if err := registry.write(); err != nil {
+		return err
+	}
+	log.Infof("registed into endpoints file,path=%s,cluster=%s", registry.path, proxyCluster.Cluster)
+	// register_interval is global, every cluster carries the same value
+	registry.refreshOnce.Do(func() {
+		go registry.refresh(time.Duration(proxyCluster.Register_interval) * time.Second)
+	})
+	return nil
+}
+
+func (registry *FileRegistry) Close() {
+	registry.closeOnce.Do(func() {
+		close(registry.done)
+	})
+}
+
+// refresh rewrites the file with every registered cluster once per interval.
+func (registry *FileRegistry) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-registry.done:
+			return
+		case <-ticker.C:
+		}
+		if err := registry.write(); err != nil {
+			log.Errorf("refresh endpoints file error,path=%s,error=%v", registry.path, err)
+		}
+	}
+}
+
+// write replaces the endpoints file atomically, readers never see a partial file.
+func (registry *FileRegistry) write() error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	endpoints := make([]*ProxyMetadata, 0, len(registry.clusters))
+	for _, proxyCluster := range registry.clusters {
+		endpoints = append(endpoints, NewProxyMetadata(proxyCluster))
+	}
+	data, err := json.MarshalIndent(endpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := registry.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, registry.path)
+}
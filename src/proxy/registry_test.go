@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_FileRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "endpoints.json")
+	registry := NewFileRegistry(path)
+	defer registry.Close()
+	registry.Register(newTestProxyCluster("item_cluster"))
+	registry.Register(newTestProxyCluster("user_cluster"))
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints := []*ProxyMetadata{}
+	if err := json.Unmarshal(data, &endpoints); err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 2 || endpoints[0].Cluster != "item_cluster" || endpoints[1].Cluster != "user_cluster" {
+		t.Errorf("unexpected endpoints %s", data)
+	}
+}
@@ -0,0 +1,473 @@
+package proxy
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cluster"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	ReadPreferenceMaster        = "master"
+	ReadPreferencePreferReplica = "prefer-replica"
+	ReadPreferenceReplicaOnly   = "replica-only"
+	ReadPreferenceNearest       = "nearest"
+)
+
+const topologyRefreshInterval = 5 * time.Second
+
+const slotCount = cluster.SlotCount
+
+type slotRange struct {
+	start    int
+	end      int
+	master   string
+	replicas []string
+}
+
+// replicaNode is a redis node with its measured health.
+type replicaNode struct {
+	addr string
+	// READONLY connections of a replica, nil for masters which are reached
+	// through the pools of the cluster client
+	pool *cluster.Pool
+	// ewma of the PING round trip in nanoseconds, 0 if the node is unreachable
+	latency int64
+	// replication lag in seconds as reported by the master, -1 if offline
+	lag int64
+	// atomic, redirections answered by the node
+	moved int64
+	ask   int64
+}
+
+// replicaRouter serves read only commands from replicas according to the
+// read_preference of the cluster, writes always go to the masters. The slot
+// map is the one of the cluster client, copied on every refresh.
+type replicaRouter struct {
+	proxyCluster *ProxyClusterConfig
+	// the current cluster client, nil if there is none
+	clusterOf func() *cluster.Cluster
+	// shared with the master side, replicas with an open breaker are skipped
+	breakers *nodeBreakers
+	// read timeout of the commands listed in command_timeouts
+	timeouts map[string]time.Duration
+
+	mu    sync.RWMutex
+	slots []slotRange
+	nodes map[string]*replicaNode
+	// last successful CLUSTER SLOTS load of the cluster client
+	refreshedAt time.Time
+
+	refreshing int32
+	done       chan struct{}
+}
+
+func newReplicaRouter(proxyCluster *ProxyClusterConfig, clusterOf func() *cluster.Cluster, breakers *nodeBreakers) *replicaRouter {
+	router := &replicaRouter{
+		proxyCluster: proxyCluster,
+		clusterOf:    clusterOf,
+		breakers:     breakers,
+		timeouts:     commandTimeouts(proxyCluster),
+		nodes:        make(map[string]*replicaNode),
+		done:         make(chan struct{}),
+	}
+	router.refresh()
+	go router.refreshLoop()
+	return router
+}
+
+// Do runs a read only command on a replica of the slot owning the first key,
+// master is used whenever no replica qualifies.
+func (router *replicaRouter) Do(master func() (interface{}, error), req *proxyRequest) (interface{}, error) {
+	cmd, args := req.cmd, req.args
+	slot, ok := commandSlot(cmd, args)
+	if !ok {
+		return master()
+	}
+	node, err := router.pick(slot)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return master()
+	}
+	if err := router.breakers.Allow(node.addr); err != nil {
+		GMonitor.RecordOne(router.proxyCluster.Cluster + ".replica_fallback")
+		return master()
+	}
+	reply, err := node.pool.DoStream(router.timeouts[cmd], cmd, args...)
+	router.breakers.Record(node.addr, err)
+	if err != nil {
+		log.Errorf("replica read error,node=%s,cmd=%s,error=%v", node.addr, cmd, err)
+		atomic.StoreInt64(&node.latency, 0)
+		GMonitor.RecordOne(router.proxyCluster.Cluster + ".replica_fallback")
+		return master()
+	}
+	if redisErr, ok := cluster.ReplyError(reply); ok && isRedirect(redisErr) {
+		// the slot is moving, the master side follows the redirection
+		if redirect := strings.SplitN(redisErr.Error(), " ", 2)[0]; redirect != "TRYAGAIN" {
+			router.recordRedirect(node.addr, redirect)
+		}
+		router.triggerRefresh()
+		GMonitor.RecordOne(router.proxyCluster.Cluster + ".replica_fallback")
+		return master()
+	}
+	GMonitor.RecordOne(router.proxyCluster.Cluster + ".replica")
+	req.node = node.addr
+	return reply, nil
+}
+
+// findSlot returns the range slot belongs to, mu must be held.
+func (router *replicaRouter) findSlot(slot int) (slotRange, bool) {
+	i := sort.Search(len(router.slots), func(i int) bool { return router.slots[i].end >= slot })
+	if i == len(router.slots) || router.slots[i].start > slot {
+		return slotRange{}, false
+	}
+	return router.slots[i], true
+}
+
+// pick returns the replica to read from, nil means the master.
+func (router *replicaRouter) pick(slot int) (*replicaNode, error) {
+	router.mu.RLock()
+	defer router.mu.RUnlock()
+	slotRange, ok := router.findSlot(slot)
+	if !ok {
+		return nil, nil
+	}
+
+	maxLag := int64(router.proxyCluster.Replica_max_lag)
+	candidates := make([]*replicaNode, 0, len(slotRange.replicas))
+	for _, addr := range slotRange.replicas {
+		node := router.nodes[addr]
+		lag := atomic.LoadInt64(&node.lag)
+		if node.pool != nil && lag >= 0 && lag <= maxLag && atomic.LoadInt64(&node.latency) > 0 {
+			candidates = append(candidates, node)
+		}
+	}
+
+	switch router.proxyCluster.Read_preference {
+	case ReadPreferenceReplicaOnly:
+		if len(slotRange.replicas) == 0 {
+			return nil, BackendDownError("no replica available for slot " + strconv.Itoa(slot))
+		}
+	case ReadPreferenceNearest:
+		var nearest *replicaNode
+		if master := router.nodes[slotRange.master]; master != nil && atomic.LoadInt64(&master.latency) > 0 {
+			nearest = master
+		}
+		for _, node := range candidates {
+			if nearest == nil || atomic.LoadInt64(&node.latency) < atomic.LoadInt64(&nearest.latency) {
+				nearest = node
+			}
+		}
+		if nearest == nil || nearest.addr == slotRange.master {
+			return nil, nil
+		}
+		return nearest, nil
+	}
+	if len(candidates) == 0 {
+		// every replica is stale or down, the master is always fresh
+		return nil, nil
+	}
+	return candidates[rand.Intn(len(candidates))], nil
+}
+
+// SlotRangeInfo is the admin api view of a slot range.
+type SlotRangeInfo struct {
+	Start    int      `json:"start"`
+	End      int      `json:"end"`
+	Master   string   `json:"master"`
+	Replicas []string `json:"replicas"`
+}
+
+// NodeHealth is what the router measured of a node, lag is -1 for masters
+// and offline replicas.
+type NodeHealth struct {
+	Addr      string  `json:"addr"`
+	Reachable bool    `json:"reachable"`
+	LatencyMs float64 `json:"latency_ms"`
+	Lag       int64   `json:"lag"`
+	Moved     int64   `json:"moved"`
+	Ask       int64   `json:"ask"`
+}
+
+// Topology returns the slot map and the health of every node as of the last refresh.
+func (router *replicaRouter) Topology() ([]SlotRangeInfo, []NodeHealth) {
+	router.mu.RLock()
+	defer router.mu.RUnlock()
+	slots := make([]SlotRangeInfo, 0, len(router.slots))
+	for _, slotRange := range router.slots {
+		slots = append(slots, SlotRangeInfo{
+			Start:    slotRange.start,
+			End:      slotRange.end,
+			Master:   slotRange.master,
+			Replicas: slotRange.replicas,
+		})
+	}
+	nodes := make([]NodeHealth, 0, len(router.nodes))
+	for _, node := range router.nodes {
+		latency := atomic.LoadInt64(&node.latency)
+		nodes = append(nodes, NodeHealth{
+			Addr:      node.addr,
+			Reachable: latency > 0,
+			LatencyMs: float64(latency) / float64(time.Millisecond),
+			Lag:       atomic.LoadInt64(&node.lag),
+			Moved:     atomic.LoadInt64(&node.moved),
+			Ask:       atomic.LoadInt64(&node.ask),
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Addr < nodes[j].Addr })
+	return slots, nodes
+}
+
+// reachable returns whether addr answered the last ping, known is false for a
+// node missing from the slot map of the last refresh.
+func (router *replicaRouter) reachable(addr string) (reachable bool, known bool) {
+	router.mu.RLock()
+	node := router.nodes[addr]
+	router.mu.RUnlock()
+	if node == nil {
+		return false, false
+	}
+	return atomic.LoadInt64(&node.latency) > 0, true
+}
+
+// RefreshedAt returns when the slot map was last loaded from CLUSTER SLOTS,
+// zero if it never was.
+func (router *replicaRouter) RefreshedAt() time.Time {
+	router.mu.RLock()
+	defer router.mu.RUnlock()
+	return router.refreshedAt
+}
+
+func (router *replicaRouter) Close() {
+	close(router.done)
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	for _, node := range router.nodes {
+		if node.pool != nil {
+			node.pool.Close()
+		}
+	}
+}
+
+func (router *replicaRouter) refreshLoop() {
+	ticker := time.NewTicker(topologyRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-router.done:
+			return
+		case <-ticker.C:
+			router.refresh()
+		}
+	}
+}
+
+func (router *replicaRouter) triggerRefresh() {
+	go router.refresh()
+}
+
+// refresh reloads the slot map from CLUSTER SLOTS, then measures the latency
+// of every node and the replication lag of every replica.
+func (router *replicaRouter) refresh() {
+	if !atomic.CompareAndSwapInt32(&router.refreshing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&router.refreshing, 0)
+
+	c := router.clusterOf()
+	if c == nil {
+		return
+	}
+	if err := c.Refresh(); err != nil {
+		log.Errorf("load cluster slots error,cluster=%s,error=%v", router.proxyCluster.Cluster, err)
+	}
+	slots := slotRangesOf(c.SlotRanges())
+	router.mu.Lock()
+	router.slots = slots
+	router.refreshedAt = c.RefreshedAt()
+	for _, slotRange := range slots {
+		if _, ok := router.nodes[slotRange.master]; !ok {
+			router.nodes[slotRange.master] = &replicaNode{addr: slotRange.master, lag: -1}
+		}
+		for _, addr := range slotRange.replicas {
+			// a master turned replica gets its READONLY connections
+			if node, ok := router.nodes[addr]; !ok || node.pool == nil {
+				router.nodes[addr] = router.newReplica(addr, node)
+			}
+		}
+	}
+	router.mu.Unlock()
+
+	router.mu.RLock()
+	slots = router.slots
+	nodes := make([]*replicaNode, 0, len(router.nodes))
+	for _, node := range router.nodes {
+		nodes = append(nodes, node)
+	}
+	router.mu.RUnlock()
+
+	for _, node := range nodes {
+		router.ping(node)
+	}
+	lags := make(map[string]int64)
+	for _, slotRange := range slots {
+		router.replicationLags(slotRange.master, lags)
+	}
+	for _, node := range nodes {
+		if lag, ok := lags[node.addr]; ok {
+			atomic.StoreInt64(&node.lag, lag)
+		} else {
+			atomic.StoreInt64(&node.lag, -1)
+		}
+	}
+}
+
+// newReplica returns a node with READONLY connections to addr, the redirect
+// counts of old are kept.
+func (router *replicaRouter) newReplica(addr string, old *replicaNode) *replicaNode {
+	pc := router.proxyCluster
+	node := &replicaNode{
+		addr: addr,
+		pool: cluster.NewPool(addr, pc.Pool_size, time.Duration(pc.Connect_timeout)*time.Millisecond,
+			time.Duration(pc.Read_timeout)*time.Millisecond, time.Duration(pc.Write_timeout)*time.Millisecond, "READONLY"),
+		lag: -1,
+	}
+	node.pool.LimitReplies(pc.Reply_max_bytes, pc.Reply_max_elements)
+	if old != nil {
+		node.moved, node.ask = atomic.LoadInt64(&old.moved), atomic.LoadInt64(&old.ask)
+	}
+	return node
+}
+
+// poolOf returns the READONLY connections of a replica, the connections of
+// the cluster client otherwise.
+func (router *replicaRouter) poolOf(node *replicaNode) *cluster.Pool {
+	if node.pool != nil {
+		return node.pool
+	}
+	c := router.clusterOf()
+	if c == nil {
+		return nil
+	}
+	pool, _ := c.Pool(node.addr)
+	return pool
+}
+
+func slotRangesOf(clusterSlots []cluster.SlotRange) []slotRange {
+	slots := make([]slotRange, 0, len(clusterSlots))
+	for _, s := range clusterSlots {
+		slots = append(slots, slotRange{start: s.Start, end: s.End, master: s.Master, replicas: s.Replicas})
+	}
+	return slots
+}
+
+// recordRedirect counts a MOVED or ASK answered by the node addr.
+func (router *replicaRouter) recordRedirect(addr string, redirect string) {
+	router.mu.RLock()
+	node := router.nodes[addr]
+	router.mu.RUnlock()
+	if node != nil {
+		if redirect == "ASK" {
+			atomic.AddInt64(&node.ask, 1)
+		} else {
+			atomic.AddInt64(&node.moved, 1)
+		}
+	}
+	GMonitor.RecordRedirect(router.proxyCluster.Cluster, addr, redirect)
+}
+
+func (router *replicaRouter) ping(node *replicaNode) {
+	pool := router.poolOf(node)
+	if pool == nil {
+		atomic.StoreInt64(&node.latency, 0)
+		return
+	}
+	begin := time.Now()
+	reply, err := pool.Do("PING")
+	if err != nil || reply != "PONG" {
+		atomic.StoreInt64(&node.latency, 0)
+		return
+	}
+	rt := int64(time.Since(begin))
+	GMonitor.RecordNodeLatency(router.proxyCluster.Cluster, node.addr, time.Duration(rt))
+	if old := atomic.LoadInt64(&node.latency); old > 0 {
+		rt = (old*7 + rt) / 8
+	}
+	atomic.StoreInt64(&node.latency, rt)
+}
+
+// replicationLags reads INFO replication of a master, every online replica is
+// listed as slaveN:ip=...,port=...,state=online,offset=...,lag=...
+func (router *replicaRouter) replicationLags(master string, lags map[string]int64) {
+	router.mu.RLock()
+	node := router.nodes[master]
+	router.mu.RUnlock()
+	if node == nil {
+		return
+	}
+	pool := router.poolOf(node)
+	if pool == nil {
+		return
+	}
+	reply, err := pool.Do("INFO", "replication")
+	info, ok := reply.([]byte)
+	if err != nil || !ok {
+		return
+	}
+	for _, line := range bytes.Split(info, []byte("\r\n")) {
+		if !bytes.HasPrefix(line, []byte("slave")) || bytes.IndexByte(line, ':') < 0 {
+			continue
+		}
+		fields := make(map[string]string)
+		for _, kv := range strings.Split(string(line[bytes.IndexByte(line, ':')+1:]), ",") {
+			if idx := strings.IndexByte(kv, '='); idx > 0 {
+				fields[kv[:idx]] = kv[idx+1:]
+			}
+		}
+		if fields["state"] != "online" {
+			continue
+		}
+		lag, err := strconv.ParseInt(fields["lag"], 10, 64)
+		if err != nil {
+			continue
+		}
+		lags[fields["ip"]+":"+fields["port"]] = lag
+	}
+}
+
+// commandSlot returns the slot of the keys of cmd, false if there is no key
+// or the keys live in different slots. Every key position of
+// commandKeyPositions is checked.
+func commandSlot(cmd string, args []interface{}) (int, bool) {
+	isKey := commandKeyPositions(cmd)
+	slot := -1
+	for i, arg := range args {
+		if !isKey(i) {
+			continue
+		}
+		key, ok := arg.([]byte)
+		if !ok {
+			return 0, false
+		}
+		if keySlot := cluster.Slot(key); slot < 0 {
+			slot = keySlot
+		} else if keySlot != slot {
+			return 0, false
+		}
+	}
+	return slot, slot >= 0
+}
+
+func isRedirect(redisErr cluster.Error) bool {
+	msg := redisErr.Error()
+	return strings.HasPrefix(msg, "MOVED ") || strings.HasPrefix(msg, "ASK ") || strings.HasPrefix(msg, "TRYAGAIN")
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"cluster"
+)
+
+func newTestReplicaRouter(preference string) *replicaRouter {
+	proxyCluster := newTestProxyCluster("item_cluster")
+	proxyCluster.Read_preference = preference
+	proxyCluster.Replica_max_lag = 10
+	router := &replicaRouter{
+		proxyCluster: proxyCluster,
+		nodes:        make(map[string]*replicaNode),
+		slots: []slotRange{
+			{start: 0, end: 8191, master: "m1:7000", replicas: []string{"r1:7000"}},
+			{start: 8192, end: 16383, master: "m2:7000"},
+		},
+	}
+	for _, addr := range []string{"m1:7000", "r1:7000", "m2:7000"} {
+		router.nodes[addr] = &replicaNode{addr: addr, latency: 1000, lag: 0}
+	}
+	router.nodes["r1:7000"].pool = cluster.NewPool("r1:7000", 1, time.Second, time.Second, time.Second, "READONLY")
+	return router
+}
+
+func Test_ReplicaRouterPick(t *testing.T) {
+	router := newTestReplicaRouter(ReadPreferencePreferReplica)
+	if node, _ := router.pick(100); node == nil || node.addr != "r1:7000" {
+		t.Errorf("prefer-replica must read from the replica, got %v", node)
+	}
+	if node, _ := router.pick(9000); node != nil {
+		t.Errorf("slot without replica must read from the master, got %v", node)
+	}
+
+	// staleness guard
+	router.nodes["r1:7000"].lag = 30
+	if node, _ := router.pick(100); node != nil {
+		t.Errorf("lagging replica must not be used, got %v", node)
+	}
+
+	router = newTestReplicaRouter(ReadPreferenceReplicaOnly)
+	if _, err := router.pick(9000); err == nil {
+		t.Error("replica-only must fail without replica")
+	}
+
+	router = newTestReplicaRouter(ReadPreferenceNearest)
+	router.nodes["r1:7000"].latency = 5000
+	if node, _ := router.pick(100); node != nil {
+		t.Errorf("nearest must choose the faster master, got %v", node)
+	}
+	router.nodes["r1:7000"].latency = 500
+	if node, _ := router.pick(100); node == nil || node.addr != "r1:7000" {
+		t.Errorf("nearest must choose the faster replica, got %v", node)
+	}
+}
+
+func Test_CommandSlot(t *testing.T) {
+	args := func(keys ...string) []interface{} {
+		result := make([]interface{}, 0, len(keys))
+		for _, key := range keys {
+			result = append(result, []byte(key))
+		}
+		return result
+	}
+	tagged := cluster.Slot([]byte("{user1}"))
+	for _, c := range []struct {
+		cmd  string
+		args []interface{}
+		slot int
+		ok   bool
+	}{
+		{"GET", args("{user1}.name"), tagged, true},
+		{"HSET", args("{user1}.profile", "other", "value"), tagged, true},
+		{"MGET", args("{user1}.a", "{user1}.b"), tagged, true},
+		{"MGET", args("a", "b"), 0, false},
+		{"DEL", args("{user1}.a", "{user1}.b"), tagged, true},
+		{"DEL", args("a", "b"), 0, false},
+		{"EXISTS", args("a", "b"), 0, false},
+		{"UNLINK", args("a", "b"), 0, false},
+		{"MSET", args("{user1}.a", "1", "{user1}.b", "2"), tagged, true},
+		{"MSET", args("a", "1", "b", "2"), 0, false},
+		{"SLOWLOG", args("GET"), 0, false},
+		{"GET", nil, 0, false},
+	} {
+		if slot, ok := commandSlot(c.cmd, c.args); ok != c.ok || (ok && slot != c.slot) {
+			t.Errorf("slot of %s %q is %d,%v", c.cmd, c.args, slot, ok)
+		}
+	}
+}
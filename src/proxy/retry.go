@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"cluster"
+)
+
+// retryPolicy sends idempotent commands again after transient backend errors.
+type retryPolicy struct {
+	cluster     string
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	// share of the backoff taken off at random
+	jitter float64
+}
+
+// newRetryPolicy returns nil if retry_max_attempts allows a single attempt.
+func newRetryPolicy(proxyCluster *ProxyClusterConfig) *retryPolicy {
+	if proxyCluster.Retry_max_attempts <= 1 {
+		return nil
+	}
+	return &retryPolicy{
+		cluster:     proxyCluster.Cluster,
+		maxAttempts: proxyCluster.Retry_max_attempts,
+		backoff:     time.Duration(proxyCluster.Retry_backoff_ms) * time.Millisecond,
+		maxBackoff:  time.Duration(proxyCluster.Retry_max_backoff_ms) * time.Millisecond,
+		jitter:      proxyCluster.Retry_jitter,
+	}
+}
+
+// Do runs do up to retry_max_attempts times while it fails transiently,
+// commands that are not idempotent run once whatever happens.
+func (rp *retryPolicy) Do(req *proxyRequest, do func() (interface{}, error)) (interface{}, error) {
+	reply, err := do()
+	if rp == nil || !isTransient(reply, err) || !IsCmdIdempotent(req.cmd, req.args) {
+		return reply, err
+	}
+	for attempt := 1; attempt < rp.maxAttempts && isTransient(reply, err); attempt++ {
+		time.Sleep(rp.delay(attempt))
+		GMonitor.RecordOne(rp.cluster + ".retry")
+		reply, err = do()
+	}
+	if isTransient(reply, err) {
+		GMonitor.RecordOne(rp.cluster + ".retry_exhausted")
+	}
+	return reply, err
+}
+
+// delay is the exponential backoff before the attempt+1th attempt.
+func (rp *retryPolicy) delay(attempt int) time.Duration {
+	d := rp.backoff << uint(attempt-1)
+	if d > rp.maxBackoff || d <= 0 {
+		d = rp.maxBackoff
+	}
+	return d - time.Duration(rand.Float64()*rp.jitter*float64(d))
+}
+
+// isTransient tells whether a backend call may succeed when sent again:
+// connections reset, refused or closed by the node, connect timeouts and the
+// TRYAGAIN, CLUSTERDOWN and LOADING replies. Anything else is not retried,
+// read and write timeouts would pile more load on a slow node.
+func isTransient(reply interface{}, err error) bool {
+	if err == nil {
+		redisErr, ok := cluster.ReplyError(reply)
+		if !ok {
+			return false
+		}
+		msg := redisErr.Error()
+		return strings.HasPrefix(msg, "TRYAGAIN") || strings.HasPrefix(msg, "CLUSTERDOWN") || strings.HasPrefix(msg, "LOADING")
+	}
+	switch e := err.(type) {
+	case TimeoutError:
+		return e.Op == "connect"
+	case *net.OpError:
+		if sysErr, ok := e.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.ECONNRESET || sysErr.Err == syscall.ECONNREFUSED || sysErr.Err == syscall.EPIPE
+		}
+		return false
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"cluster"
+)
+
+func newTestRetryPolicy(jitter float64) *retryPolicy {
+	proxyCluster := newTestProxyCluster("retry_cluster")
+	proxyCluster.Retry_max_attempts = 3
+	proxyCluster.Retry_backoff_ms = 1
+	proxyCluster.Retry_max_backoff_ms = 4
+	proxyCluster.Retry_jitter = jitter
+	return newRetryPolicy(proxyCluster)
+}
+
+// failing returns do failing with reply and err before it returns OK.
+func failing(calls *int, failures int, reply interface{}, err error) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		*calls++
+		if *calls <= failures {
+			return reply, err
+		}
+		return "OK", nil
+	}
+}
+
+func Test_RetryPolicy(t *testing.T) {
+	rp := newTestRetryPolicy(0.5)
+	tests := []struct {
+		cmd   string
+		args  []string
+		reply interface{}
+		err   error
+		calls int
+	}{
+		{"GET", []string{"k"}, cluster.Error("TRYAGAIN Multiple keys request during rehashing of slot"), nil, 3},
+		{"GET", []string{"k"}, cluster.Error("LOADING Redis is loading the dataset in memory"), nil, 3},
+		{"GET", []string{"k"}, nil, io.EOF, 3},
+		{"SET", []string{"k", "v"}, cluster.Error("CLUSTERDOWN The cluster is down"), nil, 3},
+		{"SET", []string{"k", "v", "GET"}, nil, io.EOF, 1},
+		{"INCR", []string{"k"}, nil, io.EOF, 1},
+		{"GET", []string{"k"}, cluster.Error("ERR wrong type"), nil, 1},
+		{"GET", []string{"k"}, nil, TimeoutError{Op: "read"}, 1},
+		{"GET", []string{"k"}, nil, TimeoutError{Op: "connect"}, 3},
+		{"GET", []string{"k"}, nil, BackendDownError("circuit breaker open"), 1},
+		{"GET", []string{"k"}, nil, cluster.ErrNoNode, 1},
+		{"GET", []string{"k"}, nil, errors.New("unknown"), 1},
+		{"GET", []string{"k"}, nil, &net.OpError{Op: "read", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}, 3},
+		{"GET", []string{"k"}, nil, &net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}, 3},
+		{"SET", []string{"k", "v", "EX", "10"}, nil, io.EOF, 3},
+		{"SET", []string{"k", "v", "nx"}, nil, io.EOF, 1},
+		{"SET", []string{"k", "v", "XX"}, nil, io.EOF, 1},
+		{"DEL", []string{"k"}, nil, io.EOF, 1},
+		{"SADD", []string{"k", "m"}, nil, io.EOF, 1},
+		{"HMSET", []string{"k", "f", "v"}, nil, io.EOF, 3},
+	}
+	for _, test := range tests {
+		req := slowRequest(test.cmd, 0, test.args...)
+		calls := 0
+		rp.Do(req, failing(&calls, 2, test.reply, test.err))
+		if calls != test.calls {
+			t.Errorf("%s %v failing with %v,%v ran %d times, want %d", test.cmd, test.args, test.reply, test.err, calls, test.calls)
+		}
+	}
+
+	calls := 0
+	if _, err := rp.Do(slowRequest("GET", 0, "k"), failing(&calls, 5, nil, io.EOF)); err != io.EOF || calls != 3 {
+		t.Errorf("exhausted retries returned %v after %d calls", err, calls)
+	}
+	calls = 0
+	(*retryPolicy)(nil).Do(slowRequest("GET", 0, "k"), failing(&calls, 2, nil, io.EOF))
+	if calls != 1 {
+		t.Errorf("nil policy ran %d times", calls)
+	}
+}
+
+func Test_RetryDelay(t *testing.T) {
+	rp := newTestRetryPolicy(0)
+	for attempt, want := range []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 4 * time.Millisecond} {
+		if d := rp.delay(attempt + 1); d != want {
+			t.Errorf("delay of attempt %d is %v, want %v", attempt+1, d, want)
+		}
+	}
+	rp.jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := rp.delay(1); d < 500*time.Microsecond || d > time.Millisecond {
+			t.Fatalf("jittered delay %v", d)
+		}
+	}
+}
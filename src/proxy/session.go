@@ -6,9 +6,10 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 	log "github.com/cihub/seelog"
-	"github.com/carlvine500/redis-go-cluster"
+	"cluster"
 	"util"
 )
 
@@ -16,77 +17,199 @@ type ClientSession interface {
 	ParseRequest() ([]interface{}, error)
 	Response(reply interface{}, err error, cmd string)
 	RemoteAddr() string
+	// RequestStart is when the first line of the last request was read.
+	RequestStart() time.Time
+	// BytesWritten is the number of bytes sent to the client so far.
+	BytesWritten() int64
+	// SetReadTimeout changes how long ParseRequest waits, 0 waits forever.
+	SetReadTimeout(timeout time.Duration)
+	// KeepRequest hands the buffer of the last request over to its arguments,
+	// they stay valid after the next ParseRequest.
+	KeepRequest()
 	Close() error
 }
 
+// NewSession wraps a client connection, requests are read and replies are
+// written within the timeouts in milliseconds, 0 or less waits forever.
 func NewSession(netConn net.Conn, readTimeout, writeTimeout int64) ClientSession {
-	//atomic.
-
-	return &clientSession{
-		conn:         netConn,
-		bufferWriter: bufio.NewWriter(netConn),
-		bufferReader: bufio.NewReader(netConn),
-		readTimeout:  time.Duration(readTimeout) * time.Millisecond,
-		writeTimeout: time.Duration(readTimeout) * time.Millisecond,
+	session := &clientSession{
+		conn:          netConn,
+		bufferReader:  bufio.NewReader(netConn),
+		readDeadline:  deadline{timeout: time.Duration(readTimeout) * time.Millisecond},
+		writeDeadline: deadline{timeout: time.Duration(writeTimeout) * time.Millisecond},
 	}
+	session.bufferWriter = bufio.NewWriter(&countingWriter{w: netConn, n: &session.bytesWritten})
+	return session
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	*cw.n += int64(n)
+	return n, err
 }
 
 type clientSession struct {
-	conn         net.Conn
-	readTimeout  time.Duration
-	bufferReader *bufio.Reader
-	writeTimeout time.Duration
-	bufferWriter *bufio.Writer
+	conn          net.Conn
+	bufferReader  *bufio.Reader
+	readDeadline  deadline
+	bufferWriter  *bufio.Writer
+	writeDeadline deadline
+	bytesWritten  int64
+	requestStart  time.Time
+	// request holds the last parsed request, taken from requestPool
+	request *request
+}
+
+const (
+	// requestBufferSize is the initial size of the buffer holding the arguments of a request.
+	requestBufferSize = 4 * 1024
+	// requestBufferMax is the largest buffer kept for the next request, a bigger one is dropped.
+	requestBufferMax = 64 * 1024
+)
+
+// request is the arguments of a request, they are slices of buf and only
+// valid until the next request of the session is parsed.
+type request struct {
+	buf  []byte
+	args []interface{}
+}
+
+var requestPool = sync.Pool{New: func() interface{} {
+	return &request{buf: make([]byte, 0, requestBufferSize), args: make([]interface{}, 0, 8)}
+}}
+
+func (req *request) reset() {
+	if cap(req.buf) > requestBufferMax {
+		req.buf = make([]byte, 0, requestBufferSize)
+	}
+	req.buf = req.buf[:0]
+	for i := range req.args {
+		req.args[i] = nil
+	}
+	req.args = req.args[:0]
+}
+
+// read appends the next n bytes of br to buf, the earlier arguments keep
+// pointing to the old buf when it grows.
+func (req *request) read(br *bufio.Reader, n int64) ([]byte, error) {
+	start := len(req.buf)
+	if int64(cap(req.buf)-start) < n {
+		size := 2 * cap(req.buf)
+		if int64(size) < n {
+			size = int(n)
+		}
+		req.buf = make([]byte, 0, size)
+		start = 0
+	}
+	req.buf = req.buf[:start+int(n)]
+	p := req.buf[start:len(req.buf):len(req.buf)]
+	_, err := io.ReadFull(br, p)
+	return p, err
 }
 
 func (clientConn *clientSession) RemoteAddr() string {
 	return clientConn.conn.RemoteAddr().String()
 }
 
+func (clientConn *clientSession) RequestStart() time.Time {
+	return clientConn.requestStart
+}
+
+func (clientConn *clientSession) BytesWritten() int64 {
+	return clientConn.bytesWritten
+}
+
 func (clientConn *clientSession) Close() error {
 	return clientConn.conn.Close()
 }
 
+func (clientConn *clientSession) KeepRequest() {
+	// the next request gets a new buffer from the pool
+	clientConn.request = nil
+}
+
+func (clientConn *clientSession) SetReadTimeout(timeout time.Duration) {
+	clientConn.readDeadline.reset(timeout, clientConn.conn.SetReadDeadline)
+}
+
+// ParseRequest reads the next request, its arguments are only valid until
+// the next call.
 func (clientConn *clientSession) ParseRequest() ([]interface{}, error) {
-	//bad performance
-	/*if clientConn.readTimeout > 0 {
-		clientConn.conn.SetReadDeadline(time.Now().Add(clientConn.readTimeout))
-	}*/
+	clientConn.readDeadline.refresh(clientConn.conn.SetReadDeadline)
 	line, err := readLine(clientConn.bufferReader)
 	if err != nil {
-		return nil, err
+		return nil, clientConn.release(err)
 	}
+	clientConn.requestStart = time.Now()
 
-	if line[0] != '*' {
-		return nil, ProtocolError(fmt.Sprintf("bad command %s ", string(line)))
+	if len(line) == 0 || line[0] != '*' {
+		return nil, clientConn.release(ProtocolError(fmt.Sprintf("bad command %s ", string(line))))
 	}
-	lineCount, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	lineCount, err := parseInt(line[1:])
 	if err != nil {
-		return nil, err
+		return nil, clientConn.release(err)
+	}
+	if lineCount < 1 {
+		return nil, clientConn.release(ProtocolError("empty command"))
 	}
 
-	results := make([]interface{}, lineCount)
-	for i := range results {
+	if clientConn.request == nil {
+		clientConn.request = requestPool.Get().(*request)
+	}
+	req := clientConn.request
+	req.reset()
+	for i := int64(0); i < lineCount; i++ {
 		line, err = readLine(clientConn.bufferReader)
-		if line[0] != '$' {
-			return nil, ProtocolError(fmt.Sprintf("redis: expected '$', but got %q", line))
+		if err != nil {
+			return nil, clientConn.release(err)
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, clientConn.release(ProtocolError(fmt.Sprintf("redis: expected '$', but got %q", line)))
 		}
 		argLen, err := parseInt(line[1:])
 		if err != nil {
-			return nil, err
+			return nil, clientConn.release(err)
 		}
-		p, err := readLen(clientConn.bufferReader, argLen)
+		if argLen < 0 {
+			return nil, clientConn.release(ProtocolError("bad bulk string length"))
+		}
+		p, err := req.read(clientConn.bufferReader, argLen)
 		if err != nil {
-			return nil, err
+			return nil, clientConn.release(err)
 		}
 		if line, err := readLine(clientConn.bufferReader); err != nil {
-			return nil, err
+			return nil, clientConn.release(err)
 		} else if len(line) != 0 {
-			return nil, ProtocolError("bad bulk string format")
+			return nil, clientConn.release(ProtocolError("bad bulk string format"))
 		}
-		results[i] = p
+		req.args = append(req.args, p)
+	}
+	return req.args, nil
+}
+
+// release puts the request buffer back to the pool once reading failed, the
+// session ends and nothing refers to the last request anymore.
+func (clientConn *clientSession) release(err error) error {
+	if clientConn.request != nil {
+		requestPool.Put(clientConn.request)
+		clientConn.request = nil
 	}
-	return results, nil
+	return err
+}
+
+// requestSize is the number of bytes request took on the wire.
+func requestSize(request []interface{}) int {
+	size := 1 + len(util.Itoa(len(request))) + 2
+	for _, arg := range request {
+		argLen := len(arg.([]byte))
+		size += 1 + len(util.Itoa(argLen)) + 2 + argLen + 2
+	}
+	return size
 }
 
 func readLine(br *bufio.Reader) ([]byte, error) {
@@ -105,12 +228,6 @@ func readLine(br *bufio.Reader) ([]byte, error) {
 	return p[:i], nil
 }
 
-func readLen(br *bufio.Reader, len int64) ([]byte, error) {
-	p := make([]byte, len)
-	_, err := io.ReadFull(br, p)
-	return p, err
-}
-
 func parseInt(p []byte) (int64, error) {
 	if len(p) == 0 {
 		return 0, ProtocolError("malformed integer")
@@ -138,13 +255,26 @@ func parseInt(p []byte) (int64, error) {
 }
 
 func (clientConn *clientSession)Response(reply interface{}, err error, cmd string) {
-	ParseReply(clientConn.bufferWriter, reply, err, cmd)
-	// bad performance
-	/*if clientConn.writeTimeout > 0 {
-		clientConn.conn.SetWriteDeadline(time.Now().Add(clientConn.writeTimeout))
-	}*/
-	if flushErr := clientConn.bufferWriter.Flush(); flushErr != nil {
-		log.Error(flushErr)
+	clientConn.writeDeadline.refresh(clientConn.conn.SetWriteDeadline)
+	var flushErr error
+	if stream, ok := reply.(*cluster.Stream); ok && err == nil {
+		// copied from the backend as it arrives, a backend failure cuts the reply too
+		_, flushErr = stream.WriteTo(clientConn.bufferWriter)
+	} else {
+		ParseReply(clientConn.bufferWriter, reply, err, cmd)
+	}
+	if flushErr == nil {
+		flushErr = clientConn.bufferWriter.Flush()
+	}
+	if flushErr != nil {
+		if netErr, ok := flushErr.(net.Error); ok && netErr.Timeout() {
+			GMonitor.RecordOne("client.write_timeout")
+			log.Warnf("client write timeout, remote:%v, timeout:%v", clientConn.RemoteAddr(), clientConn.writeDeadline.timeout)
+		} else {
+			log.Error(flushErr)
+		}
+		// the reply is cut, ParseRequest fails on the closed connection and ends the session
+		clientConn.conn.Close()
 	}
 }
 
@@ -154,16 +284,27 @@ func ParseReply(bw *bufio.Writer, reply interface{}, err error, cmd string) {
 		bw.WriteString(fmt.Sprintf("-%s\r\n", err.Error()))
 		return
 	}
+	if raw, ok := reply.(cluster.Raw); ok {
+		// passed through as the node sent it
+		bw.Write(raw)
+		return
+	}
+	if stream, ok := reply.(*cluster.Stream); ok {
+		// a failure cuts the reply, Response closes the connection then
+		stream.WriteTo(bw)
+		return
+	}
 	if reply == nil {
 		bw.Write([]byte("$-1\r\n"))
 		return
-	} else if redisErr, ok := reply.(redis.RedisError); ok {
+	} else if redisErr, ok := reply.(cluster.Error); ok {
 		bw.WriteString(fmt.Sprintf("-%s\r\n", redisErr.Error()))
 		return
 	}
 
 	switch cmd {
-	case "HMSET", //
+	case "AUTH", //
+		"HMSET", //
 		"LSET", //
 		"PING", //
 		"LTRIM", //
@@ -174,7 +315,8 @@ func ParseReply(bw *bufio.Writer, reply interface{}, err error, cmd string) {
 		"RESTORE", //
 		"SET", //
 		"SETEX", //
-		"TYPE":    //
+		"TYPE", //
+		"MONITOR": //
 		getStatusCodeReply(bw, reply)
 	case "HINCRBYFLOAT", //
 		"INCRBYFLOAT", //
@@ -299,6 +441,8 @@ func ParseReply(bw *bufio.Writer, reply interface{}, err error, cmd string) {
 		} else {
 			getBinaryMultiBulkReply(bw, reply)
 		}
+	case "SLOWLOG":
+		getNestedReply(bw, reply)
 	default:
 		bw.WriteString(fmt.Sprintf("-%s\r\n", "unSupported command=" + cmd))
 	}
@@ -342,6 +486,27 @@ func getBinaryMultiBulkReply(bw *bufio.Writer, reply interface{}) {
 	}
 }
 
+// getNestedReply writes arrays of any depth, the element types decide the reply types.
+func getNestedReply(bw *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case []interface{}:
+		bw.WriteByte('*')
+		bw.WriteString(util.Itoa(len(v)))
+		bw.WriteString("\r\n")
+		for _, item := range v {
+			getNestedReply(bw, item)
+		}
+	case int64:
+		getIntegerReply(bw, v)
+	case string:
+		getStatusCodeReply(bw, v)
+	case []byte:
+		getBinaryBulkReply(bw, v)
+	default:
+		bw.WriteString("$-1\r\n")
+	}
+}
+
 func getScanReply(bw *bufio.Writer, reply interface{}) {
 	bw.WriteByte('*')
 	bw.WriteByte('2')
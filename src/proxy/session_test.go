@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loopConn reads data over and over, writes are dropped.
+type loopConn struct {
+	net.Conn
+	data string
+	r    *strings.Reader
+}
+
+func newLoopConn(data string) *loopConn {
+	return &loopConn{data: data, r: strings.NewReader(data)}
+}
+
+func (c *loopConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err == io.EOF {
+		c.r.Reset(c.data)
+		return c.r.Read(p)
+	}
+	return n, err
+}
+
+func (c *loopConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c *loopConn) Close() error                       { return nil }
+func (c *loopConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *loopConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func Test_ParseRequest(t *testing.T) {
+	data := "*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\n" +
+		"*2\r\n$3\r\nGET\r\n$0\r\n\r\n" +
+		"*2\r\n$3\r\nGET\r\n$5000\r\n" + strings.Repeat("k", 5000) + "\r\n" +
+		"*0\r\n"
+	session := NewSession(newLoopConn(data), -1, -1)
+
+	request, err := session.ParseRequest()
+	if err != nil || len(request) != 3 || string(request[0].([]byte)) != "set" || string(request[2].([]byte)) != "value" {
+		t.Fatalf("parsed %q,%v", request, err)
+	}
+	request, err = session.ParseRequest()
+	if err != nil || len(request) != 2 || len(request[1].([]byte)) != 0 {
+		t.Fatalf("parsed %q,%v", request, err)
+	}
+	request, err = session.ParseRequest()
+	if err != nil || len(request[1].([]byte)) != 5000 || string(request[0].([]byte)) != "GET" {
+		t.Fatalf("parsed a big request as %d args,%v", len(request), err)
+	}
+	if _, err := session.ParseRequest(); commandOutcome(nil, err) != OutcomeProtocolError {
+		t.Errorf("empty request parsed,%v", err)
+	}
+}
+
+func Test_CommandName(t *testing.T) {
+	for name, want := range map[string]string{"get": "GET", "Set": "SET", " hgetall ": "HGETALL", "xunknown": "XUNKNOWN"} {
+		if cmd := commandName([]byte(name)); cmd != want {
+			t.Errorf("command name of %q is %q", name, cmd)
+		}
+	}
+	if allocs := testing.AllocsPerRun(100, func() { commandName([]byte("get")) }); allocs != 0 {
+		t.Errorf("known command looked up with %v allocations", allocs)
+	}
+}
+
+func BenchmarkParseRequest(b *testing.B) {
+	session := NewSession(newLoopConn("*3\r\n$3\r\nSET\r\n$10\r\nuser:10001\r\n$32\r\n"+strings.Repeat("v", 32)+"\r\n"), -1, -1)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := session.ParseRequest(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCommandName(b *testing.B) {
+	name := []byte("hgetall")
+	b.Run("lookup", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			commandName(name)
+		}
+	})
+	b.Run("toupper", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = strings.ToUpper(strings.TrimSpace(string(name)))
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	slowlogMaxArgs   = 32
+	slowlogMaxArgLen = 128
+)
+
+// SlowlogEntry is one command slower than the slowlog threshold, durations
+// are microseconds like the redis SLOWLOG.
+type SlowlogEntry struct {
+	Id        int64    `json:"id"`
+	Timestamp int64    `json:"timestamp"`
+	Client    string   `json:"client"`
+	Command   string   `json:"command"`
+	Args      []string `json:"args"`
+	Node      string   `json:"node"`
+	Duration  int64    `json:"duration"`
+	Parse     int64    `json:"parse"`
+	Backend   int64    `json:"backend"`
+	Write     int64    `json:"write"`
+}
+
+// slowlog keeps the latest slow commands of a cluster in a ring buffer.
+type slowlog struct {
+	cluster string
+	// time.Duration, updated atomically
+	threshold int64
+
+	mu      sync.Mutex
+	entries []SlowlogEntry
+	next    int
+	full    bool
+	nextId  int64
+}
+
+// slowlogLogger receives every slow command as json if slowlog_logger is configured.
+var slowlogLogger log.LoggerInterface
+
+// InitSlowlogLogger loads the dedicated seelog logger of the slow commands.
+func InitSlowlogLogger(configFile string) {
+	if configFile == "" {
+		return
+	}
+	logger, err := log.LoggerFromConfigAsFile(configFile)
+	if err != nil {
+		log.Errorf("err parsing slowlog logger config %s, %v", configFile, err)
+		return
+	}
+	slowlogLogger = logger
+}
+
+func newSlowlog(proxyCluster *ProxyClusterConfig) *slowlog {
+	sl := &slowlog{
+		cluster: proxyCluster.Cluster,
+		entries: make([]SlowlogEntry, proxyCluster.Slowlog_max_len),
+	}
+	sl.SetThreshold(proxyCluster.Slowlog_threshold_ms)
+	return sl
+}
+
+// SetThreshold changes the threshold at runtime, <= 0 disables the slowlog.
+func (sl *slowlog) SetThreshold(thresholdMs int) {
+	atomic.StoreInt64(&sl.threshold, int64(time.Duration(thresholdMs)*time.Millisecond))
+}
+
+// Record adds req if it took longer than the threshold, a threshold <= 0 disables the slowlog.
+func (sl *slowlog) Record(session ClientSession, req *proxyRequest) {
+	duration := req.parseTime + req.backendTime + req.writeTime
+	threshold := time.Duration(atomic.LoadInt64(&sl.threshold))
+	if threshold <= 0 || duration < threshold || len(sl.entries) == 0 {
+		return
+	}
+	entry := SlowlogEntry{
+		Timestamp: req.start.Unix(),
+		Client:    session.RemoteAddr(),
+		Command:   req.cmd,
+		Args:      slowlogArgs(req.args),
+		Node:      req.node,
+		Duration:  int64(duration / time.Microsecond),
+		Parse:     int64(req.parseTime / time.Microsecond),
+		Backend:   int64(req.backendTime / time.Microsecond),
+		Write:     int64(req.writeTime / time.Microsecond),
+	}
+	sl.mu.Lock()
+	entry.Id = sl.nextId
+	sl.nextId++
+	sl.entries[sl.next] = entry
+	sl.next = (sl.next + 1) % len(sl.entries)
+	if sl.next == 0 {
+		sl.full = true
+	}
+	sl.mu.Unlock()
+
+	if slowlogLogger != nil {
+		data, _ := json.Marshal(entry)
+		slowlogLogger.Infof("cluster=%s,%s", sl.cluster, data)
+	}
+}
+
+// slowlogArgs truncates the arguments the same way redis does.
+func slowlogArgs(args []interface{}) []string {
+	result := make([]string, 0, len(args))
+	for i, arg := range args {
+		if i == slowlogMaxArgs-1 && len(args) > slowlogMaxArgs {
+			result = append(result, "... ("+strconv.Itoa(len(args)-i)+" more arguments)")
+			break
+		}
+		p, _ := arg.([]byte)
+		if len(p) > slowlogMaxArgLen {
+			result = append(result, string(p[:slowlogMaxArgLen])+"... ("+strconv.Itoa(len(p)-slowlogMaxArgLen)+" more bytes)")
+		} else {
+			result = append(result, string(p))
+		}
+	}
+	return result
+}
+
+// Get returns the latest n entries, the newest first. n < 0 returns all of them.
+func (sl *slowlog) Get(n int) []SlowlogEntry {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	length := sl.len()
+	if n < 0 || n > length {
+		n = length
+	}
+	result := make([]SlowlogEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		result = append(result, sl.entries[(sl.next-i+len(sl.entries))%len(sl.entries)])
+	}
+	return result
+}
+
+func (sl *slowlog) Len() int {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return sl.len()
+}
+
+func (sl *slowlog) len() int {
+	if sl.full {
+		return len(sl.entries)
+	}
+	return sl.next
+}
+
+func (sl *slowlog) Reset() {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.next = 0
+	sl.full = false
+}
+
+// command serves SLOWLOG GET [n], SLOWLOG LEN and SLOWLOG RESET locally.
+func (sl *slowlog) command(args []interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, ProtocolError("wrong number of arguments for 'slowlog' command")
+	}
+	switch strings.ToUpper(string(args[0].([]byte))) {
+	case "GET":
+		n := 10
+		if len(args) > 1 {
+			var err error
+			if n, err = strconv.Atoi(string(args[1].([]byte))); err != nil {
+				return nil, ProtocolError("value is not an integer or out of range")
+			}
+		}
+		entries := sl.Get(n)
+		reply := make([]interface{}, 0, len(entries))
+		for _, entry := range entries {
+			cmdArgs := make([]interface{}, 0, len(entry.Args)+1)
+			cmdArgs = append(cmdArgs, []byte(entry.Command))
+			for _, arg := range entry.Args {
+				cmdArgs = append(cmdArgs, []byte(arg))
+			}
+			// the redis fields first, the proxy has no client names, the node
+			// comes after them where clients do not look
+			reply = append(reply, []interface{}{
+				entry.Id, entry.Timestamp, entry.Duration, cmdArgs, []byte(entry.Client), []byte(""), []byte(entry.Node),
+			})
+		}
+		return reply, nil
+	case "LEN":
+		return int64(sl.Len()), nil
+	case "RESET":
+		sl.Reset()
+		return "OK", nil
+	}
+	return nil, ProtocolError("unknown subcommand for 'slowlog' command")
+}
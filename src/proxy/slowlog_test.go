@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeSession struct {
+	ClientSession
+	addr string
+}
+
+func (session *fakeSession) RemoteAddr() string {
+	return session.addr
+}
+
+func newTestSlowlog(maxLen int) *slowlog {
+	proxyCluster := newTestProxyCluster("slowlog_cluster")
+	proxyCluster.Slowlog_threshold_ms = 10
+	proxyCluster.Slowlog_max_len = maxLen
+	return newSlowlog(proxyCluster)
+}
+
+func slowRequest(cmd string, backendTime time.Duration, args ...string) *proxyRequest {
+	req := &proxyRequest{cmd: cmd, start: time.Now(), node: "127.0.0.1:7000", backendTime: backendTime}
+	for _, arg := range args {
+		req.args = append(req.args, []byte(arg))
+	}
+	return req
+}
+
+func Test_Slowlog(t *testing.T) {
+	sl := newTestSlowlog(3)
+	session := &fakeSession{addr: "127.0.0.1:50000"}
+
+	sl.Record(session, slowRequest("GET", 5*time.Millisecond, "fast"))
+	if sl.Len() != 0 {
+		t.Fatalf("command below the threshold recorded, len=%d", sl.Len())
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		sl.Record(session, slowRequest("GET", 20*time.Millisecond, key))
+	}
+	if sl.Len() != 3 {
+		t.Fatalf("len=%d, want 3", sl.Len())
+	}
+	entries := sl.Get(-1)
+	for i, key := range []string{"d", "c", "b"} {
+		if entries[i].Args[0] != key {
+			t.Errorf("entry %d has key %s, want %s", i, entries[i].Args[0], key)
+		}
+	}
+	if entries[0].Id != 3 || entries[0].Duration != 20000 || entries[0].Backend != 20000 {
+		t.Errorf("unexpected entry %+v", entries[0])
+	}
+	if entries[0].Client != session.addr || entries[0].Node != "127.0.0.1:7000" {
+		t.Errorf("unexpected entry %+v", entries[0])
+	}
+	if got := len(sl.Get(2)); got != 2 {
+		t.Errorf("Get(2) returned %d entries", got)
+	}
+
+	reply, err := sl.command([]interface{}{[]byte("len")})
+	if err != nil || reply.(int64) != 3 {
+		t.Errorf("SLOWLOG LEN=%v,%v", reply, err)
+	}
+	reply, err = sl.command([]interface{}{[]byte("GET"), []byte("1")})
+	if err != nil || len(reply.([]interface{})) != 1 {
+		t.Fatalf("SLOWLOG GET 1=%v,%v", reply, err)
+	}
+	if fields := reply.([]interface{})[0].([]interface{}); len(fields) != 7 || string(fields[4].([]byte)) != session.addr ||
+		string(fields[5].([]byte)) != "" || string(fields[6].([]byte)) != "127.0.0.1:7000" {
+		t.Errorf("SLOWLOG GET entry=%v", fields)
+	}
+	if _, err = sl.command([]interface{}{[]byte("RESET")}); err != nil || sl.Len() != 0 {
+		t.Errorf("SLOWLOG RESET left %d entries,%v", sl.Len(), err)
+	}
+	if _, err = sl.command([]interface{}{[]byte("FOO")}); err == nil {
+		t.Error("unknown subcommand accepted")
+	}
+}
+
+func Test_SlowlogForbidden(t *testing.T) {
+	cp := newTestAdminCluster("slowlog_forbidden_cluster")
+	if reply, err := process(cp, slowRequest("SLOWLOG", 0, "LEN")); err != nil || reply.(int64) != 0 {
+		t.Fatalf("SLOWLOG LEN=%v,%v", reply, err)
+	}
+	SetCmdForbidden("SLOWLOG", true)
+	defer SetCmdForbidden("SLOWLOG", false)
+	if _, err := process(cp, slowRequest("SLOWLOG", 0, "LEN")); err == nil || err.Error() != "proxy: unsupported cmd SLOWLOG" {
+		t.Errorf("forbidden SLOWLOG returned %v", err)
+	}
+}
+
+func Test_SlowlogArgs(t *testing.T) {
+	args := make([]interface{}, 40)
+	for i := range args {
+		args[i] = []byte("v")
+	}
+	args[0] = []byte(strings.Repeat("x", 200))
+	result := slowlogArgs(args)
+	if len(result) != slowlogMaxArgs {
+		t.Fatalf("%d args kept, want %d", len(result), slowlogMaxArgs)
+	}
+	if result[0] != strings.Repeat("x", 128)+"... (72 more bytes)" {
+		t.Errorf("long arg truncated to %s", result[0])
+	}
+	if result[slowlogMaxArgs-1] != "... (9 more arguments)" {
+		t.Errorf("last arg is %s", result[slowlogMaxArgs-1])
+	}
+}
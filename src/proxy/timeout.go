@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// commandCategories are the categories command_timeouts accepts besides
+// command names.
+var commandCategories = map[string][]string{
+	"blocking": {"BLPOP", "BRPOP", "BRPOPLPUSH", "BLMOVE", "BZPOPMIN", "BZPOPMAX", "XREAD", "XREADGROUP", "WAIT"},
+	"range": {"LRANGE", "ZRANGE", "ZREVRANGE", "ZRANGEBYSCORE", "ZREVRANGEBYSCORE", "ZRANGEBYLEX", "ZREVRANGEBYLEX",
+		"SMEMBERS", "SUNION", "SINTER", "SDIFF", "SUNIONSTORE", "SINTERSTORE", "SDIFFSTORE",
+		"HGETALL", "HKEYS", "HVALS", "XRANGE", "XREVRANGE", "MGET", "SORT"},
+}
+
+// commandTimeouts resolves command_timeouts into the read timeout of every
+// command, command names take precedence over categories.
+func commandTimeouts(proxyCluster *ProxyClusterConfig) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	for name, ms := range proxyCluster.Command_timeouts {
+		if cmds, ok := commandCategories[strings.ToLower(name)]; ok {
+			for _, cmd := range cmds {
+				timeouts[cmd] = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	for name, ms := range proxyCluster.Command_timeouts {
+		if _, ok := commandCategories[strings.ToLower(name)]; ok {
+			continue
+		}
+		timeouts[strings.ToUpper(name)] = time.Duration(ms) * time.Millisecond
+	}
+	return timeouts
+}
+
+// TimeoutError is a backend call that ran out of time, op is connect, read
+// or write.
+type TimeoutError struct {
+	Op    string
+	Node  string
+	After time.Duration
+}
+
+func (te TimeoutError) Error() string {
+	msg := "proxy: " + te.Op + " timeout"
+	if te.After > 0 {
+		msg += " after " + te.After.String()
+	}
+	if te.Node != "" {
+		msg += " on node " + te.Node
+	}
+	return msg
+}
+
+func (te TimeoutError) Timeout() bool   { return true }
+func (te TimeoutError) Temporary() bool { return true }
+
+// asTimeoutError turns the net timeouts of a backend call into a
+// TimeoutError, other errors are returned as is.
+func asTimeoutError(err error, node string, connectTimeout, readTimeout, writeTimeout time.Duration) error {
+	netErr, ok := err.(net.Error)
+	if !ok || !netErr.Timeout() {
+		return err
+	}
+	te := TimeoutError{Op: "read", Node: node, After: readTimeout}
+	if opErr, ok := err.(*net.OpError); ok {
+		switch opErr.Op {
+		case "dial":
+			te.Op, te.After = "connect", connectTimeout
+		case "write":
+			te.Op, te.After = "write", writeTimeout
+		}
+	}
+	return te
+}
+
+// deadline moves a connection deadline forward only once an eighth of its
+// timeout has passed instead of on every call, setting it is not free. The
+// connection times out after 7/8 to 8/8 of the timeout.
+type deadline struct {
+	timeout time.Duration
+	at      time.Time
+}
+
+func (d *deadline) refresh(set func(time.Time) error) {
+	if d.timeout <= 0 {
+		return
+	}
+	now := time.Now()
+	if d.at.Sub(now) > d.timeout-d.timeout/8 {
+		return
+	}
+	d.at = now.Add(d.timeout)
+	set(d.at)
+}
+
+func (d *deadline) reset(timeout time.Duration, set func(time.Time) error) {
+	d.timeout = timeout
+	d.at = time.Time{}
+	set(d.at)
+}
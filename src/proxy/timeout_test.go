@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_CommandTimeouts(t *testing.T) {
+	proxyCluster := newTestProxyCluster("timeout_cluster")
+	proxyCluster.Command_timeouts = map[string]int{"blocking": 30000, "range": 500, "lrange": 1000}
+	timeouts := commandTimeouts(proxyCluster)
+	if timeouts["BLPOP"] != 30*time.Second || timeouts["ZRANGE"] != 500*time.Millisecond {
+		t.Errorf("category timeouts %v", timeouts)
+	}
+	if timeouts["LRANGE"] != time.Second {
+		t.Errorf("command timeout of LRANGE %v, want it to override its category", timeouts["LRANGE"])
+	}
+	if _, ok := timeouts["GET"]; ok {
+		t.Error("GET got a command timeout")
+	}
+}
+
+func Test_AsTimeoutError(t *testing.T) {
+	timeout := &net.OpError{Op: "dial", Net: "tcp", Err: &timeoutErr{}}
+	err := asTimeoutError(timeout, "10.0.0.1:7000", time.Second, 2*time.Second, 3*time.Second)
+	if err.Error() != "proxy: connect timeout after 1s on node 10.0.0.1:7000" || commandOutcome(nil, err) != OutcomeConnectTimeout {
+		t.Errorf("dial timeout became %v", err)
+	}
+	timeout.Op = "read"
+	if err := asTimeoutError(timeout, "", time.Second, 2*time.Second, 3*time.Second); commandOutcome(nil, err) != OutcomeReadTimeout {
+		t.Errorf("read timeout became %v", err)
+	}
+	timeout.Op = "write"
+	if err := asTimeoutError(timeout, "", time.Second, 2*time.Second, 3*time.Second); commandOutcome(nil, err) != OutcomeWriteTimeout {
+		t.Errorf("write timeout became %v", err)
+	}
+	refused := errors.New("connection refused")
+	if err := asTimeoutError(refused, "", time.Second, time.Second, time.Second); err != refused {
+		t.Errorf("other error became %v", err)
+	}
+}
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func Test_SessionWriteTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	session := NewSession(server, -1, 50)
+
+	// nobody reads the reply
+	session.Response("OK", nil, "SET")
+	if _, err := bufio.NewReader(client).ReadString('\n'); err == nil {
+		t.Error("session still open after a write timeout")
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "redis-proxy"
+
+// nil while tracing is disabled, requests are not traced at all then
+var tracer trace.Tracer
+
+// stopTracing flushes the spans not exported yet, called on drain.
+var stopTracing = func() {}
+
+// InitTracing exports sampled command spans over OTLP/gRPC to tracing_endpoint.
+func InitTracing(config *ProxyConfig) {
+	if config.Tracing_endpoint == "" {
+		return
+	}
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(config.Tracing_endpoint)}
+	if config.Tracing_insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(context.Background(), opts...)
+	if err != nil {
+		log.Errorf("create otlp exporter error,endpoint=%s,error=%v", config.Tracing_endpoint, err)
+		return
+	}
+	provider := newTracerProvider(config.Tracing_sample_rate, sdktrace.WithBatcher(exporter))
+	tracer = provider.Tracer(tracerName)
+	log.Infof("tracing started,endpoint=%s,sampleRate=%v", config.Tracing_endpoint, config.Tracing_sample_rate)
+	stopTracing = func() {
+		if err := provider.Shutdown(context.Background()); err != nil {
+			log.Errorf("stop tracing error,%v", err)
+		}
+	}
+}
+
+func newTracerProvider(sampleRate float64, exporter sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		exporter,
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRate))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", tracerName))),
+	)
+}
+
+// traceRequest records the spans of a finished request from its timings:
+//
+//	redis.command
+//	├── parse    reading the request from the client
+//	├── route    everything before the backend call
+//	├── backend  the backend call, with node and slot
+//	└── write    writing the reply to the client
+func traceRequest(cluster string, session ClientSession, req *proxyRequest, outcome string) {
+	if tracer == nil {
+		return
+	}
+	parsed := req.start.Add(req.parseTime)
+	backendStart := parsed.Add(req.routeTime)
+	backendEnd := parsed.Add(req.backendTime)
+	end := backendEnd.Add(req.writeTime)
+
+	ctx, root := tracer.Start(context.Background(), "redis.command",
+		trace.WithTimestamp(req.start),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("db.system", "redis"),
+			attribute.String("db.operation", req.cmd),
+			attribute.String("proxy.cluster", cluster),
+		))
+	if !root.IsRecording() {
+		root.End(trace.WithTimestamp(end))
+		return
+	}
+	root.SetAttributes(
+		attribute.String("net.peer.name", session.RemoteAddr()),
+		attribute.String("proxy.outcome", outcome),
+	)
+	if outcome != OutcomeOk {
+		root.SetStatus(codes.Error, outcome)
+	}
+
+	childSpan(ctx, "parse", req.start, parsed)
+	childSpan(ctx, "route", parsed, backendStart)
+	backendAttrs := []attribute.KeyValue{attribute.String("net.peer.name", req.node)}
+	if slot, ok := commandSlot(req.cmd, req.args); ok {
+		backendAttrs = append(backendAttrs, attribute.Int("redis.slot", slot))
+	}
+	childSpan(ctx, "backend", backendStart, backendEnd, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(backendAttrs...))
+	childSpan(ctx, "write", backendEnd, end)
+	root.End(trace.WithTimestamp(end))
+}
+
+func childSpan(ctx context.Context, name string, start time.Time, end time.Time, opts ...trace.SpanStartOption) {
+	_, span := tracer.Start(ctx, name, append(opts, trace.WithTimestamp(start))...)
+	span.End(trace.WithTimestamp(end))
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func useTestTracer(t *testing.T, sampleRate float64) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	tracer = newTracerProvider(sampleRate, sdktrace.WithSyncer(exporter)).Tracer(tracerName)
+	t.Cleanup(func() { tracer = nil })
+	return exporter
+}
+
+func Test_TraceRequest(t *testing.T) {
+	exporter := useTestTracer(t, 1)
+	req := slowRequest("GET", 3*time.Millisecond, "key")
+	req.parseTime = time.Millisecond
+	req.routeTime = time.Millisecond
+	req.writeTime = 2 * time.Millisecond
+	traceRequest("trace_cluster", &fakeSession{addr: "127.0.0.1:50000"}, req, OutcomeOk)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 5 {
+		t.Fatalf("got %d spans, want 5", len(spans))
+	}
+	byName := make(map[string]tracetest.SpanStub)
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	root := byName["redis.command"]
+	if !root.StartTime.Equal(req.start) || root.EndTime.Sub(root.StartTime) != 6*time.Millisecond {
+		t.Errorf("root span from %v to %v", root.StartTime, root.EndTime)
+	}
+	parsed := req.start.Add(time.Millisecond)
+	want := map[string][2]time.Time{
+		"parse":   {req.start, parsed},
+		"route":   {parsed, parsed.Add(time.Millisecond)},
+		"backend": {parsed.Add(time.Millisecond), parsed.Add(3 * time.Millisecond)},
+		"write":   {parsed.Add(3 * time.Millisecond), parsed.Add(5 * time.Millisecond)},
+	}
+	for name, times := range want {
+		span, ok := byName[name]
+		if !ok {
+			t.Errorf("span %s missing", name)
+			continue
+		}
+		if span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("span %s is not a child of the command span", name)
+		}
+		if !span.StartTime.Equal(times[0]) || !span.EndTime.Equal(times[1]) {
+			t.Errorf("span %s from %v to %v, want %v to %v", name, span.StartTime, span.EndTime, times[0], times[1])
+		}
+	}
+
+	attrs := make(map[string]string)
+	for _, kv := range byName["backend"].Attributes {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["net.peer.name"] != "127.0.0.1:7000" || attrs["redis.slot"] != "12539" {
+		t.Errorf("unexpected backend attributes %v", attrs)
+	}
+}
+
+func Test_TraceRequestSampling(t *testing.T) {
+	exporter := useTestTracer(t, 0)
+	traceRequest("trace_cluster", &fakeSession{addr: "127.0.0.1:50000"}, slowRequest("GET", time.Millisecond, "key"), OutcomeOk)
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Errorf("sample rate 0 exported %d spans", len(spans))
+	}
+
+	tracer = nil
+	traceRequest("trace_cluster", &fakeSession{addr: "127.0.0.1:50000"}, slowRequest("GET", time.Millisecond, "key"), OutcomeOk)
+}
@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// zkClient is the part of *zk.Conn used by the registrar.
+type zkClient interface {
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Exists(path string) (bool, *zk.Stat, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+	Close()
+}
+
+// RegistrationState is a snapshot of the zookeeper registration, the session
+// state and the registered flag of every cluster are exported as gauges too.
+type RegistrationState struct {
+	SessionState    string   `json:"session_state"`
+	Registered      []string `json:"registered"`
+	Expirations     int64    `json:"expirations"`
+	Reregistrations int64    `json:"reregistrations"`
+}
+
+// ZookeeperRegistrar is the zookeeper Registry, it keeps the ephemeral node of every proxy cluster alive,
+// the nodes are created again after the zookeeper session expired.
+type ZookeeperRegistrar struct {
+	conn zkClient
+	root string
+
+	mu              sync.Mutex
+	clusters        []*ProxyClusterConfig
+	registered      map[string]bool
+	state           zk.State
+	expirations     int64
+	reregistrations int64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewZookeeperRegistrar(conn zkClient, events <-chan zk.Event, root string) *ZookeeperRegistrar {
+	registrar := &ZookeeperRegistrar{
+		conn:       conn,
+		root:       strings.TrimRight(root, "/"),
+		registered: make(map[string]bool),
+		state:      zk.StateUnknown,
+		done:       make(chan struct{}),
+	}
+	if events != nil {
+		go registrar.watch(events)
+	}
+	return registrar
+}
+
+// Register creates the node of proxyCluster and keeps its data fresh.
+func (registrar *ZookeeperRegistrar) Register(proxyCluster *ProxyClusterConfig) error {
+	if err := registrar.registerIntoZookeeper(proxyCluster); err != nil {
+		return err
+	}
+	registrar.mu.Lock()
+	registrar.clusters = append(registrar.clusters, proxyCluster)
+	registrar.mu.Unlock()
+	go registrar.refresh(proxyCluster)
+	return nil
+}
+
+func (registrar *ZookeeperRegistrar) Close() {
+	registrar.closeOnce.Do(func() {
+		close(registrar.done)
+		registrar.conn.Close()
+	})
+}
+
+func (registrar *ZookeeperRegistrar) State() RegistrationState {
+	registrar.mu.Lock()
+	defer registrar.mu.Unlock()
+	state := RegistrationState{
+		SessionState:    registrar.state.String(),
+		Registered:      []string{},
+		Expirations:     registrar.expirations,
+		Reregistrations: registrar.reregistrations,
+	}
+	for _, proxyCluster := range registrar.clusters {
+		if registrar.registered[proxyCluster.Cluster] {
+			state.Registered = append(state.Registered, proxyCluster.Cluster)
+		}
+	}
+	return state
+}
+
+// watch follows the session events, ephemeral nodes vanish with an expired
+// session so all clusters are registered again once a new session is established.
+func (registrar *ZookeeperRegistrar) watch(events <-chan zk.Event) {
+	for event := range events {
+		if event.Type != zk.EventSession {
+			continue
+		}
+		registrar.mu.Lock()
+		registrar.state = event.State
+		if event.State == zk.StateExpired {
+			registrar.expirations++
+			registrar.registered = make(map[string]bool)
+		}
+		clusters := append([]*ProxyClusterConfig{}, registrar.clusters...)
+		registrar.mu.Unlock()
+		GMonitor.RecordZookeeperState(event.State)
+
+		switch event.State {
+		case zk.StateExpired:
+			log.Errorf("zookeeper session expired, proxy nodes will be registered again")
+			GMonitor.RecordOne("zookeeper.expired")
+			for _, proxyCluster := range clusters {
+				GMonitor.RecordRegistration(proxyCluster.Cluster, false)
+			}
+		case zk.StateDisconnected:
+			log.Errorf("zookeeper disconnected,server=%s", event.Server)
+		case zk.StateHasSession:
+			log.Infof("zookeeper session established,server=%s", event.Server)
+			for _, proxyCluster := range clusters {
+				registrar.reregister(proxyCluster)
+			}
+		}
+	}
+}
+
+func (registrar *ZookeeperRegistrar) reregister(proxyCluster *ProxyClusterConfig) {
+	registrar.mu.Lock()
+	registered := registrar.registered[proxyCluster.Cluster]
+	registrar.mu.Unlock()
+	if registered {
+		return
+	}
+	if err := registrar.registerIntoZookeeper(proxyCluster); err != nil {
+		log.Errorf("register into zookeeper again failed,cluster=%s,error=%v", proxyCluster.Cluster, err)
+		return
+	}
+	registrar.mu.Lock()
+	registrar.reregistrations++
+	registrar.mu.Unlock()
+	GMonitor.RecordOne("zookeeper.reregistered")
+}
+
+func (registrar *ZookeeperRegistrar) registerIntoZookeeper(proxyCluster *ProxyClusterConfig) error {
+	proxyClusterPath := registrar.root + "/" + proxyCluster.Cluster
+	if err := ensureExsists(registrar.conn, proxyClusterPath); err != nil {
+		return err
+	}
+
+	serverPath := registrar.serverPath(proxyCluster)
+	_, err := registrar.conn.Create(serverPath, NewProxyMetadata(proxyCluster).Bytes(), int32(zk.FlagEphemeral), zk.WorldACL(zk.PermAll))
+	if err != nil && err != zk.ErrNodeExists {
+		return err
+	}
+	registrar.mu.Lock()
+	registrar.registered[proxyCluster.Cluster] = true
+	registrar.mu.Unlock()
+	GMonitor.RecordRegistration(proxyCluster.Cluster, true)
+	log.Infof("registed into zookeeper,path=%s", serverPath)
+	return nil
+}
+
+// refresh the node data, so clients always see the current load of this proxy.
+func (registrar *ZookeeperRegistrar) refresh(proxyCluster *ProxyClusterConfig) {
+	ticker := time.NewTicker(time.Duration(proxyCluster.Register_interval) * time.Second)
+	defer ticker.Stop()
+	serverPath := registrar.serverPath(proxyCluster)
+	for {
+		select {
+		case <-registrar.done:
+			return
+		case <-ticker.C:
+		}
+		_, err := registrar.conn.Set(serverPath, NewProxyMetadata(proxyCluster).Bytes(), -1)
+		switch err {
+		case nil:
+		case zk.ErrClosing:
+			return
+		case zk.ErrNoNode:
+			// the session was lost without us noticing it
+			registrar.mu.Lock()
+			delete(registrar.registered, proxyCluster.Cluster)
+			registrar.mu.Unlock()
+			GMonitor.RecordRegistration(proxyCluster.Cluster, false)
+			registrar.reregister(proxyCluster)
+		default:
+			log.Errorf("refresh zookeeper registration error,path=%s,error=%v", serverPath, err)
+		}
+	}
+}
+
+func (registrar *ZookeeperRegistrar) serverPath(proxyCluster *ProxyClusterConfig) string {
+	return registrar.root + "/" + proxyCluster.Cluster + "/" + proxyCluster.Advertise
+}
+
+func ensureExsists(zkConn zkClient, path string) error {
+	pathArr := strings.Split(path, "/")
+	existsPathDepth := 1
+	for i := len(pathArr); i > 1; i-- {
+		tmpPath := strings.Join(pathArr[0:i], "/")
+		exist, _, err := zkConn.Exists(tmpPath)
+		if err != nil {
+			return err
+		}
+		if exist {
+			existsPathDepth = i
+			break
+		}
+	}
+	for i := existsPathDepth + 1; i < len(pathArr)+1; i++ {
+		tmpPath := strings.Join(pathArr[0:i], "/")
+		_, err := zkConn.Create(tmpPath, []byte{}, int32(0), zk.WorldACL(zk.PermAll))
+		if err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+func ConnectZookeeper(servers []string) (*zk.Conn, <-chan zk.Event) {
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	log.Info("connect Zookeeper started!")
+	conn, events, err := zk.Connect(servers, 60*time.Second)
+	Must(err)
+	log.Info("connect Zookeeper end!")
+	return conn, events
+}
+
+// zkChildrenWatcher is the part of *zk.Conn used to follow the backend servers.
+type zkChildrenWatcher interface {
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+}
+
+// watchServers calls onChange with the children of path, every child is a
+// host:port of the redis cluster, and again whenever the children change.
+func watchServers(conn zkChildrenWatcher, path string, onChange func(servers []string)) {
+	for {
+		servers, _, events, err := conn.ChildrenW(path)
+		if err == zk.ErrClosing {
+			return
+		}
+		if err != nil {
+			log.Errorf("watch servers error,path=%s,error=%v", path, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if len(servers) > 0 {
+			onChange(servers)
+		} else {
+			log.Errorf("no servers under %s, keep the current ones", path)
+		}
+		event := <-events
+		if event.Err == zk.ErrClosing {
+			return
+		}
+	}
+}
@@ -0,0 +1,568 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// zkServer is a zookeeper server in process. It speaks the client protocol
+// for the requests the registrar and watchServers send, keeps the node tree
+// in memory and expires sessions like a real server.
+type zkServer struct {
+	ln net.Listener
+
+	mu          sync.Mutex
+	zxid        int64
+	nodes       map[string]*zkNode
+	sessions    map[int64]*zkSession
+	lastSession int64
+}
+
+type zkNode struct {
+	data []byte
+	// session of an ephemeral node, 0 otherwise
+	owner int64
+}
+
+type zkSession struct {
+	id   int64
+	conn net.Conn
+	// paths whose children the session watches
+	childWatches map[string]bool
+}
+
+// opcodes and error codes of the zookeeper client protocol
+const (
+	zkOpCreate       = 1
+	zkOpDelete       = 2
+	zkOpExists       = 3
+	zkOpSetData      = 5
+	zkOpPing         = 11
+	zkOpGetChildren2 = 12
+	zkOpClose        = -11
+	zkOpSetWatches   = 101
+
+	zkErrUnimplemented = -6
+	zkErrNoNode        = -101
+	zkErrNodeExists    = -110
+)
+
+func startZkServer(t *testing.T) *zkServer {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &zkServer{
+		ln:       ln,
+		nodes:    map[string]*zkNode{"/": {}},
+		sessions: make(map[int64]*zkSession),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+// connect opens a client session, the client logs are dropped.
+func (server *zkServer) connect(t *testing.T) (*zk.Conn, <-chan zk.Event) {
+	conn, events, err := zk.Connect([]string{server.ln.Addr().String()}, 3*time.Second, zk.WithLogger(zkQuietLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, events
+}
+
+type zkQuietLogger struct{}
+
+func (zkQuietLogger) Printf(format string, args ...interface{}) {}
+
+func (server *zkServer) serve(conn net.Conn) {
+	defer conn.Close()
+	packet, err := readZkPacket(conn)
+	if err != nil {
+		return
+	}
+	r := &zkReader{packet}
+	r.int32() // protocol version
+	r.int64() // last zxid seen
+	timeout := r.int32()
+	session := server.open(r.int64(), timeout, conn)
+	if session == nil {
+		return
+	}
+	for {
+		packet, err := readZkPacket(conn)
+		if err != nil {
+			return
+		}
+		r := &zkReader{packet}
+		xid, op := r.int32(), r.int32()
+		if !server.handle(session, xid, op, r) {
+			return
+		}
+	}
+}
+
+// open answers the connect request of a client, a session unknown to the
+// server expired and the client is told so with session id 0.
+func (server *zkServer) open(id int64, timeout int32, conn net.Conn) *zkSession {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	session := server.sessions[id]
+	if session == nil && id == 0 {
+		server.lastSession++
+		session = &zkSession{id: server.lastSession, childWatches: make(map[string]bool)}
+		server.sessions[session.id] = session
+	}
+	w := &zkWriter{}
+	w.int32(0)
+	if session == nil {
+		w.int32(0)
+		w.int64(0)
+		w.bytes(make([]byte, 16))
+		writeZkPacket(conn, w.buf)
+		return nil
+	}
+	session.conn = conn
+	w.int32(timeout)
+	w.int64(session.id)
+	w.bytes(make([]byte, 16))
+	writeZkPacket(conn, w.buf)
+	return session
+}
+
+// handle answers a request of session, false once the session is closed.
+func (server *zkServer) handle(session *zkSession, xid int32, op int32, r *zkReader) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.zxid++
+	w := &zkWriter{}
+	w.int32(xid)
+	w.int64(server.zxid)
+	w.int32(0)
+	var code int32
+	switch op {
+	case zkOpPing:
+	case zkOpClose:
+		server.expire(session.id)
+		writeZkPacket(session.conn, w.buf)
+		return false
+	case zkOpCreate:
+		path, data := r.string(), r.bytes()
+		for n := r.int32(); n > 0; n-- {
+			r.int32() // perms
+			r.string()
+			r.string()
+		}
+		var owner int64
+		if r.int32()&zk.FlagEphemeral != 0 {
+			owner = session.id
+		}
+		if code = server.create(path, data, owner); code == 0 {
+			w.string(path)
+		}
+	case zkOpDelete:
+		code = server.delete(r.string())
+	case zkOpExists:
+		if node, ok := server.nodes[r.string()]; ok {
+			w.stat(node)
+		} else {
+			code = zkErrNoNode
+		}
+	case zkOpSetData:
+		if node, ok := server.nodes[r.string()]; ok {
+			node.data = r.bytes()
+			w.stat(node)
+		} else {
+			code = zkErrNoNode
+		}
+	case zkOpGetChildren2:
+		path, watch := r.string(), r.bool()
+		node, ok := server.nodes[path]
+		if !ok {
+			code = zkErrNoNode
+			break
+		}
+		if watch {
+			session.childWatches[path] = true
+		}
+		w.strings(server.children(path))
+		w.stat(node)
+	case zkOpSetWatches:
+		r.int64()   // relative zxid
+		r.strings() // data watches
+		r.strings() // exist watches
+		for _, path := range r.strings() {
+			session.childWatches[path] = true
+		}
+	default:
+		code = zkErrUnimplemented
+	}
+	if code != 0 {
+		w.buf = w.buf[:12]
+		w.int32(code)
+	}
+	writeZkPacket(session.conn, w.buf)
+	return true
+}
+
+func (server *zkServer) create(path string, data []byte, owner int64) int32 {
+	if _, ok := server.nodes[path]; ok {
+		return zkErrNodeExists
+	}
+	parent := zkParent(path)
+	if _, ok := server.nodes[parent]; !ok {
+		return zkErrNoNode
+	}
+	server.nodes[path] = &zkNode{data: append([]byte{}, data...), owner: owner}
+	server.childrenChanged(parent)
+	return 0
+}
+
+func (server *zkServer) delete(path string) int32 {
+	if _, ok := server.nodes[path]; !ok {
+		return zkErrNoNode
+	}
+	delete(server.nodes, path)
+	server.childrenChanged(zkParent(path))
+	return 0
+}
+
+func (server *zkServer) children(path string) []string {
+	children := []string{}
+	for child := range server.nodes {
+		if child != "/" && zkParent(child) == path {
+			children = append(children, child[strings.LastIndex(child, "/")+1:])
+		}
+	}
+	return children
+}
+
+// childrenChanged fires the children watches of path, a watch fires once.
+func (server *zkServer) childrenChanged(path string) {
+	for _, session := range server.sessions {
+		if !session.childWatches[path] {
+			continue
+		}
+		delete(session.childWatches, path)
+		w := &zkWriter{}
+		w.int32(-1)
+		w.int64(server.zxid)
+		w.int32(0)
+		w.int32(int32(zk.EventNodeChildrenChanged))
+		w.int32(3) // SyncConnected
+		w.string(path)
+		writeZkPacket(session.conn, w.buf)
+	}
+}
+
+// expire drops a session and its ephemeral nodes.
+func (server *zkServer) expire(id int64) {
+	for path, node := range server.nodes {
+		if node.owner == id {
+			server.delete(path)
+		}
+	}
+	delete(server.sessions, id)
+}
+
+// expireSessions expires every session as if its client was gone past the
+// session timeout, the clients are disconnected and told the session expired
+// when they connect again.
+func (server *zkServer) expireSessions() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for id, session := range server.sessions {
+		server.expire(id)
+		session.conn.Close()
+	}
+}
+
+// add creates a persistent node, the parent must exist.
+func (server *zkServer) add(path string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.create(path, nil, 0)
+}
+
+// remove deletes a node, its session is not told unless it watches the parent.
+func (server *zkServer) remove(path string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.delete(path)
+}
+
+// data returns the data of a node, nil if it does not exist.
+func (server *zkServer) data(path string) []byte {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if node, ok := server.nodes[path]; ok {
+		return node.data
+	}
+	return nil
+}
+
+func zkParent(path string) string {
+	if i := strings.LastIndex(path, "/"); i > 0 {
+		return path[:i]
+	}
+	return "/"
+}
+
+func readZkPacket(conn net.Conn) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, binary.BigEndian.Uint32(size[:]))
+	_, err := io.ReadFull(conn, packet)
+	return packet, err
+}
+
+func writeZkPacket(conn net.Conn, packet []byte) {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(packet)))
+	conn.Write(append(size[:], packet...))
+}
+
+// zkReader decodes the fields of a packet in order.
+type zkReader struct {
+	buf []byte
+}
+
+func (r *zkReader) int32() int32 {
+	if len(r.buf) < 4 {
+		r.buf = nil
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(r.buf))
+	r.buf = r.buf[4:]
+	return v
+}
+
+func (r *zkReader) int64() int64 {
+	return int64(r.int32())<<32 | int64(uint32(r.int32()))
+}
+
+func (r *zkReader) bool() bool {
+	if len(r.buf) < 1 {
+		return false
+	}
+	v := r.buf[0] != 0
+	r.buf = r.buf[1:]
+	return v
+}
+
+func (r *zkReader) bytes() []byte {
+	n := int(r.int32())
+	if n < 0 || n > len(r.buf) {
+		return nil
+	}
+	v := r.buf[:n]
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *zkReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *zkReader) strings() []string {
+	var v []string
+	for n := r.int32(); n > 0; n-- {
+		v = append(v, r.string())
+	}
+	return v
+}
+
+// zkWriter encodes the fields of a packet in order.
+type zkWriter struct {
+	buf []byte
+}
+
+func (w *zkWriter) int32(v int32) {
+	w.buf = append(w.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *zkWriter) int64(v int64) {
+	w.int32(int32(v >> 32))
+	w.int32(int32(v))
+}
+
+func (w *zkWriter) bytes(v []byte) {
+	w.int32(int32(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *zkWriter) string(v string) {
+	w.bytes([]byte(v))
+}
+
+func (w *zkWriter) strings(v []string) {
+	w.int32(int32(len(v)))
+	for _, s := range v {
+		w.string(s)
+	}
+}
+
+// stat writes a zk.Stat, only the owner and the data length are kept.
+func (w *zkWriter) stat(node *zkNode) {
+	for i := 0; i < 4; i++ {
+		w.int64(0) // czxid, mzxid, ctime, mtime
+	}
+	for i := 0; i < 3; i++ {
+		w.int32(0) // version, cversion, aversion
+	}
+	w.int64(node.owner)
+	w.int32(int32(len(node.data)))
+	w.int32(0) // children
+	w.int64(0) // pzxid
+}
+
+func newTestProxyCluster(name string) *ProxyClusterConfig {
+	return &ProxyClusterConfig{
+		Cluster:           name,
+		Listen:            "10.0.0.1:6679",
+		Advertise:         "10.0.0.1:6679",
+		Register_interval: 1,
+	}
+}
+
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_ZookeeperRegister(t *testing.T) {
+	server := startZkServer(t)
+	conn, events := server.connect(t)
+	registrar := NewZookeeperRegistrar(conn, events, "/gcache/proxy")
+	defer registrar.Close()
+
+	proxyCluster := newTestProxyCluster("item_cluster")
+	if err := registrar.Register(proxyCluster); err != nil {
+		t.Fatal(err)
+	}
+	data := server.data("/gcache/proxy/item_cluster/10.0.0.1:6679")
+	metadata := &ProxyMetadata{}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		t.Fatalf("node data is not json: %q", data)
+	}
+	if metadata.Cluster != "item_cluster" || metadata.Address != "10.0.0.1:6679" || metadata.Version != Version {
+		t.Errorf("unexpected metadata %+v", metadata)
+	}
+}
+
+func Test_ZookeeperReregisterAfterSessionExpired(t *testing.T) {
+	server := startZkServer(t)
+	conn, events := server.connect(t)
+	registrar := NewZookeeperRegistrar(conn, events, "/gcache/proxy")
+	defer registrar.Close()
+
+	for _, name := range []string{"item_cluster", "user_cluster"} {
+		proxyCluster := newTestProxyCluster(name)
+		// only the session events register the nodes again
+		proxyCluster.Register_interval = 60
+		if err := registrar.Register(proxyCluster); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.expireSessions()
+	if server.data("/gcache/proxy/item_cluster/10.0.0.1:6679") != nil {
+		t.Fatal("ephemeral node kept by the expired session")
+	}
+
+	// the client reconnects after a second, is told the session expired and
+	// connects again after another one
+	waitFor(t, 5*time.Second, func() bool {
+		return server.data("/gcache/proxy/item_cluster/10.0.0.1:6679") != nil &&
+			server.data("/gcache/proxy/user_cluster/10.0.0.1:6679") != nil
+	})
+	waitFor(t, time.Second, func() bool {
+		return registrar.State().SessionState == zk.StateHasSession.String()
+	})
+	state := registrar.State()
+	if state.Expirations != 1 || state.Reregistrations != 2 || len(state.Registered) != 2 {
+		t.Errorf("unexpected registration state %+v", state)
+	}
+}
+
+func Test_ZookeeperRefreshRecreatesLostNode(t *testing.T) {
+	server := startZkServer(t)
+	conn, events := server.connect(t)
+	registrar := NewZookeeperRegistrar(conn, events, "/gcache/proxy")
+	defer registrar.Close()
+
+	registrar.Register(newTestProxyCluster("item_cluster"))
+	// the node is lost but no event is delivered
+	server.remove("/gcache/proxy/item_cluster/10.0.0.1:6679")
+
+	waitFor(t, 3*time.Second, func() bool {
+		return server.data("/gcache/proxy/item_cluster/10.0.0.1:6679") != nil
+	})
+}
+
+func Test_WatchServers(t *testing.T) {
+	server := startZkServer(t)
+	server.add("/gcache")
+	server.add("/gcache/clusters")
+	server.add("/gcache/clusters/item_cluster")
+	server.add("/gcache/clusters/item_cluster/10.0.0.1:7000")
+	conn, _ := server.connect(t)
+
+	changes := make(chan []string, 4)
+	stopped := make(chan struct{})
+	go func() {
+		watchServers(conn, "/gcache/clusters/item_cluster", func(servers []string) {
+			changes <- servers
+		})
+		close(stopped)
+	}()
+	if servers := <-changes; len(servers) != 1 || servers[0] != "10.0.0.1:7000" {
+		t.Errorf("unexpected servers %v", servers)
+	}
+
+	server.add("/gcache/clusters/item_cluster/10.0.0.2:7000")
+	if servers := <-changes; len(servers) != 2 {
+		t.Errorf("unexpected servers %v", servers)
+	}
+
+	server.remove("/gcache/clusters/item_cluster/10.0.0.1:7000")
+	if servers := <-changes; len(servers) != 1 || servers[0] != "10.0.0.2:7000" {
+		t.Errorf("unexpected servers %v", servers)
+	}
+
+	// an empty server list never replaces the current one
+	server.remove("/gcache/clusters/item_cluster/10.0.0.2:7000")
+	server.add("/gcache/clusters/item_cluster/10.0.0.3:7000")
+	if servers := <-changes; len(servers) != 1 || servers[0] != "10.0.0.3:7000" {
+		t.Errorf("unexpected servers %v", servers)
+	}
+
+	conn.Close()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Error("watchServers still running after the connection closed")
+	}
+}